@@ -1,29 +1,50 @@
 package main
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	_ "github.com/google/gopacket/layers"
 	"github.com/jashakimov/multiswitcher/internal/api"
 	"github.com/jashakimov/multiswitcher/internal/config"
 	"github.com/jashakimov/multiswitcher/internal/interface_link"
+	"github.com/jashakimov/multiswitcher/internal/journal"
+	"github.com/jashakimov/multiswitcher/internal/ledger"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/priority"
+	"github.com/jashakimov/multiswitcher/internal/service/bpf_forward"
 	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/hitless"
 	"github.com/jashakimov/multiswitcher/internal/service/igmp"
+	"github.com/jashakimov/multiswitcher/internal/service/manager"
 	"github.com/jashakimov/multiswitcher/internal/service/net_listener"
 	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/service/stream"
+	"github.com/jashakimov/multiswitcher/internal/service/udp_forward"
+	"github.com/jashakimov/multiswitcher/internal/service/webhook"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
 	"github.com/jashakimov/multiswitcher/internal/utils"
 	"github.com/vishvananda/netlink"
-	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
+var log = logging.For(logging.System)
+
 var Version string
 
 func main() {
 	fileConfig := utils.ParseFlags()
 	cfg := config.NewConfig(fileConfig)
-	log.Println("Версия приложения:", Version)
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+	if err := logging.Configure(cfg.Log.Format, cfg.Log.Level, cfg.Log.Subsystems); err != nil {
+		panic(err)
+	}
+	log.Info("Версия приложения", "version", Version)
+	cfg.AssignIDs()
 
 	link, err := netlink.LinkByName(cfg.Interface)
 	if err != nil {
@@ -34,59 +55,137 @@ func main() {
 		panic(err)
 	}
 
-	db := MakeLocalDB(cfg)
-	interface_link.SetIngressQDisc(copyFrom)
-	interface_link.MirrorTraffic(copyFrom, link, db)
-	interface_link.Configure(link, cfg)
-	statManager := statistic.NewService(link.Attrs().Name, cfg.StatFrequencySec)
+	alloc := priority.NewAllocator()
+	db, err := MakeLocalDB(cfg, alloc)
+	if err != nil {
+		panic(err)
+	}
+	installedFile := cfg.InstalledFile
+	if installedFile == "" {
+		installedFile = fileConfig + ".installed"
+	}
+	installed := ledger.New(installedFile)
+	tc := traffic_control.NewRecorded(traffic_control.NewNetlink(), installed)
+	interface_link.SetIngressQDisc(copyFrom, installed)
+	if cfg.MLDVersion != 0 {
+		if err := interface_link.SetMLDVersion(copyFrom, cfg.MLDVersion); err != nil {
+			log.Error("Ошибка установки версии MLD", logging.Err(err))
+		}
+	}
+	interface_link.MirrorTraffic(tc, copyFrom, link, db.Values())
+	interface_link.Configure(link, cfg, installed)
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = fileConfig + ".state"
+	}
+	state := filter.NewStateStore(stateFile, db)
+	igmpOn := state.Restore()
+
+	historySamples := cfg.HistorySamples
+	if historySamples == 0 {
+		historySamples = config.DefaultHistorySamples
+	}
 	netListener := net_listener.NewService(cfg.Interface)
-	filterManager := filter.NewService(statManager, db, netListener)
-	imgpService := igmp.NewService(db)
+	forwarder := udp_forward.NewService(netListener.Feed)
+	classifier := bpf_forward.NewService(link.Attrs().Name, alloc, installed)
+	merger := hitless.NewService()
+	statManager := statistic.NewService(tc, filter.Owners(db), link.Attrs().Name, copyFrom.Attrs().Name, cfg.StatFrequencySec,
+		historySamples, []statistic.OutputCounter{forwarder, merger}, forwarder, classifier)
+	hub := stream.NewHub(db, statManager, cfg.StatFrequencySec)
+	state = stream.NotifyingState(state, hub)
+	hooks, err := webhook.NewService(cfg.Webhooks, db, statManager, cfg.StatFrequencySec)
+	if err != nil {
+		panic(err)
+	}
+	events := webhook.Journal(newJournal(fileConfig, cfg), hooks)
+	filterManager := filter.NewService(tc, statManager, db, netListener, state, events, merger, forwarder, classifier)
+	imgpService := igmp.NewService(db, state, installed)
+	for _, id := range igmpOn {
+		if err := imgpService.ToggleByID(context.Background(), id, igmp.JoinReport); err != nil {
+			log.Error("Ошибка восстановления IGMP", logging.Err(err))
+		}
+	}
 
 	gin.SetMode(gin.ReleaseMode)
 	server := gin.New()
-	server.Use(gin.Recovery(), gin.Logger())
-	api.RegisterAPI(server, db, filterManager, imgpService)
+	server.Use(gin.Recovery(), api.Logger())
+	configManager := manager.NewManager(fileConfig, cfg, db, alloc, tc, filterManager, imgpService, state, installed, link, copyFrom)
+	api.RegisterAPI(server, db, filterManager, imgpService, configManager, statManager, events)
+	api.RegisterMetrics(server, db, statManager, netListener)
+	api.RegisterStream(server, hub, cfg.StreamOrigins)
+	api.RegisterWebhooks(server, hooks)
+	api.RegisterHealth(server, db, netListener)
+	api.RegisterHitless(server, db, merger)
+	api.RegisterLogging(server)
 
 	go func() {
-		log.Println("Запущен сервер, порт", cfg.Port)
+		log.Info("Запущен сервер", "port", cfg.Port)
 		if err := server.Run(":" + cfg.Port); err != nil {
 			panic(err)
 		}
 	}()
 
+	go reloadConfig(fileConfig, configManager)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
+	configManager.Shutdown()
 }
 
-func MakeLocalDB(cfg *config.Config) map[int]*filter.Filter {
-	info := make(map[int]*filter.Filter)
-	for i, f := range cfg.Filters {
-
-		info[i+1] = &filter.Filter{
-			Id:                i + 1,
-			InterfaceName:     cfg.Interface,
-			MasterIP:          f.Master.IP,
-			Hostname:          cfg.Hostname,
-			SlaveIP:           f.Slave.IP,
-			DstIP:             f.Route,
-			Title:             f.Title,
-			IsMasterActual:    false,
-			IsIgmpOn:          false,
-			IsReturnToMaster:  false,
-			MasterBytes:       nil,
-			SlaveBytes:        nil,
-			CopyFromInterface: cfg.CopyTrafficFrom,
-			Cfg: filter.Cfg{
-				Tries:      f.SwitchTries,
-				MsToSwitch: cfg.StatFrequencySec,
-				MasterPrio: i + 1,
-				SlavePrio:  i + 1,
-				AutoSwitch: f.AutoSwitch,
-			},
+// reloadConfig перечитывает конфиг по SIGHUP или при изменении файла
+func reloadConfig(fileConfig string, configManager manager.Manager) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	changes := config.Watch(fileConfig, 2*time.Second)
+
+	for {
+		select {
+		case <-hup:
+			log.Info("Получен SIGHUP, перечитываем конфиг")
+		case <-changes:
+			log.Info("Файл конфига изменился, перечитываем")
 		}
+
+		cfg, err := config.Load(fileConfig)
+		if err != nil {
+			log.Error("Ошибка чтения конфига, оставляем прежний", logging.Err(err))
+			continue
+		}
+		if err := configManager.Reload(cfg); err != nil {
+			log.Error("Ошибка применения конфига", logging.Err(err))
+		}
+	}
+}
+
+func newJournal(fileConfig string, cfg *config.Config) journal.Journal {
+	fileName := cfg.EventsFile
+	if fileName == "" {
+		fileName = fileConfig + ".events"
+	}
+	maxSizeKb := cfg.EventsMaxSizeKb
+	if maxSizeKb == 0 {
+		maxSizeKb = config.DefaultEventsMaxSizeKb
+	}
+	maxFiles := cfg.EventsMaxFiles
+	if maxFiles == 0 {
+		maxFiles = config.DefaultEventsMaxFiles
+	}
+	return journal.New(fileName, int64(maxSizeKb)*1024, maxFiles)
+}
+
+func MakeLocalDB(cfg *config.Config, alloc priority.Allocator) (*utils.SyncMap[int, *filter.Filter], error) {
+	info := utils.NewSyncMap[int, *filter.Filter]()
+	var filters []*filter.Filter
+	for _, f := range cfg.Filters {
+		data := filter.FromConfig(f.Id, cfg, f)
+		info.Set(data.Id, data)
+		filters = append(filters, data)
+	}
+
+	if err := filter.ReservePrio(alloc, filters...); err != nil {
+		return nil, err
 	}
 
-	return info
+	return info, nil
 }
@@ -1,11 +1,12 @@
 module github.com/jashakimov/multiswitcher
 
-go 1.20
+go 1.21
 
 require (
 	github.com/gin-gonic/gin v1.9.1
 	github.com/google/gopacket v1.1.19
 	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/net v0.10.0
 	golang.org/x/sys v0.17.0
 	gopkg.in/errgo.v2 v2.1.0
 )
@@ -37,7 +38,6 @@ require (
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
 	golang.org/x/arch v0.3.0 // indirect
 	golang.org/x/crypto v0.9.0 // indirect
-	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
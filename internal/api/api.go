@@ -3,45 +3,84 @@ package api
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/journal"
+	"github.com/jashakimov/multiswitcher/internal/logging"
 	"github.com/jashakimov/multiswitcher/internal/service/filter"
 	"github.com/jashakimov/multiswitcher/internal/service/igmp"
+	"github.com/jashakimov/multiswitcher/internal/service/manager"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
 	"github.com/jashakimov/multiswitcher/internal/utils"
+	"gopkg.in/errgo.v2/fmt/errors"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func RegisterAPI(
 	server *gin.Engine,
-	db map[int]*filter.Filter,
+	db *utils.SyncMap[int, *filter.Filter],
 	filterService filter.Service,
 	igmpService igmp.Service,
+	manager manager.Manager,
+	statManager statistic.Service,
+	journal journal.Journal,
 ) {
 	s := &service{
 		db:            db,
 		filterService: filterService,
 		igmpService:   igmpService,
+		manager:       manager,
+		statManager:   statManager,
+		journal:       journal,
 	}
 
 	server.GET("/stats", s.getConfigs)
 	server.GET("/stats/:id", s.getConfigByID)
+	server.GET("/stats/:id/history", s.getHistory)
+	server.GET("/events", s.getEvents)
 	server.PATCH("/auto-switch/:id/:val", s.setAutoSwitch)
 	server.PATCH("/switch/:id/:name", s.switchFilter)
 	server.PATCH("/igmp/all/:toggle", s.turnOnIgmp)
 	server.PATCH("/igmp/:id/:toggleId", s.turnOnIgmpById)
 	server.PATCH("/return-master/:id/:toggle", s.returnToMaster)
+	server.DELETE("/lockout/:id", s.clearLockout)
+	server.POST("/filters", s.createFilter)
+	server.PUT("/filters/:id", s.updateFilter)
+	server.DELETE("/filters/:id", s.deleteFilter)
+	server.GET("/outputs/:id", s.getOutputs)
+	server.POST("/outputs/:id", s.addOutput)
+	server.DELETE("/outputs/:id/:route", s.deleteOutput)
 }
 
 type service struct {
-	db            map[int]*filter.Filter
+	db            *utils.SyncMap[int, *filter.Filter]
 	filterService filter.Service
 	igmpService   igmp.Service
+	manager       manager.Manager
+	statManager   statistic.Service
+	journal       journal.Journal
+}
+
+type sourceHistory struct {
+	Name    string             `json:"name"`
+	IP      string             `json:"ip"`
+	Samples []statistic.Sample `json:"samples"`
+}
+
+type filterHistory struct {
+	Id           int             `json:"id"`
+	Title        string          `json:"title"`
+	DstIP        string          `json:"dstIP"`
+	ActiveSource string          `json:"activeSource"`
+	Sources      []sourceHistory `json:"sources"`
 }
 
 func (s *service) getConfigs(ctx *gin.Context) {
 	var filters []*filter.Filter
-	for _, f := range s.db {
+	for _, f := range s.db.Values() {
 		filters = append(filters, f)
 	}
 	sort.Slice(filters, func(i, j int) bool {
@@ -58,28 +97,35 @@ func (s *service) switchFilter(ctx *gin.Context) {
 		return
 	}
 	name := strings.ToLower(ctx.Param("name"))
-	if !utils.InSlice(name, []string{"master", "slave"}) {
-		ctx.JSON(http.StatusBadRequest, "Значение только master/slave")
-		return
-	}
 
-	filterInfo, ok := s.db[id]
+	filterInfo, ok := s.db.Get(id)
 	if !ok {
 		ctx.JSON(http.StatusNotFound, "Не найден")
 		return
 	}
 
-	switch {
-	case name == "slave" && !filterInfo.IsMasterActual:
-		ctx.JSON(http.StatusBadRequest, "Фильтр уже на slave")
+	i, ok := filterInfo.SourceIndex(name)
+	if !ok {
+		var names []string
+		for _, src := range filterInfo.Sources {
+			names = append(names, src.Name)
+		}
+		ctx.JSON(http.StatusBadRequest, "Значение только "+strings.Join(names, "/"))
 		return
-	case name == "master" && filterInfo.IsMasterActual:
-		ctx.JSON(http.StatusBadRequest, "Фильтр уже на master")
+	}
+	if filterInfo.IsHitless() {
+		ctx.JSON(http.StatusConflict, filter.ErrHitless.Error())
+		return
+	}
+	if filterInfo.GetActual() == filterInfo.Sources[i] {
+		ctx.JSON(http.StatusBadRequest, "Фильтр уже на "+filterInfo.Sources[i].Name)
 		return
 	}
 
-	s.filterService.ChangeFilter(filterInfo)
-	filterInfo.IsMasterActual = !filterInfo.IsMasterActual
+	if err := s.filterService.SwitchTo(filterInfo, i, filter.ReasonManual, apiClient(ctx)); err != nil {
+		ctx.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	ctx.JSON(http.StatusOK, filterInfo)
 }
@@ -91,7 +137,7 @@ func (s *service) getConfigByID(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, err.Error())
 		return
 	}
-	filterInfo, ok := s.db[id]
+	filterInfo, ok := s.db.Get(id)
 	if !ok {
 		ctx.JSON(http.StatusNotFound, "Not found")
 		return
@@ -100,6 +146,103 @@ func (s *service) getConfigByID(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, filterInfo)
 }
 
+// getHistory битрейт и pps источников связки.
+// from и to - RFC3339 или unix время в секундах, step - интервал усреднения, например 10s
+func (s *service) getHistory(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "id не число")
+		return
+	}
+	filterInfo, ok := s.db.Get(id)
+	if !ok {
+		ctx.JSON(http.StatusNotFound, "Не найден")
+		return
+	}
+
+	from, err := parseTime(ctx.Query("from"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "from: "+err.Error())
+		return
+	}
+	to, err := parseTime(ctx.Query("to"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "to: "+err.Error())
+		return
+	}
+	var step time.Duration
+	if raw := ctx.Query("step"); raw != "" {
+		if step, err = time.ParseDuration(raw); err != nil || step < 0 {
+			ctx.JSON(http.StatusBadRequest, "step должен быть интервалом, например 10s")
+			return
+		}
+	}
+
+	result := filterHistory{
+		Id:           filterInfo.Id,
+		Title:        filterInfo.GetTitle(),
+		DstIP:        filterInfo.DstIP,
+		ActiveSource: filterInfo.GetActual().Name,
+	}
+	for _, src := range filterInfo.Sources {
+		samples := s.statManager.History(filterInfo.StatKey(src), from, to)
+		result.Sources = append(result.Sources, sourceHistory{
+			Name:    src.Name,
+			IP:      src.IP,
+			Samples: statistic.Downsample(samples, step),
+		})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+// getEvents журнал переключений, параметры: filter_id, reason, source, from, to, limit
+func (s *service) getEvents(ctx *gin.Context) {
+	var q journal.Query
+	var err error
+	if raw := ctx.Query("filter_id"); raw != "" {
+		if q.FilterId, err = strconv.Atoi(raw); err != nil {
+			ctx.JSON(http.StatusBadRequest, "filter_id не число")
+			return
+		}
+	}
+	if raw := ctx.Query("limit"); raw != "" {
+		if q.Limit, err = strconv.Atoi(raw); err != nil || q.Limit < 0 {
+			ctx.JSON(http.StatusBadRequest, "limit должен быть положительным числом")
+			return
+		}
+	}
+	if q.From, err = parseTime(ctx.Query("from")); err != nil {
+		ctx.JSON(http.StatusBadRequest, "from: "+err.Error())
+		return
+	}
+	if q.To, err = parseTime(ctx.Query("to")); err != nil {
+		ctx.JSON(http.StatusBadRequest, "to: "+err.Error())
+		return
+	}
+	q.Reason = ctx.Query("reason")
+	q.Source = ctx.Query("source")
+
+	ctx.JSON(http.StatusOK, s.journal.Query(q))
+}
+
+// apiClient кто обратился к API: адрес клиента и имя оператора из заголовка X-Operator, если есть
+func apiClient(ctx *gin.Context) string {
+	if operator := ctx.GetHeader("X-Operator"); operator != "" {
+		return operator + "@" + ctx.ClientIP()
+	}
+	return ctx.ClientIP()
+}
+
+func parseTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
 func (s *service) setAutoSwitch(ctx *gin.Context) {
 	rawId := ctx.Param("id")
 	id, err := strconv.Atoi(rawId)
@@ -119,18 +262,19 @@ func (s *service) setAutoSwitch(ctx *gin.Context) {
 		return
 	}
 
-	filterInfo, ok := s.db[id]
+	filterInfo, ok := s.db.Get(id)
 	if !ok {
 		ctx.JSON(http.StatusNotFound, "Не найден")
 		return
 	}
 
-	filterInfo.Cfg.AutoSwitch = autoSwitchVal
-
-	if filterInfo.Cfg.AutoSwitch {
-		go s.filterService.AutoSwitch(filterInfo)
+	if autoSwitchVal && filterInfo.GetLockout() != nil {
+		ctx.JSON(http.StatusConflict, "Связка заблокирована защитой от переключений, сначала снимите блокировку")
+		return
 	}
 
+	s.filterService.SetAutoSwitch(filterInfo, autoSwitchVal)
+
 	ctx.JSON(http.StatusOK, filterInfo)
 }
 
@@ -177,7 +321,7 @@ func (s *service) returnToMaster(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, "id не число")
 		return
 	}
-	filterInfo, ok := s.db[id]
+	filterInfo, ok := s.db.Get(id)
 	if !ok {
 		ctx.JSON(http.StatusNotFound, "Не найден")
 		return
@@ -186,13 +330,13 @@ func (s *service) returnToMaster(ctx *gin.Context) {
 	var toggle bool
 	switch strings.ToLower(ctx.Param("toggle")) {
 	case "on":
-		if filterInfo.IsReturnToMaster {
+		if filterInfo.GetReturnToMaster() {
 			ctx.String(http.StatusBadRequest, "Параметр уже включен\n")
 			return
 		}
 		toggle = true
 	case "off":
-		if !filterInfo.IsReturnToMaster {
+		if !filterInfo.GetReturnToMaster() {
 			ctx.String(http.StatusBadRequest, "Параметр уже выключен\n")
 			return
 		}
@@ -202,7 +346,92 @@ func (s *service) returnToMaster(ctx *gin.Context) {
 		return
 	}
 
-	s.filterService.ReturnToMaster(filterInfo, toggle)
+	if err := s.filterService.ReturnToMaster(filterInfo, toggle); err != nil {
+		ctx.String(http.StatusConflict, err.Error()+"\n")
+		return
+	}
 
 	ctx.String(http.StatusOK, fmt.Sprintf("Режим возврат на мастер: %v\n", toggle))
 }
+
+func (s *service) createFilter(ctx *gin.Context) {
+	var fc config.Filter
+	if err := ctx.ShouldBindJSON(&fc); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filterInfo, err := s.manager.Create(fc)
+	if err != nil {
+		ctx.JSON(managerStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(http.StatusCreated, filterInfo)
+}
+
+func (s *service) updateFilter(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "id не число")
+		return
+	}
+	var fc config.Filter
+	if err := ctx.ShouldBindJSON(&fc); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filterInfo, err := s.manager.Update(id, fc)
+	if err != nil {
+		ctx.JSON(managerStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, filterInfo)
+}
+
+func (s *service) deleteFilter(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "id не число")
+		return
+	}
+
+	if err := s.manager.Delete(id); err != nil {
+		ctx.JSON(managerStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, fmt.Sprintf("Связка %d удалена", id))
+}
+
+// clearLockout снятие блокировки защиты от переключений, автопереключение возвращается в прежнее состояние
+func (s *service) clearLockout(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "id не число")
+		return
+	}
+	filterInfo, ok := s.db.Get(id)
+	if !ok {
+		ctx.JSON(http.StatusNotFound, "Не найден")
+		return
+	}
+	if filterInfo.GetLockout() == nil {
+		ctx.JSON(http.StatusBadRequest, "Связка не заблокирована")
+		return
+	}
+
+	log.Info("Снятие блокировки через API", logging.KeyFilterID, id, "client", apiClient(ctx))
+	s.filterService.ClearLockout(filterInfo)
+	ctx.JSON(http.StatusOK, filterInfo)
+}
+
+func managerStatus(err error) int {
+	switch errors.Cause(err) {
+	case manager.ErrNotFound:
+		return http.StatusNotFound
+	case manager.ErrInvalid:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
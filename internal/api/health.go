@@ -0,0 +1,66 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/net_listener"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"net/http"
+	"strconv"
+)
+
+type sourceHealth struct {
+	Name   string                 `json:"name"`
+	IP     string                 `json:"ip"`
+	Active bool                   `json:"active"`
+	TS     *net_listener.TSHealth `json:"ts,omitempty"`
+	RTP    *net_listener.RTPStats `json:"rtp,omitempty"`
+}
+
+type filterHealth struct {
+	Id             int            `json:"id"`
+	Title          string         `json:"title"`
+	DstIP          string         `json:"dstIP"`
+	TSMaxErrorRate float64        `json:"tsMaxErrorRate"`
+	RTPMaxLossRate float64        `json:"rtpMaxLossRate"`
+	RTPMaxJitterMs float64        `json:"rtpMaxJitterMs"`
+	Sources        []sourceHealth `json:"sources"`
+}
+
+// RegisterHealth ошибки MPEG-TS, потери и джиттер RTP источников связки
+func RegisterHealth(server *gin.Engine, db *utils.SyncMap[int, *filter.Filter], listener net_listener.Listener) {
+	server.GET("/health/:id", func(ctx *gin.Context) {
+		id, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, "id не число")
+			return
+		}
+		f, ok := db.Get(id)
+		if !ok {
+			ctx.JSON(http.StatusNotFound, "Not found")
+			return
+		}
+
+		cfg := f.GetCfg()
+		resp := filterHealth{
+			Id:             f.Id,
+			Title:          f.GetTitle(),
+			DstIP:          f.DstIP,
+			TSMaxErrorRate: cfg.TSMaxErrorRate,
+			RTPMaxLossRate: cfg.RTPMaxLossRate,
+			RTPMaxJitterMs: cfg.RTPMaxJitterMs,
+		}
+		actual := f.GetActual()
+		for _, src := range f.Sources {
+			health := sourceHealth{Name: src.Name, IP: src.IP, Active: src == actual}
+			if ts, ok := listener.Health(src.Key()); ok {
+				health.TS = &ts
+			}
+			if rtp, ok := listener.RTP(src.Key()); ok {
+				health.RTP = &rtp
+			}
+			resp.Sources = append(resp.Sources, health)
+		}
+		ctx.JSON(http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/hitless"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"net/http"
+	"strconv"
+)
+
+type legHitless struct {
+	Name string `json:"name"`
+	hitless.LegStats
+}
+
+type filterHitless struct {
+	Id         int             `json:"id"`
+	Title      string          `json:"title"`
+	DstIP      string          `json:"dstIP"`
+	Hitless    *config.Hitless `json:"hitless"`
+	Running    bool            `json:"running"`
+	Packets    uint64          `json:"packets"`
+	Bytes      uint64          `json:"bytes"`
+	Duplicates uint64          `json:"duplicates"`
+	Lost       uint64          `json:"lost"`
+	Invalid    uint64          `json:"invalid"`
+	Legs       []legHitless    `json:"legs"`
+}
+
+// RegisterHitless счетчики объединения потоков связки по путям
+func RegisterHitless(server *gin.Engine, db *utils.SyncMap[int, *filter.Filter], merger hitless.Service) {
+	server.GET("/hitless/:id", func(ctx *gin.Context) {
+		id, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, "id не число")
+			return
+		}
+		f, ok := db.Get(id)
+		if !ok {
+			ctx.JSON(http.StatusNotFound, "Not found")
+			return
+		}
+		if !f.IsHitless() {
+			ctx.JSON(http.StatusBadRequest, "Связка не в режиме hitless")
+			return
+		}
+
+		resp := filterHitless{Id: f.Id, Title: f.GetTitle(), DstIP: f.DstIP, Hitless: f.Cfg.Hitless}
+		stats, running := merger.Stats(f.Id)
+		resp.Running = running
+		resp.Packets, resp.Bytes = stats.Packets, stats.Bytes
+		resp.Duplicates, resp.Lost, resp.Invalid = stats.Duplicates, stats.Lost, stats.Invalid
+		for i, src := range f.Sources {
+			leg := legHitless{Name: src.Name, LegStats: hitless.LegStats{IP: src.Key()}}
+			if i < len(stats.Legs) {
+				leg.LegStats = stats.Legs[i]
+			}
+			resp.Legs = append(resp.Legs, leg)
+		}
+		ctx.JSON(http.StatusOK, resp)
+	})
+}
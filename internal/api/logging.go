@@ -0,0 +1,60 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var log = logging.For(logging.API)
+
+// RegisterLogging уровни логов подсистем, default - уровень по умолчанию
+func RegisterLogging(server *gin.Engine) {
+	server.GET("/log-levels", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, logging.Levels())
+	})
+	server.PATCH("/log-level/:subsystem/:level", func(ctx *gin.Context) {
+		subsystem := ctx.Param("subsystem")
+		if subsystem != logging.Default && !knownSubsystem(subsystem) {
+			ctx.JSON(http.StatusNotFound, "Нет подсистемы "+subsystem)
+			return
+		}
+		if err := logging.SetLevel(subsystem, ctx.Param("level")); err != nil {
+			ctx.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Info("Изменен уровень логов", "target", subsystem, "level", ctx.Param("level"), "client", apiClient(ctx))
+		ctx.JSON(http.StatusOK, logging.Levels())
+	})
+}
+
+// Logger запись запросов к API вместо gin.Logger
+func Logger() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		lvl := slog.LevelInfo
+		if ctx.Writer.Status() >= http.StatusInternalServerError {
+			lvl = slog.LevelError
+		}
+		log.Log(ctx, lvl, "Запрос",
+			"method", ctx.Request.Method,
+			"path", ctx.Request.URL.Path,
+			"status", ctx.Writer.Status(),
+			"latency", time.Since(start),
+			"client", apiClient(ctx),
+		)
+	}
+}
+
+func knownSubsystem(name string) bool {
+	for _, s := range logging.Subsystems() {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
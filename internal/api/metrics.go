@@ -0,0 +1,205 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/net_listener"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var switchReasons = []filter.Reason{
+	filter.ReasonAuto, filter.ReasonManual, filter.ReasonReturnToMaster, filter.ReasonReload, filter.ReasonTSErrors,
+	filter.ReasonBitrate, filter.ReasonFlapLock, filter.ReasonRTP,
+}
+
+// RegisterMetrics метрики в текстовом формате Prometheus
+func RegisterMetrics(
+	server *gin.Engine,
+	db *utils.SyncMap[int, *filter.Filter],
+	statManager statistic.Service,
+	listener net_listener.Listener,
+) {
+	m := &metrics{
+		db:          db,
+		statManager: statManager,
+		listener:    listener,
+	}
+
+	server.GET("/metrics", m.getMetrics)
+}
+
+type metrics struct {
+	db          *utils.SyncMap[int, *filter.Filter]
+	statManager statistic.Service
+	listener    net_listener.Listener
+}
+
+func (m *metrics) getMetrics(ctx *gin.Context) {
+	var filters []*filter.Filter
+	for _, f := range m.db.Values() {
+		filters = append(filters, f)
+	}
+	sort.Slice(filters, func(i, j int) bool {
+		return filters[i].Id < filters[j].Id
+	})
+
+	w := &metricsWriter{}
+
+	w.family("multiswitcher_filter_bytes_total", "counter", "Байты, переданные nat фильтром активного источника")
+	w.family("multiswitcher_filter_packets_total", "counter", "Пакеты, переданные nat фильтром активного источника")
+	w.family("multiswitcher_filter_bitrate_bits_per_second", "gauge", "Битрейт на выходе связки, бит/с")
+	for _, f := range filters {
+		stats, err := m.statManager.GetStatsByIP(f.StatKey(f.GetActual()))
+		if err != nil {
+			continue
+		}
+		labels := filterLabels(f)
+		w.sample("multiswitcher_filter_bytes_total", labels, float64(stats.Bytes))
+		w.sample("multiswitcher_filter_packets_total", labels, float64(stats.Packets))
+		w.sample("multiswitcher_filter_bitrate_bits_per_second", labels, stats.Bitrate)
+	}
+
+	w.family("multiswitcher_output_bytes_total", "counter", "Байты, отправленные в дополнительный выход связки")
+	w.family("multiswitcher_output_packets_total", "counter", "Пакеты, отправленные в дополнительный выход связки")
+	w.family("multiswitcher_output_bitrate_bits_per_second", "gauge", "Битрейт в дополнительном выходе связки, бит/с")
+	for _, f := range filters {
+		for _, o := range f.GetOutputs() {
+			stats, err := m.statManager.GetOutputStatsByIP(o.Route)
+			if err != nil {
+				continue
+			}
+			labels := append(filterLabels(f), "output", o.Route, "interface", o.Interface)
+			w.sample("multiswitcher_output_bytes_total", labels, float64(stats.Bytes))
+			w.sample("multiswitcher_output_packets_total", labels, float64(stats.Packets))
+			w.sample("multiswitcher_output_bitrate_bits_per_second", labels, stats.Bitrate)
+		}
+	}
+
+	w.family("multiswitcher_source_bytes_total", "counter", "Байты от источника по счетчику зеркалирования")
+	w.family("multiswitcher_source_packets_total", "counter", "Пакеты от источника по счетчику зеркалирования")
+	w.family("multiswitcher_source_bitrate_bits_per_second", "gauge", "Битрейт источника, бит/с")
+	w.family("multiswitcher_source_active", "gauge", "1 у активного источника связки")
+	for _, f := range filters {
+		actual := f.GetActual()
+		for _, src := range f.Sources {
+			labels := sourceLabels(f, src)
+			if stats, err := m.statManager.GetSourceStatsByIP(f.StatKey(src)); err == nil {
+				w.sample("multiswitcher_source_bytes_total", labels, float64(stats.Bytes))
+				w.sample("multiswitcher_source_packets_total", labels, float64(stats.Packets))
+				w.sample("multiswitcher_source_bitrate_bits_per_second", labels, stats.Bitrate)
+			}
+			w.sample("multiswitcher_source_active", labels, flag(src == actual))
+		}
+	}
+
+	w.family("multiswitcher_source_rtp_lost_total", "counter", "Потерянные RTP пакеты источника по номерам")
+	w.family("multiswitcher_source_rtp_reordered_total", "counter", "RTP пакеты источника не по порядку")
+	w.family("multiswitcher_source_rtp_loss_rate", "gauge", "Доля потерянных RTP пакетов за последнюю секунду")
+	w.family("multiswitcher_source_rtp_jitter_ms", "gauge", "Джиттер RTP источника по RFC 3550, мс")
+	for _, f := range filters {
+		for _, src := range f.Sources {
+			rtp, ok := m.listener.RTP(src.Key())
+			if !ok {
+				continue
+			}
+			labels := sourceLabels(f, src)
+			w.sample("multiswitcher_source_rtp_lost_total", labels, float64(rtp.Lost))
+			w.sample("multiswitcher_source_rtp_reordered_total", labels, float64(rtp.Reordered))
+			w.sample("multiswitcher_source_rtp_loss_rate", labels, rtp.LossRate)
+			w.sample("multiswitcher_source_rtp_jitter_ms", labels, rtp.JitterMs)
+		}
+	}
+
+	w.family("multiswitcher_switches_total", "counter", "Переключения связки по причинам")
+	for _, f := range filters {
+		switches := f.GetSwitches()
+		for _, reason := range switchReasons {
+			labels := append(filterLabels(f), "reason", string(reason))
+			w.sample("multiswitcher_switches_total", labels, float64(switches[reason]))
+		}
+	}
+
+	w.family("multiswitcher_filter_autoswitch", "gauge", "1 если включено автопереключение")
+	w.family("multiswitcher_filter_igmp", "gauge", "1 если включена подписка IGMP")
+	w.family("multiswitcher_filter_return_to_master", "gauge", "1 если включен возврат на мастер")
+	w.family("multiswitcher_filter_locked", "gauge", "1 если связка заблокирована защитой от переключений")
+	for _, f := range filters {
+		labels := filterLabels(f)
+		w.sample("multiswitcher_filter_autoswitch", labels, flag(f.GetAutoSwitch()))
+		w.sample("multiswitcher_filter_igmp", labels, flag(f.IsIgmpOn))
+		w.sample("multiswitcher_filter_return_to_master", labels, flag(f.GetReturnToMaster()))
+		w.sample("multiswitcher_filter_locked", labels, flag(f.GetLockout() != nil))
+	}
+
+	if lastPoll := m.statManager.LastPoll(); !lastPoll.IsZero() {
+		w.family("multiswitcher_stats_poll_age_seconds", "gauge", "Время с последнего опроса счетчиков tc")
+		w.sample("multiswitcher_stats_poll_age_seconds", nil, time.Since(lastPoll).Seconds())
+	}
+
+	ctx.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(w.String()))
+}
+
+func filterLabels(f *filter.Filter) []string {
+	return []string{"filter_id", strconv.Itoa(f.Id), "title", f.GetTitle(), "route", f.DstIP}
+}
+
+func sourceLabels(f *filter.Filter, src *filter.Source) []string {
+	return append(filterLabels(f), "source", src.Name, "source_ip", src.IP)
+}
+
+func flag(on bool) float64 {
+	if on {
+		return 1
+	}
+	return 0
+}
+
+// metricsWriter текстовый формат Prometheus. Сэмплы копятся по семействам,
+// чтобы в выводе они шли одной группой после своего TYPE. labels - пары имя, значение
+type metricsWriter struct {
+	names    []string
+	families map[string]*strings.Builder
+}
+
+func (w *metricsWriter) family(name, typ, help string) {
+	if w.families == nil {
+		w.families = make(map[string]*strings.Builder)
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	w.names = append(w.names, name)
+	w.families[name] = b
+}
+
+func (w *metricsWriter) sample(name string, labels []string, value float64) {
+	b := w.families[name]
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(b, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (w *metricsWriter) String() string {
+	var out strings.Builder
+	for _, name := range w.names {
+		out.WriteString(w.families[name].String())
+	}
+	return out.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
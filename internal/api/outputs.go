@@ -0,0 +1,87 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"net/http"
+	"strconv"
+)
+
+type outputStats struct {
+	filter.Output
+	Stats *statistic.Stats `json:"stats"`
+}
+
+type filterOutputs struct {
+	Id           int           `json:"id"`
+	Title        string        `json:"title"`
+	DstIP        string        `json:"dstIP"`
+	ActiveSource string        `json:"activeSource"`
+	Outputs      []outputStats `json:"outputs"`
+}
+
+// getOutputs выходы связки со счетчиками, у выхода без отправленных пакетов stats - null
+func (s *service) getOutputs(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "id не число")
+		return
+	}
+	f, ok := s.db.Get(id)
+	if !ok {
+		ctx.JSON(http.StatusNotFound, "Не найден")
+		return
+	}
+
+	resp := filterOutputs{Id: f.Id, Title: f.GetTitle(), DstIP: f.DstIP, ActiveSource: f.GetActual().Name}
+	for _, o := range f.GetOutputs() {
+		out := outputStats{Output: o}
+		if stats, err := s.statManager.GetOutputStatsByIP(o.Route); err == nil {
+			out.Stats = &stats
+		}
+		resp.Outputs = append(resp.Outputs, out)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// addOutput новый выход связки, тело - {"route": "...", "interface": "..."}
+func (s *service) addOutput(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "id не число")
+		return
+	}
+	var o config.Output
+	if err := ctx.ShouldBindJSON(&o); err != nil {
+		ctx.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Info("Добавление выхода через API", logging.KeyFilterID, id, "output", o.Route, "client", apiClient(ctx))
+	filterInfo, err := s.manager.AddOutput(id, o)
+	if err != nil {
+		ctx.JSON(managerStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(http.StatusCreated, filterInfo)
+}
+
+func (s *service) deleteOutput(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "id не число")
+		return
+	}
+	route := ctx.Param("route")
+
+	log.Info("Удаление выхода через API", logging.KeyFilterID, id, "output", route, "client", apiClient(ctx))
+	filterInfo, err := s.manager.DelOutput(id, route)
+	if err != nil {
+		ctx.JSON(managerStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, filterInfo)
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/service/stream"
+	"golang.org/x/net/websocket"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const streamPingInterval = 15 * time.Second
+
+// RegisterStream поток изменений состояния связок в формате Server-Sent Events и по WebSocket.
+// origins - страницы, с которых браузер может открыть WebSocket, кроме адреса самого API
+func RegisterStream(server *gin.Engine, hub stream.Hub, origins []string) {
+	s := &streamAPI{hub: hub, origins: origins}
+
+	server.GET("/stream", s.getStream)
+	server.GET("/stream/ws", s.getStreamWS)
+}
+
+type streamAPI struct {
+	hub     stream.Hub
+	origins []string
+}
+
+type wsMessage struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// getStream при подключении отдает snapshot, дальше update и removed по мере изменений.
+// filter_id - подписка на связки, через запятую или несколько параметров
+func (s *streamAPI) getStream(ctx *gin.Context) {
+	ids, err := streamIDs(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "filter_id не число")
+		return
+	}
+
+	snapshot, messages, unsubscribe := s.hub.Subscribe(ids)
+	defer unsubscribe()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.SSEvent("snapshot", snapshot)
+	ctx.Writer.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-ping.C:
+			ctx.SSEvent("ping", time.Now().Unix())
+			return true
+		case msg, ok := <-messages:
+			if !ok {
+				// не успевал читать, пусть переподключится и получит свежий snapshot
+				return false
+			}
+			ctx.SSEvent(msg.Event, messageData(msg))
+			return true
+		}
+	})
+}
+
+// getStreamWS то же, что getStream, но по WebSocket: {"event": ..., "data": ...}
+func (s *streamAPI) getStreamWS(ctx *gin.Context) {
+	ids, err := streamIDs(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, "filter_id не число")
+		return
+	}
+
+	// без проверки Origin любая открытая в браузере страница читала бы состояние связок
+	websocket.Server{Handshake: s.checkOrigin, Handler: func(conn *websocket.Conn) {
+		defer conn.Close()
+
+		snapshot, messages, unsubscribe := s.hub.Subscribe(ids)
+		defer unsubscribe()
+
+		// входящие сообщения не нужны, чтение только чтобы заметить закрытие соединения
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for websocket.Message.Receive(conn, &discard) == nil {
+			}
+		}()
+
+		if websocket.JSON.Send(conn, wsMessage{Event: "snapshot", Data: snapshot}) != nil {
+			return
+		}
+		ping := time.NewTicker(streamPingInterval)
+		defer ping.Stop()
+		for {
+			var out wsMessage
+			select {
+			case <-closed:
+				return
+			case <-ping.C:
+				out = wsMessage{Event: "ping", Data: time.Now().Unix()}
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				out = wsMessage{Event: msg.Event, Data: messageData(msg)}
+			}
+			if websocket.JSON.Send(conn, out) != nil {
+				return
+			}
+		}
+	}}.ServeHTTP(ctx.Writer, ctx.Request)
+}
+
+// checkOrigin подключение с адреса API или из streamOrigins, ошибка - ответ 403.
+// Без Origin подключаются не браузеры, им проверка не нужна
+func (s *streamAPI) checkOrigin(_ *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return nil
+	}
+	for _, allowed := range s.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return nil
+		}
+	}
+	return errors.Newf("origin %s не разрешен", origin)
+}
+
+// streamIDs filter_id через запятую или несколькими параметрами
+func streamIDs(ctx *gin.Context) ([]int, error) {
+	var ids []int
+	for _, raw := range ctx.QueryArray("filter_id") {
+		for _, part := range strings.Split(raw, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func messageData(msg stream.Message) interface{} {
+	if msg.Event == stream.EventRemoved {
+		return gin.H{"id": msg.State.Id}
+	}
+	return msg.State
+}
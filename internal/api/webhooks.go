@@ -0,0 +1,14 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jashakimov/multiswitcher/internal/service/webhook"
+	"net/http"
+)
+
+// RegisterWebhooks состояние доставки webhook
+func RegisterWebhooks(server *gin.Engine, hooks webhook.Service) {
+	server.GET("/webhooks", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, hooks.Status())
+	})
+}
@@ -0,0 +1,154 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// регистры eBPF: R0 - результат, R1-R5 - аргументы вызовов, R6-R9 сохраняются при вызовах, R10 - стек
+const (
+	R0 uint8 = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+)
+
+// размеры обращений к памяти
+const (
+	W  = unix.BPF_W
+	H  = unix.BPF_H
+	B  = unix.BPF_B
+	DW = unix.BPF_DW
+)
+
+// helper функции ядра
+const (
+	FuncMapLookupElem = 1
+	FuncSkbStoreBytes = 9
+	FuncL3CsumReplace = 10
+	FuncL4CsumReplace = 11
+)
+
+type insn struct {
+	code  uint8
+	dst   uint8
+	src   uint8
+	off   int16
+	imm   int32
+	label string
+}
+
+// Asm сборка программы eBPF по инструкциям, переходы - по меткам
+type Asm struct {
+	insns  []insn
+	labels map[string]int
+}
+
+func (a *Asm) add(i insn) {
+	a.insns = append(a.insns, i)
+}
+
+func (a *Asm) Label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *Asm) Mov64(dst, src uint8) {
+	a.add(insn{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X, dst: dst, src: src})
+}
+
+func (a *Asm) Mov64Imm(dst uint8, imm int32) {
+	a.add(insn{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, dst: dst, imm: imm})
+}
+
+func (a *Asm) Add64Imm(dst uint8, imm int32) {
+	a.add(insn{code: unix.BPF_ALU64 | unix.BPF_ADD | unix.BPF_K, dst: dst, imm: imm})
+}
+
+func (a *Asm) And64Imm(dst uint8, imm int32) {
+	a.add(insn{code: unix.BPF_ALU64 | unix.BPF_AND | unix.BPF_K, dst: dst, imm: imm})
+}
+
+func (a *Asm) Lsh64Imm(dst uint8, imm int32) {
+	a.add(insn{code: unix.BPF_ALU64 | unix.BPF_LSH | unix.BPF_K, dst: dst, imm: imm})
+}
+
+// Load dst = *(size *)(src + off)
+func (a *Asm) Load(size uint8, dst, src uint8, off int16) {
+	a.add(insn{code: unix.BPF_LDX | unix.BPF_MEM | size, dst: dst, src: src, off: off})
+}
+
+// Store *(size *)(dst + off) = src
+func (a *Asm) Store(size uint8, dst, src uint8, off int16) {
+	a.add(insn{code: unix.BPF_STX | unix.BPF_MEM | size, dst: dst, src: src, off: off})
+}
+
+// AtomicAdd64 lock *(u64 *)(dst + off) += src
+func (a *Asm) AtomicAdd64(dst, src uint8, off int16) {
+	a.add(insn{code: unix.BPF_STX | unix.BPF_XADD | unix.BPF_DW, dst: dst, src: src, off: off})
+}
+
+// LoadMap dst = указатель на map по ее fd, инструкция занимает два слота
+func (a *Asm) LoadMap(dst uint8, m *Map) {
+	a.add(insn{code: unix.BPF_LD | unix.BPF_DW | unix.BPF_IMM, dst: dst, src: unix.BPF_PSEUDO_MAP_FD, imm: int32(m.fd)})
+	a.add(insn{})
+}
+
+// JumpImm переход на label, если dst op imm, op - BPF_JEQ, BPF_JNE...
+func (a *Asm) JumpImm(op uint8, dst uint8, imm int32, label string) {
+	a.add(insn{code: unix.BPF_JMP | op | unix.BPF_K, dst: dst, imm: imm, label: label})
+}
+
+// Jump переход на label, если dst op src
+func (a *Asm) Jump(op uint8, dst, src uint8, label string) {
+	a.add(insn{code: unix.BPF_JMP | op | unix.BPF_X, dst: dst, src: src, label: label})
+}
+
+func (a *Asm) Call(fn int32) {
+	a.add(insn{code: unix.BPF_JMP | unix.BPF_CALL, imm: fn})
+}
+
+func (a *Asm) Exit() {
+	a.add(insn{code: unix.BPF_JMP | unix.BPF_EXIT})
+}
+
+// Assemble инструкции в формате ядра, struct bpf_insn в порядке байт хоста
+func (a *Asm) Assemble() ([]byte, error) {
+	out := make([]byte, 0, len(a.insns)*8)
+	for pc, i := range a.insns {
+		if i.label != "" {
+			target, ok := a.labels[i.label]
+			if !ok {
+				return nil, errors.Newf("нет метки %s", i.label)
+			}
+			i.off = int16(target - pc - 1)
+		}
+		regs := i.dst | i.src<<4
+		if bigEndian() {
+			regs = i.dst<<4 | i.src
+		}
+		out = append(out, i.code, regs)
+		out = binary.NativeEndian.AppendUint16(out, uint16(i.off))
+		out = binary.NativeEndian.AppendUint32(out, uint32(i.imm))
+	}
+	return out, nil
+}
+
+func bigEndian() bool {
+	return binary.NativeEndian.Uint16([]byte{0, 1}) == 1
+}
+
+// Htons число из сети так, как его прочитает программа: из пакета значения грузятся в порядке байт хоста
+func Htons(v uint16) int32 {
+	return int32(binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v)))
+}
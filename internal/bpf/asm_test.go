@@ -0,0 +1,170 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// decoded инструкция из Assemble без учета порядка регистров
+type decoded struct {
+	code uint8
+	dst  uint8
+	src  uint8
+	off  int16
+	imm  int32
+}
+
+func decode(t *testing.T, b []byte) []decoded {
+	if len(b)%8 != 0 {
+		t.Fatalf("длина %d не кратна 8", len(b))
+	}
+	var result []decoded
+	for i := 0; i < len(b); i += 8 {
+		dst, src := b[i+1]&0xf, b[i+1]>>4
+		if bigEndian() {
+			dst, src = b[i+1]>>4, b[i+1]&0xf
+		}
+		result = append(result, decoded{
+			code: b[i],
+			dst:  dst,
+			src:  src,
+			off:  int16(binary.NativeEndian.Uint16(b[i+2:])),
+			imm:  int32(binary.NativeEndian.Uint32(b[i+4:])),
+		})
+	}
+	return result
+}
+
+// offsets смещения переходов по порядку
+func offsets(insns []decoded) []int16 {
+	var result []int16
+	for _, i := range insns {
+		if i.code&0x07 == unix.BPF_JMP && i.code&0xf0 != unix.BPF_CALL && i.code&0xf0 != unix.BPF_EXIT {
+			result = append(result, i.off)
+		}
+	}
+	return result
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(a *Asm)
+		offsets []int16
+		err     bool
+	}{
+		{
+			name: "переход вперед",
+			build: func(a *Asm) {
+				a.JumpImm(unix.BPF_JEQ, R1, 0, "out")
+				a.Mov64Imm(R0, 1)
+				a.Mov64Imm(R0, 2)
+				a.Label("out")
+				a.Exit()
+			},
+			offsets: []int16{2},
+		},
+		{
+			name: "переход на следующую инструкцию",
+			build: func(a *Asm) {
+				a.Jump(unix.BPF_JGT, R1, R2, "next")
+				a.Label("next")
+				a.Exit()
+			},
+			offsets: []int16{0},
+		},
+		{
+			name: "переход назад",
+			build: func(a *Asm) {
+				a.Label("loop")
+				a.Add64Imm(R1, -1)
+				a.JumpImm(unix.BPF_JNE, R1, 0, "loop")
+				a.Exit()
+			},
+			offsets: []int16{-2},
+		},
+		{
+			name: "загрузка map занимает два слота",
+			build: func(a *Asm) {
+				a.JumpImm(unix.BPF_JEQ, R1, 0, "out")
+				a.LoadMap(R1, &Map{fd: 7})
+				a.Call(FuncMapLookupElem)
+				a.Label("out")
+				a.Exit()
+			},
+			offsets: []int16{3},
+		},
+		{
+			name: "несколько переходов на одну метку",
+			build: func(a *Asm) {
+				a.JumpImm(unix.BPF_JEQ, R1, 0, "pass")
+				a.JumpImm(unix.BPF_JEQ, R2, 0, "pass")
+				a.Mov64Imm(R0, 0)
+				a.Exit()
+				a.Label("pass")
+				a.Mov64Imm(R0, -1)
+				a.Exit()
+			},
+			offsets: []int16{3, 2},
+		},
+		{
+			name: "нет метки",
+			build: func(a *Asm) {
+				a.JumpImm(unix.BPF_JEQ, R1, 0, "missing")
+				a.Exit()
+			},
+			err: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Asm{}
+			tt.build(a)
+			b, err := a.Assemble()
+			if tt.err {
+				if err == nil {
+					t.Fatal("ожидалась ошибка")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := offsets(decode(t, b)); !reflect.DeepEqual(got, tt.offsets) {
+				t.Fatalf("смещения %v, ожидалось %v", got, tt.offsets)
+			}
+		})
+	}
+}
+
+func TestAssembleEncoding(t *testing.T) {
+	a := &Asm{}
+	a.Store(W, R10, R4, -16)
+	a.Mov64Imm(R0, -1)
+	a.LoadMap(R2, &Map{fd: 7})
+	b, err := a.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []decoded{
+		{code: unix.BPF_STX | unix.BPF_MEM | unix.BPF_W, dst: R10, src: R4, off: -16},
+		{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, dst: R0, imm: -1},
+		{code: unix.BPF_LD | unix.BPF_DW | unix.BPF_IMM, dst: R2, src: unix.BPF_PSEUDO_MAP_FD, imm: 7},
+		{},
+	}
+	if got := decode(t, b); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%+v, ожидалось %+v", got, want)
+	}
+}
+
+func TestHtons(t *testing.T) {
+	// значение, прочитанное из пакета программой, - байты в сетевом порядке в порядке хоста
+	packet := []byte{0x08, 0x00}
+	if got, want := Htons(unix.ETH_P_IP), int32(binary.NativeEndian.Uint16(packet)); got != want {
+		t.Fatalf("%#x, ожидалось %#x", got, want)
+	}
+}
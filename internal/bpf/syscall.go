@@ -0,0 +1,141 @@
+package bpf
+
+import (
+	"golang.org/x/sys/unix"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// logSize буфер лога верификатора, в ошибку загрузки попадает его хвост
+const logSize = 64 * 1024
+
+// mapCreateAttr начало union bpf_attr для BPF_MAP_CREATE
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	flags      uint32
+}
+
+// mapElemAttr union bpf_attr для BPF_MAP_*_ELEM
+type mapElemAttr struct {
+	fd    uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// progLoadAttr начало union bpf_attr для BPF_PROG_LOAD
+type progLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	progName    [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(fd), nil
+}
+
+// Map хэш-таблица eBPF, ключи и значения - байты в том виде, в каком их видит программа
+type Map struct {
+	fd        int
+	keySize   int
+	valueSize int
+}
+
+func NewHashMap(keySize, valueSize, maxEntries int) (*Map, error) {
+	attr := mapCreateAttr{
+		mapType:    unix.BPF_MAP_TYPE_HASH,
+		keySize:    uint32(keySize),
+		valueSize:  uint32(valueSize),
+		maxEntries: uint32(maxEntries),
+	}
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, errors.Newf("создание map: %s", err)
+	}
+	return &Map{fd: fd, keySize: keySize, valueSize: valueSize}, nil
+}
+
+func (m *Map) Update(key, value []byte) error {
+	return m.elem(unix.BPF_MAP_UPDATE_ELEM, key, value)
+}
+
+// Lookup значение по ключу в value, unix.ENOENT - ключа нет
+func (m *Map) Lookup(key, value []byte) error {
+	return m.elem(unix.BPF_MAP_LOOKUP_ELEM, key, value)
+}
+
+func (m *Map) Delete(key []byte) error {
+	return m.elem(unix.BPF_MAP_DELETE_ELEM, key, nil)
+}
+
+func (m *Map) elem(cmd int, key, value []byte) error {
+	if len(key) != m.keySize || (value != nil && len(value) != m.valueSize) {
+		return errors.Newf("размер ключа или значения не совпадает с map: %d, %d", len(key), len(value))
+	}
+	attr := mapElemAttr{fd: uint32(m.fd), key: uint64(uintptr(unsafe.Pointer(&key[0])))}
+	if value != nil {
+		attr.value = uint64(uintptr(unsafe.Pointer(&value[0])))
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func (m *Map) Close() error {
+	return unix.Close(m.fd)
+}
+
+// LoadSchedCLS загрузка программы классификатора tc, в ошибке - хвост лога верификатора
+func LoadSchedCLS(name string, insns []byte, license string) (int, error) {
+	lic := append([]byte(license), 0)
+	log := make([]byte, logSize)
+	attr := progLoadAttr{
+		progType: unix.BPF_PROG_TYPE_SCHED_CLS,
+		insnCnt:  uint32(len(insns) / 8),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&lic[0]))),
+		logLevel: 1,
+		logSize:  logSize,
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	copy(attr.progName[:unix.BPF_OBJ_NAME_LEN-1], name)
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(lic)
+	runtime.KeepAlive(log)
+	if err != nil {
+		verifier := strings.TrimSpace(string(log[:clen(log)]))
+		if len(verifier) > 512 {
+			verifier = verifier[len(verifier)-512:]
+		}
+		return 0, errors.Newf("загрузка программы: %s: %s", err, verifier)
+	}
+	return fd, nil
+}
+
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
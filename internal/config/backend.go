@@ -0,0 +1,86 @@
+package config
+
+import "gopkg.in/errgo.v2/fmt/errors"
+
+// способ форвардинга связки
+const (
+	// BackendTC nat фильтр tc на ingress, по умолчанию
+	BackendTC = "tc"
+	// BackendUDP сокеты в userspace, для ядер без act_nat и act_mirred
+	BackendUDP = "udp"
+	// BackendBPF классификатор eBPF на ingress, переключение - одним обновлением map
+	BackendBPF = "bpf"
+)
+
+// UDP форвардинг сокетами: Port - UDP порт потоков источников, на него же поток уходит в route, TTL потока в route
+type UDP struct {
+	Port int `json:"port"`
+	TTL  int `json:"ttl,omitempty"`
+}
+
+// DefaultUDPTTL TTL потока в route при форвардинге сокетами, если не задан
+const DefaultUDPTTL = 16
+
+// GetBackend способ форвардинга, без backend - tc
+func (f Filter) GetBackend() string {
+	if f.Backend == "" {
+		return BackendTC
+	}
+	return f.Backend
+}
+
+// GetUDP параметры форвардинга сокетами с значениями по умолчанию, nil - у связки форвардинг tc
+func (f Filter) GetUDP() *UDP {
+	if f.GetBackend() != BackendUDP || f.UDP == nil {
+		return nil
+	}
+	u := *f.UDP
+	if u.TTL == 0 {
+		u.TTL = DefaultUDPTTL
+	}
+	return &u
+}
+
+func (f Filter) validateBackend() error {
+	if err := f.validateSourceMatch(); err != nil {
+		return err
+	}
+	switch f.GetBackend() {
+	case BackendTC:
+		return nil
+	case BackendUDP, BackendBPF:
+	default:
+		return errors.Newf("backend должен быть %s, %s или %s: '%s'", BackendTC, BackendUDP, BackendBPF, f.Backend)
+	}
+	if f.Hitless != nil {
+		return errors.Newf("hitless работает в userspace, backend %s с ним не задается", f.GetBackend())
+	}
+	if f.GetBackend() == BackendBPF {
+		if f.IsIPv6() {
+			return errors.New("backend bpf работает только с IPv4")
+		}
+		return nil
+	}
+	if f.UDP == nil || f.UDP.Port <= 0 || f.UDP.Port > 0xffff {
+		return errors.New("для backend udp нужен udp.port от 1 до 65535")
+	}
+	if f.UDP.TTL < 0 || f.UDP.TTL > 255 {
+		return errors.Newf("udp.ttl вне диапазона 1-255: %d", f.UDP.TTL)
+	}
+	return nil
+}
+
+// validateSourceMatch уточнения потоков, которые backend умеет сопоставить: tc - все,
+// сокеты (udp и hitless) - только адрес источника, классификатор eBPF - ни одного
+func (f Filter) validateSourceMatch() error {
+	backend := f.GetBackend()
+	for _, src := range f.GetSources() {
+		switch {
+		case backend == BackendBPF && (src.SourceIP != "" || src.Port != 0 || src.VLAN != 0):
+			return errors.Newf("backend bpf сопоставляет только группу, sourceIP, port и vlan источника %s не задаются", src.Name)
+		case (backend == BackendUDP || f.Hitless != nil) && (src.Port != 0 || src.VLAN != 0):
+			return errors.Newf("сокеты принимают поток группы на общем порту, port и vlan источника %s не задаются", src.Name)
+		}
+	}
+	return nil
+}
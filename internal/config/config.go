@@ -2,47 +2,224 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"os"
 )
 
 type Config struct {
-	Interface        string   `json:"interface"`
-	Port             string   `json:"port"`
-	CopyTrafficFrom  string   `json:"copyTrafficFrom"`
-	StatFrequencySec int      `json:"statsFrequencyMs"`
-	Hostname         string   `json:"hostname"`
-	Filters          []Filter `json:"filters"`
+	Interface        string    `json:"interface"`
+	Port             string    `json:"port"`
+	CopyTrafficFrom  string    `json:"copyTrafficFrom"`
+	StatFrequencySec int       `json:"statsFrequencyMs"`
+	HistorySamples   int       `json:"historySamples,omitempty"`
+	Hostname         string    `json:"hostname"`
+	StateFile        string    `json:"stateFile,omitempty"`
+	InstalledFile    string    `json:"installedFile,omitempty"`
+	EventsFile       string    `json:"eventsFile,omitempty"`
+	EventsMaxSizeKb  int       `json:"eventsMaxSizeKb,omitempty"`
+	EventsMaxFiles   int       `json:"eventsMaxFiles,omitempty"`
+	Webhooks         []Webhook `json:"webhooks,omitempty"`
+	Log              Log       `json:"log,omitempty"`
+	// MLDVersion версия MLD (1 или 2) при подписке на IPv6 группы на copyTrafficFrom, 0 - как решит ядро
+	MLDVersion int `json:"mldVersion,omitempty"`
+	// StreamOrigins с каких страниц браузера можно подключиться к /stream/ws, кроме адреса самого API, * - с любых
+	StreamOrigins []string `json:"streamOrigins,omitempty"`
+	// ShutdownMode что делать с установленным при остановке: teardown или keep
+	ShutdownMode string   `json:"shutdownMode,omitempty"`
+	Filters      []Filter `json:"filters"`
+}
+
+// DefaultHistorySamples сколько опросов битрейта хранить на источник, если historySamples не задан
+const DefaultHistorySamples = 3600
+
+// размер файла журнала событий до ротации и количество хранимых файлов по умолчанию
+const (
+	DefaultEventsMaxSizeKb = 10240
+	DefaultEventsMaxFiles  = 5
+)
+
+const (
+	// ShutdownTeardown снять все, что установило приложение
+	ShutdownTeardown = "teardown"
+	// ShutdownKeep оставить форвардинг работать, например на время обновления
+	ShutdownKeep = "keep"
+)
+
+// Webhook получатель событий. Events - типы событий, пустой список - все.
+// Template - text/template тела запроса, без него отправляется событие в JSON
+type Webhook struct {
+	Name      string   `json:"name,omitempty"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events,omitempty"`
+	Template  string   `json:"template,omitempty"`
+	Secret    string   `json:"secret,omitempty"`
+	Retries   int      `json:"retries,omitempty"`
+	TimeoutMs int      `json:"timeoutMs,omitempty"`
+}
+
+// Log формат (text или json) и уровень логов. Subsystems - уровни отдельных подсистем:
+// statistic, filter, igmp, net_listener, api, manager, interface_link, webhook, ledger, journal, hitless, udp_forward,
+// bpf_forward, system
+type Log struct {
+	Format     string            `json:"format,omitempty"`
+	Level      string            `json:"level,omitempty"`
+	Subsystems map[string]string `json:"subsystems,omitempty"`
 }
 
 type Filter struct {
+	Id          int    `json:"id,omitempty"`
 	Route       string `json:"route,omitempty"`
 	SwitchTries int    `json:"switchTries,omitempty"`
 	AutoSwitch  bool   `json:"autoSwitch"`
 	Title       string `json:"title"`
-	Master      Info   `json:"master,omitempty"`
-	Slave       Info   `json:"slave,omitempty"`
+	// TSMaxErrorRate доля TS пакетов с ошибками (CC, синхронизация, PCR) за секунду,
+	// при превышении которой опрос считается неудачным. 0 - проверка TS выключена
+	TSMaxErrorRate float64 `json:"tsMaxErrorRate,omitempty"`
+	// RTPMaxLossRate доля потерянных RTP пакетов за секунду, RTPMaxJitterMs - джиттер по RFC 3550,
+	// при превышении которых опрос считается неудачным. 0 - порог не проверяется
+	RTPMaxLossRate float64 `json:"rtpMaxLossRate,omitempty"`
+	RTPMaxJitterMs float64 `json:"rtpMaxJitterMs,omitempty"`
+	// MinBitrate и MaxBitrate пороги битрейта источников в бит/с, если у источника не заданы свои.
+	// Битрейт вне порогов BitrateSamples опросов подряд (по умолчанию 1) считается неудачной попыткой
+	MinBitrate     float64 `json:"minBitrate,omitempty"`
+	MaxBitrate     float64 `json:"maxBitrate,omitempty"`
+	BitrateSamples int     `json:"bitrateSamples,omitempty"`
+	// Revert условия возврата на мастер, без них возврат по первому пакету мастера
+	Revert *Revert `json:"revert,omitempty"`
+	// Flap защита от постоянных переключений, без нее связка не блокируется
+	Flap *Flap `json:"flap,omitempty"`
+	// Backend форвардинг связки: tc (по умолчанию), udp или bpf, UDP - параметры форвардинга сокетами
+	Backend string `json:"backend,omitempty"`
+	UDP     *UDP   `json:"udp,omitempty"`
+	// Hitless объединение потоков источников вместо переключения, только для RTP
+	Hitless *Hitless `json:"hitless,omitempty"`
+	// Outputs дополнительные выходы: в каждый уходит поток того же активного источника, что и в route
+	Outputs []Output `json:"outputs,omitempty"`
+	// Master и Slave старый формат, используются если Sources не заданы
+	Master  *Info  `json:"master,omitempty"`
+	Slave   *Info  `json:"slave,omitempty"`
+	Sources []Info `json:"sources,omitempty"`
 }
 
+// Flap больше MaxSwitches автоматических переключений за WindowMs блокируют связку:
+// автопереключение выключается до снятия блокировки через API.
+// LockTo - имя источника, на котором оставить связку, пустой - текущий
+type Flap struct {
+	MaxSwitches int    `json:"maxSwitches"`
+	WindowMs    int    `json:"windowMs"`
+	LockTo      string `json:"lockTo,omitempty"`
+}
+
+// GetFlap защита от переключений связки, без секции flap - нулевая
+func (f Filter) GetFlap() Flap {
+	if f.Flap == nil {
+		return Flap{}
+	}
+	return *f.Flap
+}
+
+// Info источник: IP - группа. SourceIP, Port и VLAN уточняют поток: только от адреса SourceIP (S,G),
+// только на UDP порт Port, только в VLAN. Подписка на группу с SourceIP - source-specific (IGMPv3, MLDv2)
 type Info struct {
-	IP       string `json:"ip,omitempty"`
-	Priority int    `json:"priority,omitempty"`
+	Name       string  `json:"name,omitempty"`
+	IP         string  `json:"ip,omitempty"`
+	SourceIP   string  `json:"sourceIP,omitempty"`
+	Port       int     `json:"port,omitempty"`
+	VLAN       int     `json:"vlan,omitempty"`
+	Priority   int     `json:"priority,omitempty"`
+	MinBitrate float64 `json:"minBitrate,omitempty"`
+	MaxBitrate float64 `json:"maxBitrate,omitempty"`
+}
+
+// SameSource совпадают ли источники без учета порогов, пороги меняются без переустановки фильтров
+func (i Info) SameSource(o Info) bool {
+	return i.Name == o.Name && i.IP == o.IP && i.SourceIP == o.SourceIP && i.Port == o.Port &&
+		i.VLAN == o.VLAN && i.Priority == o.Priority
+}
+
+// GetSources источники в порядке приоритета переключения, первый - мастер.
+// Пороги битрейта, не заданные у источника, берутся из связки
+func (f Filter) GetSources() []Info {
+	sources := f.Sources
+	if len(sources) == 0 {
+		for _, src := range []*Info{f.Master, f.Slave} {
+			if src != nil {
+				sources = append(sources, *src)
+			}
+		}
+	}
+
+	result := make([]Info, 0, len(sources))
+	for i, src := range sources {
+		if src.IP == "" {
+			continue
+		}
+		if src.Name == "" {
+			src.Name = SourceName(i)
+		}
+		if src.MinBitrate == 0 {
+			src.MinBitrate = f.MinBitrate
+		}
+		if src.MaxBitrate == 0 {
+			src.MaxBitrate = f.MaxBitrate
+		}
+		result = append(result, src)
+	}
+	return result
+}
+
+// SourceName имя источника по умолчанию: master, slave, slave2, slave3...
+func SourceName(i int) string {
+	switch i {
+	case 0:
+		return "master"
+	case 1:
+		return "slave"
+	default:
+		return fmt.Sprintf("slave%d", i)
+	}
 }
 
 func NewConfig(fileName string) *Config {
-	file, err := os.Open(fileName)
+	cfg, err := Load(fileName)
 	if err != nil {
 		panic(err)
 	}
+	return cfg
+}
+
+func Load(fileName string) (*Config, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
 	bytes, err := io.ReadAll(file)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	var cfg Config
 	if err := json.Unmarshal(bytes, &cfg); err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &cfg
+	return &cfg, nil
+}
+
+// Save атомарная запись конфига
+func (c *Config) Save(fileName string) error {
+	bytes, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fileName, bytes)
+}
+
+// IsIPv6 связка с IPv6 группами: route и все источники одного семейства
+func (f Filter) IsIPv6() bool {
+	ip := net.ParseIP(f.Route)
+	return ip != nil && ip.To4() == nil
 }
@@ -0,0 +1,47 @@
+package config
+
+import "gopkg.in/errgo.v2/fmt/errors"
+
+// Hitless бесшовное объединение RTP потоков источников по номерам пакетов (SMPTE 2022-7) в userspace
+// вместо nat фильтра. Port - UDP порт потоков источников, на него же отправляется объединенный поток
+// в route. BufferMs - допустимая разница задержки путей: сколько ждать пропущенный пакет с другого пути.
+// TTL объединенного потока
+type Hitless struct {
+	Port     int `json:"port"`
+	BufferMs int `json:"bufferMs,omitempty"`
+	TTL      int `json:"ttl,omitempty"`
+}
+
+// буфер и TTL объединенного потока, если не заданы
+const (
+	DefaultHitlessBufferMs = 50
+	DefaultHitlessTTL      = 16
+)
+
+// GetHitless объединение потоков связки с значениями по умолчанию, nil - обычное переключение nat фильтром
+func (f Filter) GetHitless() *Hitless {
+	if f.Hitless == nil {
+		return nil
+	}
+	h := *f.Hitless
+	if h.BufferMs == 0 {
+		h.BufferMs = DefaultHitlessBufferMs
+	}
+	if h.TTL == 0 {
+		h.TTL = DefaultHitlessTTL
+	}
+	return &h
+}
+
+func (h Hitless) Validate() error {
+	if h.Port <= 0 || h.Port > 0xffff {
+		return errors.Newf("hitless.port вне диапазона 1-65535: %d", h.Port)
+	}
+	if h.BufferMs < 0 {
+		return errors.Newf("hitless.bufferMs не может быть отрицательным: %d", h.BufferMs)
+	}
+	if h.TTL < 0 || h.TTL > 255 {
+		return errors.Newf("hitless.ttl вне диапазона 1-255: %d", h.TTL)
+	}
+	return nil
+}
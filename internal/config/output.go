@@ -0,0 +1,68 @@
+package config
+
+import (
+	"gopkg.in/errgo.v2/fmt/errors"
+	"net"
+)
+
+// Output дополнительный выход связки: поток активного источника уходит и в Route через Interface.
+// Без interface - через interface конфига, как и основной route
+type Output struct {
+	Route     string `json:"route"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// MaxOutputs выходов связки кроме route: у tc копии в выходы - действия одного nat фильтра,
+// ядро принимает до 32 действий, а копия IPv6 потока занимает пять
+const MaxOutputs = 6
+
+// GetOutputs выходы связки, interface не заданный у выхода - link
+func (f Filter) GetOutputs(link string) []Output {
+	outputs := make([]Output, 0, len(f.Outputs))
+	for _, o := range f.Outputs {
+		if o.Interface == "" {
+			o.Interface = link
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs
+}
+
+// Routes route связки и всех ее выходов
+func (f Filter) Routes() []string {
+	routes := []string{f.Route}
+	for _, o := range f.Outputs {
+		routes = append(routes, o.Route)
+	}
+	return routes
+}
+
+// validateOutputs адреса выходов: того же семейства, что route, не совпадают с route, источниками и друг с другом
+func (f Filter) validateOutputs() error {
+	if len(f.Outputs) == 0 {
+		return nil
+	}
+	if f.GetBackend() == BackendBPF {
+		return errors.New("backend bpf отправляет поток только в route, outputs не задаются")
+	}
+	if len(f.Outputs) > MaxOutputs {
+		return errors.Newf("не больше %d outputs: %d", MaxOutputs, len(f.Outputs))
+	}
+	used := map[string]struct{}{f.Route: {}}
+	for _, src := range f.GetSources() {
+		used[src.IP] = struct{}{}
+	}
+	for _, o := range f.Outputs {
+		if err := validateIP(o.Route); err != nil {
+			return errors.Newf("route выхода: %s", err)
+		}
+		if f.IsIPv6() != (net.ParseIP(o.Route).To4() == nil) {
+			return errors.Newf("route выхода %s и route должны быть одного семейства, IPv4 или IPv6", o.Route)
+		}
+		if _, ok := used[o.Route]; ok {
+			return errors.Newf("route выхода %s совпадает с route, источником или другим выходом", o.Route)
+		}
+		used[o.Route] = struct{}{}
+	}
+	return nil
+}
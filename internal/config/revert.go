@@ -0,0 +1,96 @@
+package config
+
+import (
+	"gopkg.in/errgo.v2/fmt/errors"
+	"strings"
+	"time"
+)
+
+// Revert условия возврата на мастер. StableMs - сколько мастер должен идти без перерывов и ошибок,
+// MinBackupMs - сколько минимум оставаться на резервном источнике, Windows - интервалы местного
+// времени "HH:MM-HH:MM", когда возврат разрешен, пустой список - всегда
+type Revert struct {
+	StableMs    int      `json:"stableMs,omitempty"`
+	MinBackupMs int      `json:"minBackupMs,omitempty"`
+	Windows     []string `json:"windows,omitempty"`
+}
+
+// GetRevert условия возврата связки, без секции revert - нулевые
+func (f Filter) GetRevert() Revert {
+	if f.Revert == nil {
+		return Revert{}
+	}
+	return *f.Revert
+}
+
+// Window интервал суток, From и To - смещение от полуночи. To меньше From - интервал через полночь
+type Window struct {
+	From time.Duration
+	To   time.Duration
+}
+
+func (r Revert) Validate() error {
+	if r.StableMs < 0 || r.MinBackupMs < 0 {
+		return errors.New("revert.stableMs и revert.minBackupMs не могут быть отрицательными")
+	}
+	_, err := r.ParseWindows()
+	return err
+}
+
+func (r Revert) ParseWindows() ([]Window, error) {
+	windows := make([]Window, 0, len(r.Windows))
+	for _, raw := range r.Windows {
+		w, err := ParseWindow(raw)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// ParseWindow разбор "HH:MM-HH:MM"
+func ParseWindow(raw string) (Window, error) {
+	from, to, ok := strings.Cut(raw, "-")
+	if !ok {
+		return Window{}, errors.Newf("окно возврата должно быть в виде HH:MM-HH:MM: '%s'", raw)
+	}
+	var w Window
+	for _, part := range []struct {
+		raw string
+		dst *time.Duration
+	}{{from, &w.From}, {to, &w.To}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.raw))
+		if err != nil {
+			return Window{}, errors.Newf("окно возврата должно быть в виде HH:MM-HH:MM: '%s'", raw)
+		}
+		*part.dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.From == w.To {
+		return Window{}, errors.Newf("пустое окно возврата: '%s'", raw)
+	}
+	return w, nil
+}
+
+// Contains попадает ли t в окно по местному времени
+func (w Window) Contains(t time.Time) bool {
+	offset := t.Sub(midnight(t))
+	if w.From < w.To {
+		return offset >= w.From && offset < w.To
+	}
+	return offset >= w.From || offset < w.To
+}
+
+// Next ближайшее начало окна после t
+func (w Window) Next(t time.Time) time.Time {
+	start := midnight(t).Add(w.From)
+	if !start.After(t) {
+		start = midnight(t.AddDate(0, 0, 1)).Add(w.From)
+	}
+	return start
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
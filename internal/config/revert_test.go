@@ -0,0 +1,93 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func at(day, hour, min int) time.Time {
+	return time.Date(2026, 3, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Window
+		err  bool
+	}{
+		{raw: "02:00-05:30", want: Window{From: 2 * time.Hour, To: 5*time.Hour + 30*time.Minute}},
+		{raw: "23:00 - 01:00", want: Window{From: 23 * time.Hour, To: time.Hour}},
+		{raw: "00:00-23:59", want: Window{To: 23*time.Hour + 59*time.Minute}},
+		{raw: "05:00-05:00", err: true},
+		{raw: "05:00", err: true},
+		{raw: "25:00-26:00", err: true},
+		{raw: "5-6", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseWindow(tt.raw)
+			if (err != nil) != tt.err {
+				t.Fatalf("ошибка %v, ожидалась %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Fatalf("%+v, ожидалось %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	day := Window{From: 2 * time.Hour, To: 5 * time.Hour}
+	night := Window{From: 23 * time.Hour, To: time.Hour}
+
+	tests := []struct {
+		name   string
+		window Window
+		t      time.Time
+		want   bool
+	}{
+		{name: "до окна", window: day, t: at(10, 1, 59), want: false},
+		{name: "начало окна", window: day, t: at(10, 2, 0), want: true},
+		{name: "внутри окна", window: day, t: at(10, 4, 59), want: true},
+		{name: "конец окна не входит", window: day, t: at(10, 5, 0), want: false},
+		{name: "через полночь до полуночи", window: night, t: at(10, 23, 30), want: true},
+		{name: "через полночь в полночь", window: night, t: at(11, 0, 0), want: true},
+		{name: "через полночь после полуночи", window: night, t: at(11, 0, 59), want: true},
+		{name: "через полночь после конца", window: night, t: at(11, 1, 0), want: false},
+		{name: "через полночь днем", window: night, t: at(11, 12, 0), want: false},
+		{name: "через полночь перед началом", window: night, t: at(10, 22, 59), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.Contains(tt.t); got != tt.want {
+				t.Fatalf("%v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowNext(t *testing.T) {
+	day := Window{From: 2 * time.Hour, To: 5 * time.Hour}
+	night := Window{From: 23 * time.Hour, To: time.Hour}
+
+	tests := []struct {
+		name   string
+		window Window
+		t      time.Time
+		want   time.Time
+	}{
+		{name: "окно сегодня", window: day, t: at(10, 1, 0), want: at(10, 2, 0)},
+		{name: "в начале окна - следующее", window: day, t: at(10, 2, 0), want: at(11, 2, 0)},
+		{name: "окно прошло", window: day, t: at(10, 6, 0), want: at(11, 2, 0)},
+		{name: "через полночь вечером", window: night, t: at(10, 22, 0), want: at(10, 23, 0)},
+		{name: "через полночь внутри окна", window: night, t: at(11, 0, 30), want: at(11, 23, 0)},
+		{name: "конец месяца", window: night, t: at(31, 23, 30), want: time.Date(2026, 4, 1, 23, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.Next(tt.t); !got.Equal(tt.want) {
+				t.Fatalf("%v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"gopkg.in/errgo.v2/fmt/errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Validate проверка одной связки, без учета остальных связок конфига
+func (f Filter) Validate() error {
+	if f.Id < 0 {
+		return errors.Newf("id не может быть отрицательным: %d", f.Id)
+	}
+	if err := validateIP(f.Route); err != nil {
+		return errors.Newf("route: %s", err)
+	}
+	if f.SwitchTries < 0 {
+		return errors.Newf("switchTries не может быть отрицательным: %d", f.SwitchTries)
+	}
+	if f.TSMaxErrorRate < 0 || f.TSMaxErrorRate > 1 {
+		return errors.Newf("tsMaxErrorRate должен быть от 0 до 1: %v", f.TSMaxErrorRate)
+	}
+	if f.RTPMaxLossRate < 0 || f.RTPMaxLossRate > 1 {
+		return errors.Newf("rtpMaxLossRate должен быть от 0 до 1: %v", f.RTPMaxLossRate)
+	}
+	if f.RTPMaxJitterMs < 0 {
+		return errors.Newf("rtpMaxJitterMs не может быть отрицательным: %v", f.RTPMaxJitterMs)
+	}
+	if f.BitrateSamples < 0 {
+		return errors.Newf("bitrateSamples не может быть отрицательным: %d", f.BitrateSamples)
+	}
+	if f.Revert != nil {
+		if err := f.Revert.Validate(); err != nil {
+			return err
+		}
+	}
+	if f.Flap != nil && (f.Flap.MaxSwitches <= 0 || f.Flap.WindowMs <= 0) {
+		return errors.New("flap.maxSwitches и flap.windowMs должны быть больше нуля")
+	}
+	if f.Hitless != nil {
+		if err := f.Hitless.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := f.validateBackend(); err != nil {
+		return err
+	}
+
+	sources := f.GetSources()
+	if len(sources) == 0 {
+		return errors.New("не задано ни одного источника")
+	}
+	names := make(map[string]struct{})
+	ips := make(map[Info]struct{})
+	for _, src := range sources {
+		if err := validateIP(src.IP); err != nil {
+			return errors.Newf("ip источника %s: %s", src.Name, err)
+		}
+		if f.IsIPv6() != (net.ParseIP(src.IP).To4() == nil) {
+			return errors.Newf("ip источника %s и route должны быть одного семейства, IPv4 или IPv6", src.Name)
+		}
+		if src.IP == f.Route {
+			return errors.Newf("ip источника %s совпадает с route", src.Name)
+		}
+		if err := src.validateMatch(f.IsIPv6()); err != nil {
+			return errors.Newf("источник %s: %s", src.Name, err)
+		}
+		if src.MinBitrate < 0 || src.MaxBitrate < 0 {
+			return errors.Newf("пороги битрейта источника %s не могут быть отрицательными", src.Name)
+		}
+		if src.MaxBitrate > 0 && src.MaxBitrate <= src.MinBitrate {
+			return errors.Newf("maxBitrate источника %s должен быть больше minBitrate", src.Name)
+		}
+		if src.Priority < 0 || src.Priority > 0xffff {
+			return errors.Newf("priority источника %s вне диапазона 1-65535: %d", src.Name, src.Priority)
+		}
+		name := strings.ToLower(src.Name)
+		if _, ok := names[name]; ok {
+			return errors.Newf("имя источника %s повторяется", src.Name)
+		}
+		// один и тот же поток - одна группа с тем же источником, портом и VLAN
+		stream := Info{IP: src.IP, SourceIP: src.SourceIP, Port: src.Port, VLAN: src.VLAN}
+		if _, ok := ips[stream]; ok {
+			return errors.Newf("поток источника %s повторяется", src.Name)
+		}
+		names[name] = struct{}{}
+		ips[stream] = struct{}{}
+	}
+	if err := f.validateOutputs(); err != nil {
+		return err
+	}
+	if f.Hitless != nil && len(sources) < 2 {
+		return errors.New("для hitless нужно хотя бы два источника")
+	}
+	if lockTo := f.GetFlap().LockTo; lockTo != "" {
+		if _, ok := names[strings.ToLower(lockTo)]; !ok {
+			return errors.Newf("flap.lockTo: нет источника %s", lockTo)
+		}
+	}
+	return nil
+}
+
+// validateMatch уточнения потока источника: sourceIP - unicast адрес семейства группы, порт и VLAN в пределах
+func (i Info) validateMatch(ipv6 bool) error {
+	if i.SourceIP != "" {
+		if err := validateIP(i.SourceIP); err != nil {
+			return errors.Newf("sourceIP: %s", err)
+		}
+		ip := net.ParseIP(i.SourceIP)
+		if ip.IsMulticast() || ip.IsUnspecified() {
+			return errors.Newf("sourceIP должен быть unicast адресом: '%s'", i.SourceIP)
+		}
+		if ipv6 != (ip.To4() == nil) {
+			return errors.New("sourceIP и ip должны быть одного семейства, IPv4 или IPv6")
+		}
+	}
+	if i.Port < 0 || i.Port > 0xffff {
+		return errors.Newf("port вне диапазона 1-65535: %d", i.Port)
+	}
+	if i.VLAN < 0 || i.VLAN > 4094 {
+		return errors.Newf("vlan вне диапазона 1-4094: %d", i.VLAN)
+	}
+	return nil
+}
+
+// validateIP адрес IPv4 или IPv6. IPv6 - только в сокращенной форме, как его показывают ядро и tc,
+// иначе счетчики фильтров не сопоставятся с источником
+func validateIP(raw string) error {
+	ip := net.ParseIP(raw)
+	switch {
+	case ip == nil:
+		return errors.Newf("должен быть IPv4 или IPv6 адресом: '%s'", raw)
+	case ip.To4() == nil && ip.String() != raw:
+		return errors.Newf("IPv6 адрес нужно записать как '%s': '%s'", ip, raw)
+	}
+	return nil
+}
+
+func (l Log) Validate() error {
+	if l.Format != "" && l.Format != "text" && l.Format != "json" {
+		return errors.Newf("log.format только text или json: '%s'", l.Format)
+	}
+	var lvl slog.Level
+	if l.Level != "" {
+		if err := lvl.UnmarshalText([]byte(l.Level)); err != nil {
+			return errors.Newf("неизвестный log.level: '%s'", l.Level)
+		}
+	}
+	for name, raw := range l.Subsystems {
+		if err := lvl.UnmarshalText([]byte(raw)); err != nil {
+			return errors.Newf("неизвестный уровень логов подсистемы %s: '%s'", name, raw)
+		}
+	}
+	return nil
+}
+
+// Validate проверка всех связок и их пересечений между собой
+func (c *Config) Validate() error {
+	if c.HistorySamples < 0 {
+		return errors.Newf("historySamples не может быть отрицательным: %d", c.HistorySamples)
+	}
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	if c.EventsMaxSizeKb < 0 || c.EventsMaxFiles < 0 {
+		return errors.New("eventsMaxSizeKb и eventsMaxFiles не могут быть отрицательными")
+	}
+	// при ротации удаляется самый старый файл, с одним файлом это был бы текущий журнал
+	if c.EventsMaxFiles == 1 {
+		return errors.New("eventsMaxFiles должен быть не меньше 2: текущий файл и хотя бы один ротированный")
+	}
+	for _, w := range c.Webhooks {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Newf("url webhook должен быть http(s) адресом: '%s'", w.URL)
+		}
+		if w.Retries < 0 || w.TimeoutMs < 0 {
+			return errors.Newf("webhook %s: retries и timeoutMs не могут быть отрицательными", w.URL)
+		}
+	}
+	for _, origin := range c.StreamOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			return errors.Newf("streamOrigins: origin должен быть вида scheme://host[:port] или *: '%s'", origin)
+		}
+	}
+	if c.MLDVersion < 0 || c.MLDVersion > 2 {
+		return errors.Newf("mldVersion должен быть 1 или 2: %d", c.MLDVersion)
+	}
+	switch c.ShutdownMode {
+	case "", ShutdownTeardown, ShutdownKeep:
+	default:
+		return errors.Newf("shutdownMode должен быть %s или %s: '%s'", ShutdownTeardown, ShutdownKeep, c.ShutdownMode)
+	}
+	routes := make(map[string]struct{})
+	ids := make(map[int]struct{})
+	for _, f := range c.Filters {
+		if err := f.Validate(); err != nil {
+			return errors.Newf("связка %s: %s", f.Route, err)
+		}
+		// в MLDv1 нет подписки на поток одного источника
+		if c.MLDVersion == 1 && f.IsIPv6() {
+			for _, src := range f.GetSources() {
+				if src.SourceIP != "" {
+					return errors.Newf("связка %s: sourceIP источника %s требует MLDv2, а mldVersion 1", f.Route, src.Name)
+				}
+			}
+		}
+		// выходы тоже route: в один адрес не могут отправлять две связки
+		for _, route := range f.Routes() {
+			if _, ok := routes[route]; ok {
+				return errors.Newf("route %s встречается в конфиге несколько раз", route)
+			}
+			routes[route] = struct{}{}
+		}
+		if f.Id == 0 {
+			continue
+		}
+		if _, ok := ids[f.Id]; ok {
+			return errors.Newf("id %d встречается в конфиге несколько раз", f.Id)
+		}
+		ids[f.Id] = struct{}{}
+	}
+	return nil
+}
+
+// AssignIDs выдает id связкам без id: по порядку в файле, пропуская занятые
+func (c *Config) AssignIDs() {
+	used := make(map[int]struct{})
+	for _, f := range c.Filters {
+		if f.Id > 0 {
+			used[f.Id] = struct{}{}
+		}
+	}
+	next := 1
+	for i := range c.Filters {
+		if c.Filters[i].Id > 0 {
+			continue
+		}
+		for {
+			if _, ok := used[next]; !ok {
+				break
+			}
+			next++
+		}
+		c.Filters[i].Id = next
+		used[next] = struct{}{}
+	}
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// Watch сигналит в канал, когда у файла меняется время модификации или размер.
+// Опрос, а не inotify: редакторы часто сохраняют файл через rename, и inotify теряет файл
+func Watch(fileName string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		last, _ := os.Stat(fileName)
+		t := time.NewTicker(interval)
+		for range t.C {
+			info, err := os.Stat(fileName)
+			if err != nil {
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic запись через временный файл рядом с целевым, fsync и rename,
+// чтобы при падении на диске оставалась либо старая, либо новая версия
+func WriteFileAtomic(fileName string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
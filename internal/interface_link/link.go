@@ -1,80 +1,165 @@
 package interface_link
 
 import (
-	"fmt"
 	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/ledger"
+	"github.com/jashakimov/multiswitcher/internal/logging"
 	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
 	"golang.org/x/sys/unix"
-	"log"
 	"net"
-	"os/exec"
+	"os"
 	"strconv"
 )
 
-func Configure(link netlink.Link, cfg *config.Config) {
-	log.Printf("Установка мультикаста на интерфейс: %s\n", cfg.Interface)
+var log = logging.For(logging.Link)
+
+func Configure(link netlink.Link, cfg *config.Config, l ledger.Ledger) {
+	log.Info("Установка мультикаста", "link", cfg.Interface)
 	// установка мултикаста
 	if err := LinkSetMulticast(link); err != nil {
 		panic(err)
 	}
 
-	log.Printf("Установка промискуитетного режима на интерфейс: %s\n", cfg.Interface)
+	log.Info("Установка промискуитетного режима", "link", cfg.Interface)
 	// установка промискуитетного режима
 	if err := netlink.SetPromiscOn(link); err != nil {
 		panic(err)
 	}
 
-	log.Printf("Установка qdisc на интерфейс: %s", cfg.Interface)
+	log.Info("Установка qdisc", "link", cfg.Interface)
 	// установка дисциплины, для последующей установки фильтров
-	if err := SetIngressQDisc(link); err != nil {
-		fmt.Println(err)
+	if err := SetIngressQDisc(link, l); err != nil {
+		log.Warn("Ошибка установки qdisc", "link", cfg.Interface, logging.Err(err))
 	}
 
 	// установка маршрутизации роутеров
-	if err := Route(link, cfg.Filters); err != nil {
+	if err := Route(link, cfg.Filters, l); err != nil {
 		panic(err)
 	}
 }
 
-func SetIngressQDisc(lnk netlink.Link) interface{} {
-	qDisc := &netlink.Ingress{
+// SetIngressQDisc в журнал попадает только qdisc, созданный нами, а не уже существовавший
+func SetIngressQDisc(lnk netlink.Link, l ledger.Ledger) error {
+	if err := netlink.QdiscAdd(ingressQDisc(lnk)); err != nil {
+		return err
+	}
+	l.Record(ledger.Entry{Kind: ledger.Qdisc, Link: lnk.Attrs().Name})
+	return nil
+}
+
+// DelIngressQDisc удаление ingress qdisc вместе со всеми его фильтрами
+func DelIngressQDisc(lnk netlink.Link, l ledger.Ledger) error {
+	if err := netlink.QdiscDel(ingressQDisc(lnk)); err != nil {
+		return err
+	}
+	log.Info("Удаление qdisc", "link", lnk.Attrs().Name)
+	l.Forget(ledger.Entry{Kind: ledger.Qdisc, Link: lnk.Attrs().Name})
+	return nil
+}
+
+func ingressQDisc(lnk netlink.Link) *netlink.Ingress {
+	return &netlink.Ingress{
 		QdiscAttrs: netlink.QdiscAttrs{
 			Parent:    netlink.HANDLE_INGRESS,
 			LinkIndex: lnk.Attrs().Index,
 			Handle:    netlink.HANDLE_NONE,
 		},
 	}
-
-	return netlink.QdiscAdd(qDisc)
 }
 
-func Route(lnk netlink.Link, filters []config.Filter) error {
+// Route маршруты route связок через lnk и их выходов через интерфейсы выходов
+func Route(lnk netlink.Link, filters []config.Filter, l ledger.Ledger) error {
 	for _, f := range filters {
-		ipParsed := net.ParseIP(f.Route)
-
-		route := &netlink.Route{
-			Dst: &net.IPNet{
-				IP:   ipParsed,
-				Mask: net.CIDRMask(32, 32),
-			},
-			LinkIndex: lnk.Attrs().Index,
+		if err := AddRoute(lnk, f.Route, l); err != nil {
+			return err
+		}
+		for _, o := range f.GetOutputs(lnk.Attrs().Name) {
+			if err := AddLinkRoute(o.Interface, o.Route, l); err != nil {
+				return err
+			}
 		}
+	}
+
+	return nil
+}
+
+// AddLinkRoute AddRoute через интерфейс по имени, для выходов связок на других интерфейсах
+func AddLinkRoute(link, dst string, l ledger.Ledger) error {
+	lnk, err := netlink.LinkByName(link)
+	if err != nil {
+		return err
+	}
+	return AddRoute(lnk, dst, l)
+}
+
+func DelLinkRoute(link, dst string, l ledger.Ledger) error {
+	lnk, err := netlink.LinkByName(link)
+	if err != nil {
+		return err
+	}
+	return DelRoute(lnk, dst, l)
+}
 
+// AddRoute маршрут /32 или /128 в группу dst через lnk, если маршрута в нее еще нет.
+// У IPv6 всегда есть маршруты ff00::/8 в таблице local, поэтому проверяется только маршрут ровно в dst
+func AddRoute(lnk netlink.Link, dst string, l ledger.Ledger) error {
+	ipParsed := net.ParseIP(dst)
+	if ipParsed.To4() != nil {
 		if _, err := netlink.RouteGet(ipParsed); err == nil {
-			continue
+			return nil
 		}
+	}
 
-		if err := netlink.RouteAdd(route); err != nil {
-			return err
+	if err := netlink.RouteAdd(hostRoute(lnk, ipParsed)); err != nil {
+		if err == unix.EEXIST {
+			return nil
 		}
-		log.Printf("Установка маршрутизации %s на интерфейс: %s\n", f.Route, lnk.Attrs().Name)
+		return err
 	}
+	log.Info("Установка маршрутизации", logging.KeyDstIP, dst, "link", lnk.Attrs().Name)
+	l.Record(ledger.Entry{Kind: ledger.Route, Link: lnk.Attrs().Name, IP: dst})
+	return nil
+}
 
+// DelRoute удаляет только маршрут, установленный нами
+func DelRoute(lnk netlink.Link, dst string, l ledger.Ledger) error {
+	if !l.Has(ledger.Entry{Kind: ledger.Route, Link: lnk.Attrs().Name, IP: dst}) {
+		return nil
+	}
+	if err := netlink.RouteDel(hostRoute(lnk, net.ParseIP(dst))); err != nil && err != unix.ESRCH {
+		return err
+	}
+	log.Info("Удаление маршрутизации", logging.KeyDstIP, dst, "link", lnk.Attrs().Name)
+	l.Forget(ledger.Entry{Kind: ledger.Route, Link: lnk.Attrs().Name, IP: dst})
 	return nil
 }
 
+func hostRoute(lnk netlink.Link, ip net.IP) *netlink.Route {
+	mask := net.CIDRMask(32, 32)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else {
+		mask = net.CIDRMask(128, 128)
+	}
+	return &netlink.Route{
+		Dst: &net.IPNet{
+			IP:   ip,
+			Mask: mask,
+		},
+		LinkIndex: lnk.Attrs().Index,
+	}
+}
+
+// SetMLDVersion версия MLD, которой ядро подписывается на IPv6 группы на lnk: 1, 2 или 0 - автоматически
+func SetMLDVersion(lnk netlink.Link, version int) error {
+	name := lnk.Attrs().Name
+	log.Info("Установка версии MLD", "link", name, "version", version)
+	return os.WriteFile("/proc/sys/net/ipv6/conf/"+name+"/force_mld_version", []byte(strconv.Itoa(version)), 0644)
+}
+
 func LinkSetMulticast(lnk netlink.Link) error {
 	base := lnk.Attrs()
 	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
@@ -91,15 +176,36 @@ func LinkSetMulticast(lnk netlink.Link) error {
 	return err
 }
 
-func MirrorTraffic(from, to netlink.Link, ips map[int]*filter.Filter) {
+func MirrorTraffic(tc traffic_control.TrafficControl, from, to netlink.Link, ips map[int]*filter.Filter) {
 	for _, ip := range ips {
-		cmdMaster := exec.Command("tc", "filter", "add", "dev",
-			from.Attrs().Name, "parent", "ffff:", "protocol", "ip", "prio", strconv.Itoa(ip.Cfg.MasterPrio), "u32",
-			"match", "ip", "dst", ip.MasterIP+"/32", "action", "mirred", "egress", "mirror", "dev", to.Attrs().Name)
-		cmdMaster.CombinedOutput()
-		cmdSlave := exec.Command("tc", "filter", "add", "dev",
-			from.Attrs().Name, "parent", "ffff:", "protocol", "ip", "prio", strconv.Itoa(ip.Cfg.SlavePrio), "u32",
-			"match", "ip", "dst", ip.SlaveIP+"/32", "action", "mirred", "egress", "mirror", "dev", to.Attrs().Name)
-		cmdSlave.CombinedOutput()
+		MirrorFilter(tc, from, to, ip)
+	}
+}
+
+// MirrorFilter зеркалирование источников связки. При форвардинге сокетами счетчики источников дают сами сокеты,
+// и они же передают принятое на разбор (udp_forward.Sink)
+func MirrorFilter(tc traffic_control.TrafficControl, from, to netlink.Link, f *filter.Filter) {
+	if f.IsUDPBackend() {
+		return
+	}
+	for _, src := range f.Sources {
+		rule := src.Match(from.Attrs().Name, src.MirrorPrio)
+		rule.MirrorTo = to.Attrs().Name
+		if err := tc.Add(rule); err != nil && !traffic_control.IsExist(err) {
+			log.Error("Ошибка зеркалирования трафика", logging.KeyFilterID, f.Id, logging.KeySourceIP, src.Key(), logging.Err(err))
+		}
+	}
+}
+
+func UnmirrorFilter(tc traffic_control.TrafficControl, from, to netlink.Link, f *filter.Filter) {
+	if f.IsUDPBackend() {
+		return
+	}
+	for _, src := range f.Sources {
+		rule := src.Match(from.Attrs().Name, src.MirrorPrio)
+		rule.MirrorTo = to.Attrs().Name
+		if err := tc.Del(rule); err != nil && !traffic_control.IsNotFound(err) {
+			log.Error("Ошибка удаления зеркалирования трафика", logging.KeyFilterID, f.Id, logging.KeySourceIP, src.Key(), logging.Err(err))
+		}
 	}
 }
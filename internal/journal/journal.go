@@ -0,0 +1,145 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.For(logging.Journal)
+
+// MemoryEvents сколько последних событий доступно через API
+const MemoryEvents = 10000
+
+// Event переключение связки. Счетчики - байты источников по зеркалированию
+// и байты на выходе связки на момент решения
+type Event struct {
+	Time        time.Time `json:"time"`
+	FilterId    int       `json:"filterId"`
+	Title       string    `json:"title"`
+	Route       string    `json:"route"`
+	From        string    `json:"from"`
+	FromIP      string    `json:"fromIP"`
+	To          string    `json:"to"`
+	ToIP        string    `json:"toIP"`
+	Reason      string    `json:"reason"`
+	FromBytes   uint64    `json:"fromBytes"`
+	ToBytes     uint64    `json:"toBytes"`
+	FilterBytes uint64    `json:"filterBytes"`
+	// Client кто переключил через API
+	Client string `json:"client,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Query отбор событий, пустые поля не ограничивают.
+// Source совпадает с именем или ip источника, с которого или на который переключались
+type Query struct {
+	FilterId int
+	Reason   string
+	Source   string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+type Journal interface {
+	Add(e Event)
+	Query(q Query) []Event
+}
+
+type journal struct {
+	lock   sync.Mutex
+	events *utils.Ring[Event]
+	file   *rotatingFile
+}
+
+// New журнал событий с записью в fileName, файл ротируется при достижении maxSize байт,
+// хранится maxFiles файлов. События из файлов подгружаются в память при запуске
+func New(fileName string, maxSize int64, maxFiles int) Journal {
+	j := &journal{
+		events: utils.NewRing[Event](MemoryEvents),
+		file:   newRotatingFile(fileName, maxSize, maxFiles),
+	}
+	for i := maxFiles - 1; i >= 0; i-- {
+		j.load(j.file.name(i))
+	}
+	return j
+}
+
+func (j *journal) Add(e Event) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.events.Push(e)
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Error("Ошибка записи журнала событий", logging.Err(err))
+		return
+	}
+	if err := j.file.write(append(line, '\n')); err != nil {
+		log.Error("Ошибка записи журнала событий", logging.Err(err))
+	}
+}
+
+// Query события по порядку времени, при Limit - последние Limit событий
+func (j *journal) Query(q Query) []Event {
+	j.lock.Lock()
+	events := j.events.Items()
+	j.lock.Unlock()
+
+	result := make([]Event, 0)
+	for _, e := range events {
+		if q.matches(e) {
+			result = append(result, e)
+		}
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result
+}
+
+func (q Query) matches(e Event) bool {
+	switch {
+	case q.FilterId != 0 && e.FilterId != q.FilterId:
+		return false
+	case q.Reason != "" && !strings.EqualFold(e.Reason, q.Reason):
+		return false
+	case !q.From.IsZero() && e.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && e.Time.After(q.To):
+		return false
+	case q.Source != "" && !strings.EqualFold(e.From, q.Source) && !strings.EqualFold(e.To, q.Source) &&
+		e.FromIP != q.Source && e.ToIP != q.Source:
+		return false
+	}
+	return true
+}
+
+func (j *journal) load(fileName string) {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Error("Ошибка чтения журнала событий", logging.Err(err))
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Warn("Пропуск строки журнала событий", "file", fileName, "line", n)
+			continue
+		}
+		j.events.Push(e)
+	}
+}
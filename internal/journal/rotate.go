@@ -0,0 +1,76 @@
+package journal
+
+import (
+	"os"
+	"strconv"
+)
+
+// rotatingFile файл, который при переполнении переименовывается в .1, .1 в .2 и так далее
+type rotatingFile struct {
+	fileName string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFile(fileName string, maxSize int64, maxFiles int) *rotatingFile {
+	return &rotatingFile{
+		fileName: fileName,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+}
+
+// name имя i-го файла, 0 - текущий
+func (r *rotatingFile) name(i int) string {
+	if i == 0 {
+		return r.fileName
+	}
+	return r.fileName + "." + strconv.Itoa(i)
+}
+
+func (r *rotatingFile) write(line []byte) error {
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+
+	os.Remove(r.name(r.maxFiles - 1))
+	for i := r.maxFiles - 2; i >= 0; i-- {
+		if err := os.Rename(r.name(i), r.name(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return r.open()
+}
@@ -0,0 +1,161 @@
+package ledger
+
+import (
+	"encoding/json"
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"os"
+	"sync"
+)
+
+var log = logging.For(logging.Ledger)
+
+type Kind string
+
+const (
+	Qdisc      Kind = "qdisc"
+	Filter     Kind = "filter"
+	Route      Kind = "route"
+	Membership Kind = "membership"
+	BPF        Kind = "bpf"
+)
+
+// Entry то, что установило приложение на хосте.
+// IP - match ip dst у фильтра, адрес маршрута или группа подписки, у классификатора eBPF есть только prio.
+// Src, Port и VLAN - уточнения совпадения фильтра, Handle - handle фильтра от ядра, Copies - копии в выходы
+type Entry struct {
+	Kind     Kind   `json:"kind"`
+	Link     string `json:"link"`
+	Priority int    `json:"priority,omitempty"`
+	Handle   uint32 `json:"handle,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Src      string `json:"src,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	VLAN     int    `json:"vlan,omitempty"`
+	NatTo    string `json:"natTo,omitempty"`
+	MirrorTo string `json:"mirrorTo,omitempty"`
+	Copies   []Copy `json:"copies,omitempty"`
+}
+
+// Copy копия потока фильтра: адрес To, зеркалирование на ingress Link
+type Copy struct {
+	To   string `json:"to"`
+	Link string `json:"link"`
+}
+
+// entryKey то, чем записи различаются в журнале
+type entryKey struct {
+	kind     Kind
+	link     string
+	priority int
+	handle   uint32
+	ip       string
+	src      string
+	port     int
+	vlan     int
+}
+
+// Ledger журнал установленного, по нему при остановке снимается только свое.
+// Хранится в файле, чтобы после перезапуска с сохранением форвардинга
+// установленное предыдущим процессом тоже считалось своим
+type Ledger interface {
+	Record(e Entry)
+	Forget(e Entry)
+	Has(e Entry) bool
+	Entries() []Entry
+}
+
+type ledger struct {
+	lock     sync.Mutex
+	fileName string
+	entries  []Entry
+}
+
+func New(fileName string) Ledger {
+	l := &ledger{fileName: fileName}
+
+	bytes, err := os.ReadFile(fileName)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Error("Ошибка чтения журнала установленного", logging.Err(err))
+	default:
+		if err := json.Unmarshal(bytes, &l.entries); err != nil {
+			log.Error("Ошибка чтения журнала установленного", logging.Err(err))
+		}
+	}
+
+	return l
+}
+
+func (l *ledger) Record(e Entry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.index(e) >= 0 {
+		return
+	}
+	l.entries = append(l.entries, e)
+	l.save()
+}
+
+func (l *ledger) Forget(e Entry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if i := l.index(e); i >= 0 {
+		l.entries = append(l.entries[:i:i], l.entries[i+1:]...)
+		l.save()
+	}
+}
+
+func (l *ledger) Has(e Entry) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.index(e) >= 0
+}
+
+// Entries копия журнала в порядке установки
+func (l *ledger) Entries() []Entry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entries := make([]Entry, len(l.entries))
+	copy(entries, l.entries)
+	return entries
+}
+
+func (l *ledger) index(e Entry) int {
+	for i, existing := range l.entries {
+		if existing.key() == e.key() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *ledger) save() {
+	bytes, err := json.MarshalIndent(l.entries, "", "    ")
+	if err != nil {
+		log.Error("Ошибка записи журнала установленного", logging.Err(err))
+		return
+	}
+	if err := config.WriteFileAtomic(l.fileName, bytes); err != nil {
+		log.Error("Ошибка записи журнала установленного", logging.Err(err))
+	}
+}
+
+// key фильтр определяется интерфейсом, prio, совпадением и handle, действие не важно
+func (e Entry) key() entryKey {
+	return entryKey{
+		kind:     e.Kind,
+		link:     e.Link,
+		priority: e.Priority,
+		handle:   e.Handle,
+		ip:       e.IP,
+		src:      e.Src,
+		port:     e.Port,
+		vlan:     e.VLAN,
+	}
+}
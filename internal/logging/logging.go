@@ -0,0 +1,234 @@
+package logging
+
+import (
+	"context"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// подсистемы, уровень логирования которых можно менять отдельно
+const (
+	Statistic   = "statistic"
+	Filter      = "filter"
+	Igmp        = "igmp"
+	NetListener = "net_listener"
+	API         = "api"
+	Manager     = "manager"
+	Link        = "interface_link"
+	Webhook     = "webhook"
+	Ledger      = "ledger"
+	Journal     = "journal"
+	Hitless     = "hitless"
+	UDPForward  = "udp_forward"
+	BPFForward  = "bpf_forward"
+	System      = "system"
+)
+
+// Default имя для уровня по умолчанию, действует на подсистемы без своего уровня
+const Default = "default"
+
+// общие поля записей
+const (
+	KeySubsystem = "subsystem"
+	KeyFilterID  = "filter_id"
+	KeyTitle     = "title"
+	KeySourceIP  = "source_ip"
+	KeyDstIP     = "dst_ip"
+	KeyReason    = "reason"
+	KeyError     = "error"
+)
+
+var (
+	base         atomic.Pointer[slog.Handler]
+	defaultLevel = new(slog.LevelVar)
+
+	lock       sync.Mutex
+	subsystems = make(map[string]*level)
+)
+
+// level уровень подсистемы, без своего уровня действует уровень по умолчанию
+type level struct {
+	set atomic.Bool
+	val slog.LevelVar
+}
+
+func (l *level) Level() slog.Level {
+	if l.set.Load() {
+		return l.val.Level()
+	}
+	return defaultLevel.Level()
+}
+
+func init() {
+	setOutput(os.Stdout, "text")
+	// стандартный log (gin, библиотеки) пишется как подсистема system
+	slog.SetDefault(For(System))
+}
+
+// Configure формат вывода (text или json), уровень по умолчанию и уровни подсистем.
+// Уровни подсистем, которых нет в levels, возвращаются к уровню по умолчанию
+func Configure(format, defaultLvl string, levels map[string]string) error {
+	if format != "" && format != "text" && format != "json" {
+		return errors.Newf("формат логов только text или json: '%s'", format)
+	}
+	parsed := make(map[string]slog.Level, len(levels))
+	for name, raw := range levels {
+		lvl, err := ParseLevel(raw)
+		if err != nil {
+			return errors.Newf("уровень логов %s: %s", name, err)
+		}
+		parsed[name] = lvl
+	}
+	lvl := slog.LevelInfo
+	if defaultLvl != "" {
+		var err error
+		if lvl, err = ParseLevel(defaultLvl); err != nil {
+			return err
+		}
+	}
+
+	setOutput(os.Stdout, format)
+	defaultLevel.Set(lvl)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for name, l := range subsystems {
+		if _, ok := parsed[name]; !ok {
+			l.set.Store(false)
+		}
+	}
+	for name, lvl := range parsed {
+		l := subsystemLevel(name)
+		l.val.Set(lvl)
+		l.set.Store(true)
+	}
+	return nil
+}
+
+// SetLevel уровень подсистемы во время работы, Default меняет уровень по умолчанию
+func SetLevel(subsystem, raw string) error {
+	lvl, err := ParseLevel(raw)
+	if err != nil {
+		return err
+	}
+	if subsystem == Default {
+		defaultLevel.Set(lvl)
+		return nil
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	l := subsystemLevel(subsystem)
+	l.val.Set(lvl)
+	l.set.Store(true)
+	return nil
+}
+
+// Levels действующие уровни всех известных подсистем и уровень по умолчанию
+func Levels() map[string]string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	levels := map[string]string{Default: strings.ToLower(defaultLevel.Level().String())}
+	for name, l := range subsystems {
+		levels[name] = strings.ToLower(l.Level().String())
+	}
+	return levels
+}
+
+// Subsystems имена известных подсистем
+func Subsystems() []string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	names := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func ParseLevel(raw string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(raw)); err != nil {
+		return lvl, errors.Newf("неизвестный уровень логов '%s', допустимы debug, info, warn, error", raw)
+	}
+	return lvl, nil
+}
+
+// For логгер подсистемы, можно создавать до Configure
+func For(subsystem string) *slog.Logger {
+	lock.Lock()
+	l := subsystemLevel(subsystem)
+	lock.Unlock()
+
+	return slog.New(&handler{level: l}).With(KeySubsystem, subsystem)
+}
+
+// Err поле с ошибкой
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.String(KeyError, "")
+	}
+	return slog.String(KeyError, err.Error())
+}
+
+func subsystemLevel(name string) *level {
+	l, ok := subsystems[name]
+	if !ok {
+		l = &level{}
+		subsystems[name] = l
+	}
+	return l
+}
+
+func setOutput(w io.Writer, format string) {
+	var h slog.Handler
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	base.Store(&h)
+}
+
+// handler фильтрует по уровню подсистемы и пишет в текущий общий вывод,
+// поэтому смена формата в Configure действует и на уже созданные логгеры
+type handler struct {
+	level *level
+	ops   []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, lvl slog.Level) bool {
+	return lvl >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := *base.Load()
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{level: h.level, ops: append(ops, op)}
+}
@@ -0,0 +1,109 @@
+package multicast
+
+import (
+	"gopkg.in/errgo.v2/fmt/errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Output дополнительный выход потока: группа Route через интерфейс Link
+type Output struct {
+	Route string
+	Link  string
+}
+
+// Sent отправленное в выход с его открытия
+type Sent struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+// Fanout копии потока в дополнительные выходы на том же UDP порту. Набор выходов меняется
+// во время отправки: Send берет текущий набор без блокировки
+type Fanout struct {
+	port    int
+	ttl     int
+	lock    sync.Mutex
+	outputs atomic.Pointer[[]*output]
+}
+
+type output struct {
+	Output
+	sender  *Sender
+	dst     *net.UDPAddr
+	bytes   atomic.Uint64
+	packets atomic.Uint64
+}
+
+func NewFanout(port, ttl int) *Fanout {
+	return &Fanout{port: port, ttl: ttl}
+}
+
+// Set замена набора выходов. Выходы, оставшиеся в наборе, сохраняют сокет и счетчики,
+// при ошибке открытия набор не меняется
+func (f *Fanout) Set(outputs []Output) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	current := make(map[Output]*output)
+	for _, o := range f.load() {
+		current[o.Output] = o
+	}
+	next := make([]*output, 0, len(outputs))
+	var opened []*output
+	for _, o := range outputs {
+		if existing, ok := current[o]; ok {
+			next = append(next, existing)
+			delete(current, o)
+			continue
+		}
+		sender, err := NewSender(o.Link, o.Route, f.ttl)
+		if err != nil {
+			for _, out := range opened {
+				out.sender.Close()
+			}
+			return errors.Newf("отправка в %s через %s: %s", o.Route, o.Link, err)
+		}
+		out := &output{Output: o, sender: sender, dst: &net.UDPAddr{IP: net.ParseIP(o.Route), Port: f.port}}
+		next = append(next, out)
+		opened = append(opened, out)
+	}
+	f.outputs.Store(&next)
+	// Send, взявший прежний набор, получит ошибку закрытого сокета и пропустит пакет
+	for _, removed := range current {
+		removed.sender.Close()
+	}
+	return nil
+}
+
+// Send копия пакета в каждый выход, ошибка одного выхода не мешает остальным
+func (f *Fanout) Send(data []byte) {
+	for _, o := range f.load() {
+		if err := o.sender.Send(data, o.dst); err != nil {
+			continue
+		}
+		o.bytes.Add(uint64(len(data)))
+		o.packets.Add(1)
+	}
+}
+
+// Sent счетчики выходов по route
+func (f *Fanout) Sent() map[string]Sent {
+	sent := make(map[string]Sent)
+	for _, o := range f.load() {
+		sent[o.Route] = Sent{Bytes: o.bytes.Load(), Packets: o.packets.Load()}
+	}
+	return sent
+}
+
+func (f *Fanout) Close() {
+	f.Set(nil)
+}
+
+func (f *Fanout) load() []*output {
+	if outputs := f.outputs.Load(); outputs != nil {
+		return *outputs
+	}
+	return nil
+}
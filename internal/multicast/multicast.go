@@ -0,0 +1,121 @@
+package multicast
+
+import (
+	"context"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// Group группа потока и адрес его источника для подписки (S,G), пустой Source - подписка от любого источника
+type Group struct {
+	IP     string
+	Source string
+}
+
+// ListenGroup UDP сокет, подписанный на группу IPv4 или IPv6 на интерфейсе link. Go привязывает сокет группы
+// к 0.0.0.0 или ::, поэтому IP_MULTICAST_ALL выключается: в сокет не попадают группы других сокетов на том же порту.
+// С адресом источника подписка source-specific (IGMPv3, MLDv2), пакеты других источников группы в сокет не попадают
+func ListenGroup(link string, group Group, port int) (net.PacketConn, error) {
+	ifi, err := net.InterfaceByName(link)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(group.IP)
+	lc := net.ListenConfig{Control: groupOnly}
+	conn, err := lc.ListenPacket(context.Background(), network(ip), net.JoinHostPort(group.IP, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if err := join(conn, ifi, group); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func join(conn net.PacketConn, ifi *net.Interface, group Group) error {
+	ip, src := &net.UDPAddr{IP: net.ParseIP(group.IP)}, &net.UDPAddr{IP: net.ParseIP(group.Source)}
+	switch {
+	case ip.IP.To4() != nil && group.Source != "":
+		return ipv4.NewPacketConn(conn).JoinSourceSpecificGroup(ifi, ip, src)
+	case ip.IP.To4() != nil:
+		return ipv4.NewPacketConn(conn).JoinGroup(ifi, ip)
+	case group.Source != "":
+		return ipv6.NewPacketConn(conn).JoinSourceSpecificGroup(ifi, ip, src)
+	}
+	return ipv6.NewPacketConn(conn).JoinGroup(ifi, ip)
+}
+
+func groupOnly(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "udp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_ALL, 0)
+			return
+		}
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_ALL, 0)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func network(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// Sender отправка потока в группы семейства group через интерфейс link
+type Sender struct {
+	conn net.PacketConn
+}
+
+// NewSender ttl - TTL для IPv4 или hop limit для IPv6
+func NewSender(link, group string, ttl int) (*Sender, error) {
+	ifi, err := net.InterfaceByName(link)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(group)
+	conn, err := net.ListenPacket(network(ip), ":0")
+	if err != nil {
+		return nil, err
+	}
+	// свой поток не нужен на входе этого же хоста
+	if ip.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		err = p.SetMulticastInterface(ifi)
+		if err == nil {
+			err = p.SetMulticastTTL(ttl)
+		}
+		p.SetMulticastLoopback(false)
+	} else {
+		p := ipv6.NewPacketConn(conn)
+		err = p.SetMulticastInterface(ifi)
+		if err == nil {
+			err = p.SetMulticastHopLimit(ttl)
+		}
+		p.SetMulticastLoopback(false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Sender{conn: conn}, nil
+}
+
+func (s *Sender) Send(data []byte, dst *net.UDPAddr) error {
+	_, err := s.conn.WriteTo(data, dst)
+	return err
+}
+
+func (s *Sender) Close() {
+	s.conn.Close()
+}
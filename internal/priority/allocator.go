@@ -0,0 +1,82 @@
+package priority
+
+import (
+	"gopkg.in/errgo.v2/fmt/errors"
+	"sync"
+)
+
+// диапазон prio для tc фильтров, 0 ядро трактует как "выбрать самому"
+const (
+	Min = 1
+	Max = 0xffff
+)
+
+// Allocator раздает prio tc фильтров в пределах интерфейса так,
+// чтобы фильтры разных связок, их источников и зеркалирования не пересекались
+type Allocator interface {
+	Reserve(link string, prio int, owner string) error
+	Allocate(link string, owner string) (int, error)
+	Release(link string, prio int)
+	Owner(link string, prio int) (string, bool)
+}
+
+type allocator struct {
+	lock sync.Mutex
+	used map[string]map[int]string
+}
+
+func NewAllocator() Allocator {
+	return &allocator{
+		used: make(map[string]map[int]string),
+	}
+}
+
+func (a *allocator) Reserve(link string, prio int, owner string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if prio < Min || prio > Max {
+		return errors.Newf("%s: prio %d вне диапазона %d-%d", owner, prio, Min, Max)
+	}
+	if other, ok := a.link(link)[prio]; ok {
+		return errors.Newf("%s: prio %d на %s уже занят (%s)", owner, prio, link, other)
+	}
+	a.link(link)[prio] = owner
+	return nil
+}
+
+func (a *allocator) Allocate(link string, owner string) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	used := a.link(link)
+	for prio := Min; prio <= Max; prio++ {
+		if _, ok := used[prio]; !ok {
+			used[prio] = owner
+			return prio, nil
+		}
+	}
+	return 0, errors.Newf("%s: нет свободных prio на %s", owner, link)
+}
+
+func (a *allocator) Release(link string, prio int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.link(link), prio)
+}
+
+func (a *allocator) Owner(link string, prio int) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	owner, ok := a.link(link)[prio]
+	return owner, ok
+}
+
+func (a *allocator) link(name string) map[int]string {
+	if _, ok := a.used[name]; !ok {
+		a.used[name] = make(map[int]string)
+	}
+	return a.used[name]
+}
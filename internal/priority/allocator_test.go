@@ -0,0 +1,101 @@
+package priority
+
+import "testing"
+
+func TestAllocator(t *testing.T) {
+	// op: reserve, allocate или release prio на link
+	type op struct {
+		kind string
+		link string
+		prio int
+		// want prio от allocate, err - ожидается ошибка
+		want int
+		err  bool
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "занятый prio",
+			ops: []op{
+				{kind: "reserve", link: "eth0", prio: 5},
+				{kind: "reserve", link: "eth0", prio: 5, err: true},
+			},
+		},
+		{
+			name: "интерфейсы независимы",
+			ops: []op{
+				{kind: "reserve", link: "eth0", prio: 5},
+				{kind: "reserve", link: "eth1", prio: 5},
+			},
+		},
+		{
+			name: "вне диапазона",
+			ops: []op{
+				{kind: "reserve", link: "eth0", prio: 0, err: true},
+				{kind: "reserve", link: "eth0", prio: Max + 1, err: true},
+				{kind: "reserve", link: "eth0", prio: Max},
+			},
+		},
+		{
+			name: "свободный prio в обход занятых",
+			ops: []op{
+				{kind: "reserve", link: "eth0", prio: 1},
+				{kind: "reserve", link: "eth0", prio: 3},
+				{kind: "allocate", link: "eth0", want: 2},
+				{kind: "allocate", link: "eth0", want: 4},
+				{kind: "allocate", link: "eth1", want: 1},
+			},
+		},
+		{
+			name: "освобожденный prio выдается снова",
+			ops: []op{
+				{kind: "allocate", link: "eth0", want: 1},
+				{kind: "allocate", link: "eth0", want: 2},
+				{kind: "release", link: "eth0", prio: 1},
+				{kind: "allocate", link: "eth0", want: 1},
+				{kind: "release", link: "eth0", prio: 2},
+				{kind: "reserve", link: "eth0", prio: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAllocator()
+			for i, o := range tt.ops {
+				var err error
+				switch o.kind {
+				case "reserve":
+					err = a.Reserve(o.link, o.prio, "test")
+				case "allocate":
+					var prio int
+					prio, err = a.Allocate(o.link, "test")
+					if err == nil && prio != o.want {
+						t.Fatalf("шаг %d: prio %d, ожидался %d", i, prio, o.want)
+					}
+				case "release":
+					a.Release(o.link, o.prio)
+				}
+				if (err != nil) != o.err {
+					t.Fatalf("шаг %d: ошибка %v, ожидалась %v", i, err, o.err)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocatorExhausted(t *testing.T) {
+	a := NewAllocator()
+	for prio := Min; prio <= Max; prio++ {
+		if err := a.Reserve("eth0", prio, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Allocate("eth0", "test"); err == nil {
+		t.Fatal("ожидалась ошибка: все prio заняты")
+	}
+	if owner, ok := a.Owner("eth0", Max); !ok || owner != "test" {
+		t.Fatalf("владелец %q %v", owner, ok)
+	}
+}
@@ -0,0 +1,317 @@
+package bpf_forward
+
+import (
+	"encoding/binary"
+	"github.com/jashakimov/multiswitcher/internal/bpf"
+	"github.com/jashakimov/multiswitcher/internal/ledger"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/priority"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"net"
+	"sync"
+)
+
+var log = logging.For(logging.BPFForward)
+
+// имя программы и фильтра tc, по нему находятся классификаторы, оставшиеся от прошлого запуска
+const progName = "multiswitcher"
+
+// maxEntries размер map: источников всех связок и самих связок
+const maxEntries = 4096
+
+// Forward связка на классификаторе: пакеты в группу активного источника Active уходят в Route
+type Forward struct {
+	Id      int
+	Sources []string
+	Active  int
+	Route   string
+}
+
+type Service interface {
+	statistic.Forwarder
+	Start(f Forward) error
+	// Switch смена активного источника одним обновлением map, пакет уходит либо со старым, либо с новым
+	Switch(id, active int) error
+	Stop(id int)
+}
+
+type forward struct {
+	sources []net.IP
+	active  int
+}
+
+type service struct {
+	lock     sync.Mutex
+	link     string
+	alloc    priority.Allocator
+	ledger   ledger.Ledger
+	sources  *bpf.Map
+	active   *bpf.Map
+	forwards map[int]*forward
+}
+
+// NewService классификатор загружается и ставится на ingress link при запуске первой связки
+func NewService(link string, alloc priority.Allocator, l ledger.Ledger) Service {
+	return &service{
+		link:     link,
+		alloc:    alloc,
+		ledger:   l,
+		forwards: make(map[int]*forward),
+	}
+}
+
+// Start запись источников и активного источника связки в map, повторный Start перезапускает связку
+func (s *service) Start(f Forward) error {
+	s.Stop(f.Id)
+	if f.Active < 0 || f.Active >= len(f.Sources) {
+		return errors.Newf("нет источника %d", f.Active)
+	}
+	route := net.ParseIP(f.Route).To4()
+	if route == nil {
+		return errors.Newf("классификатор работает только с IPv4: %s", f.Route)
+	}
+	fwd := &forward{active: f.Active}
+	for _, ip := range f.Sources {
+		src := net.ParseIP(ip).To4()
+		if src == nil {
+			return errors.Newf("классификатор работает только с IPv4: %s", ip)
+		}
+		fwd.sources = append(fwd.sources, src)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	for id, other := range s.forwards {
+		for _, ip := range other.sources {
+			for _, src := range fwd.sources {
+				if ip.Equal(src) {
+					return errors.Newf("источник %s уже в связке %d", src, id)
+				}
+			}
+		}
+	}
+
+	value := make([]byte, sourceValSize)
+	binary.NativeEndian.PutUint32(value[valFilterID:], uint32(f.Id))
+	for _, ip := range fwd.sources {
+		if err := s.sources.Update(ip, value); err != nil {
+			s.drop(f.Id, fwd)
+			return errors.Newf("запись источника %s: %s", ip, err)
+		}
+	}
+	s.forwards[f.Id] = fwd
+	if err := s.setActive(f.Id, fwd.sources[f.Active], route); err != nil {
+		s.drop(f.Id, fwd)
+		delete(s.forwards, f.Id)
+		return err
+	}
+	log.Info("Запуск форвардинга", logging.KeyFilterID, f.Id, logging.KeyDstIP, f.Route,
+		logging.KeySourceIP, f.Sources[f.Active])
+	return nil
+}
+
+func (s *service) Switch(id, active int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fwd, ok := s.forwards[id]
+	if !ok {
+		return errors.Newf("форвардинг связки %d не запущен", id)
+	}
+	if active < 0 || active >= len(fwd.sources) {
+		return errors.Newf("нет источника %d", active)
+	}
+	value := make([]byte, activeValSize)
+	if err := s.active.Lookup(key(id), value); err != nil {
+		return errors.Newf("чтение активного источника: %s", err)
+	}
+	if err := s.setActive(id, fwd.sources[active], value[actRoute:]); err != nil {
+		return err
+	}
+	fwd.active = active
+	return nil
+}
+
+// Stop удаление связки из map, ее пакеты проходят классификатор без изменений
+func (s *service) Stop(id int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fwd, ok := s.forwards[id]
+	if !ok {
+		return
+	}
+	s.drop(id, fwd)
+	delete(s.forwards, id)
+	log.Info("Остановка форвардинга", logging.KeyFilterID, id)
+}
+
+// Forwarded переданное в route с активного источника каждой связки
+func (s *service) Forwarded() map[string]statistic.Counter {
+	return s.counters(true, valFwdBytes, valFwdPackets)
+}
+
+// Received принятое классификатором от всех источников
+func (s *service) Received() map[string]statistic.Counter {
+	return s.counters(false, valRxBytes, valRxPackets)
+}
+
+func (s *service) counters(activeOnly bool, bytes, packets int) map[string]statistic.Counter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	counters := make(map[string]statistic.Counter)
+	value := make([]byte, sourceValSize)
+	for id, fwd := range s.forwards {
+		for i, ip := range fwd.sources {
+			if activeOnly && i != fwd.active {
+				continue
+			}
+			if err := s.sources.Lookup(ip, value); err != nil {
+				log.Debug("Ошибка чтения счетчиков", logging.KeySourceIP, ip.String(), logging.Err(err))
+				continue
+			}
+			counters[statistic.Key(id, ip.String())] = statistic.Counter{
+				Bytes:   binary.NativeEndian.Uint64(value[bytes:]),
+				Packets: binary.NativeEndian.Uint64(value[packets:]),
+			}
+		}
+	}
+	return counters
+}
+
+func (s *service) setActive(id int, source, route []byte) error {
+	value := make([]byte, 0, activeValSize)
+	value = append(append(value, source...), route...)
+	if err := s.active.Update(key(id), value); err != nil {
+		return errors.Newf("запись активного источника: %s", err)
+	}
+	return nil
+}
+
+func (s *service) drop(id int, fwd *forward) {
+	if err := s.active.Delete(key(id)); err != nil && err != unix.ENOENT {
+		log.Error("Ошибка удаления связки из map", logging.KeyFilterID, id, logging.Err(err))
+	}
+	for _, ip := range fwd.sources {
+		if err := s.sources.Delete(ip); err != nil && err != unix.ENOENT {
+			log.Error("Ошибка удаления источника из map", logging.KeyFilterID, id, logging.KeySourceIP, ip.String(), logging.Err(err))
+		}
+	}
+}
+
+func key(id int) []byte {
+	return binary.NativeEndian.AppendUint32(nil, uint32(id))
+}
+
+// load создание map, загрузка и установка классификатора. Классификаторы прошлого запуска
+// снимаются после установки нового, чтобы форвардинг, оставленный на хосте, не прерывался
+func (s *service) load() error {
+	if s.sources != nil {
+		return nil
+	}
+	lnk, err := netlink.LinkByName(s.link)
+	if err != nil {
+		return err
+	}
+	old, err := installed(lnk)
+	if err != nil {
+		return errors.Newf("список классификаторов: %s", err)
+	}
+	for _, prio := range old {
+		s.alloc.Reserve(s.link, prio, progName)
+	}
+
+	sources, err := bpf.NewHashMap(net.IPv4len, sourceValSize, maxEntries)
+	if err != nil {
+		return err
+	}
+	active, err := bpf.NewHashMap(4, activeValSize, maxEntries)
+	if err != nil {
+		sources.Close()
+		return err
+	}
+	insns, err := program(sources, active)
+	if err != nil {
+		sources.Close()
+		active.Close()
+		return err
+	}
+	fd, err := bpf.LoadSchedCLS(progName, insns, "GPL")
+	if err != nil {
+		sources.Close()
+		active.Close()
+		return err
+	}
+	// фильтр tc держит программу, а программа - map
+	defer unix.Close(fd)
+
+	prio, err := s.alloc.Allocate(s.link, progName)
+	if err != nil {
+		sources.Close()
+		active.Close()
+		return err
+	}
+	if err := netlink.FilterAdd(classifier(lnk, prio, fd)); err != nil {
+		s.alloc.Release(s.link, prio)
+		sources.Close()
+		active.Close()
+		return errors.Newf("установка классификатора: %s", err)
+	}
+	s.ledger.Record(ledger.Entry{Kind: ledger.BPF, Link: s.link, Priority: prio})
+	log.Info("Установка классификатора eBPF", "link", s.link, "priority", prio)
+
+	for _, p := range old {
+		if err := Detach(lnk, p, s.ledger); err != nil {
+			log.Error("Ошибка удаления классификатора", "link", s.link, "priority", p, logging.Err(err))
+		}
+		s.alloc.Release(s.link, p)
+	}
+	s.sources, s.active = sources, active
+	return nil
+}
+
+// Detach снятие классификатора с prio на ingress lnk
+func Detach(lnk netlink.Link, prio int, l ledger.Ledger) error {
+	if err := netlink.FilterDel(classifier(lnk, prio, 0)); err != nil && err != unix.ENOENT {
+		return err
+	}
+	log.Info("Удаление классификатора eBPF", "link", lnk.Attrs().Name, "priority", prio)
+	l.Forget(ledger.Entry{Kind: ledger.BPF, Link: lnk.Attrs().Name, Priority: prio})
+	return nil
+}
+
+// installed prio классификаторов, установленных на lnk этим приложением
+func installed(lnk netlink.Link) ([]int, error) {
+	filters, err := netlink.FilterList(lnk, netlink.HANDLE_INGRESS)
+	if err != nil {
+		return nil, err
+	}
+	var prios []int
+	for _, f := range filters {
+		if b, ok := f.(*netlink.BpfFilter); ok && b.Name == progName {
+			prios = append(prios, int(b.Priority))
+		}
+	}
+	return prios, nil
+}
+
+func classifier(lnk netlink.Link, prio, fd int) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: lnk.Attrs().Index,
+			Parent:    netlink.HANDLE_INGRESS,
+			Priority:  uint16(prio),
+			Protocol:  unix.ETH_P_IP,
+		},
+		Fd:           fd,
+		Name:         progName,
+		DirectAction: true,
+	}
+}
@@ -0,0 +1,150 @@
+package bpf_forward
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// смещения полей struct __sk_buff
+const (
+	skbLen     = 0
+	skbData    = 76
+	skbDataEnd = 80
+)
+
+// смещения в пакете: Ethernet без VLAN и IPv4
+const (
+	ethProto = 12
+	ipStart  = 14
+	ipProto  = ipStart + 9
+	ipCsum   = ipStart + 10
+	ipDst    = ipStart + 16
+	ipEnd    = ipStart + 20
+	udpCsum  = 6
+)
+
+// значение source: id связки и счетчики, принятое от источника и переданное в route
+const (
+	valFilterID   = 0
+	valRxBytes    = 8
+	valRxPackets  = 16
+	valFwdBytes   = 24
+	valFwdPackets = 32
+	sourceValSize = 40
+)
+
+// значение active: ip активного источника и route связки
+const (
+	actSource     = 0
+	actRoute      = 4
+	activeValSize = 8
+)
+
+// стек программы
+const (
+	stackDst   = -4
+	stackID    = -8
+	stackRoute = -12
+	stackL4    = -16
+	stackProto = -20
+)
+
+const (
+	tcActOK     = 0
+	tcActUnspec = -1
+)
+
+// program классификатор на ingress. Пакет в группу из sources считается в ее счетчиках,
+// если группа - активный источник связки по active, адрес назначения меняется на route связки
+// с пересчетом контрольных сумм IP и UDP, как у act_nat. Остальные пакеты идут дальше по фильтрам tc
+func program(sources, active *bpf.Map) ([]byte, error) {
+	a := &bpf.Asm{}
+	a.Mov64(bpf.R6, bpf.R1)
+
+	// заголовки Ethernet и IPv4 в пределах пакета
+	a.Load(bpf.W, bpf.R2, bpf.R6, skbData)
+	a.Load(bpf.W, bpf.R3, bpf.R6, skbDataEnd)
+	a.Mov64(bpf.R4, bpf.R2)
+	a.Add64Imm(bpf.R4, ipEnd)
+	a.Jump(unix.BPF_JGT, bpf.R4, bpf.R3, "pass")
+	a.Load(bpf.H, bpf.R4, bpf.R2, ethProto)
+	a.JumpImm(unix.BPF_JNE, bpf.R4, bpf.Htons(unix.ETH_P_IP), "pass")
+
+	// смещение UDP по длине заголовка IP, протокол и адрес назначения - на стек,
+	// после вызовов указатели на пакет недействительны
+	a.Load(bpf.B, bpf.R4, bpf.R2, ipStart)
+	a.And64Imm(bpf.R4, 0x0f)
+	a.Lsh64Imm(bpf.R4, 2)
+	a.Add64Imm(bpf.R4, ipStart)
+	a.Store(bpf.W, bpf.R10, bpf.R4, stackL4)
+	a.Load(bpf.B, bpf.R4, bpf.R2, ipProto)
+	a.Store(bpf.W, bpf.R10, bpf.R4, stackProto)
+	a.Load(bpf.W, bpf.R4, bpf.R2, ipDst)
+	a.Store(bpf.W, bpf.R10, bpf.R4, stackDst)
+	a.Load(bpf.W, bpf.R8, bpf.R6, skbLen)
+
+	// источник связки
+	a.LoadMap(bpf.R1, sources)
+	a.Mov64(bpf.R2, bpf.R10)
+	a.Add64Imm(bpf.R2, stackDst)
+	a.Call(bpf.FuncMapLookupElem)
+	a.JumpImm(unix.BPF_JEQ, bpf.R0, 0, "pass")
+	a.Mov64(bpf.R7, bpf.R0)
+	a.AtomicAdd64(bpf.R7, bpf.R8, valRxBytes)
+	a.Mov64Imm(bpf.R1, 1)
+	a.AtomicAdd64(bpf.R7, bpf.R1, valRxPackets)
+
+	// активный ли он
+	a.Load(bpf.W, bpf.R1, bpf.R7, valFilterID)
+	a.Store(bpf.W, bpf.R10, bpf.R1, stackID)
+	a.LoadMap(bpf.R1, active)
+	a.Mov64(bpf.R2, bpf.R10)
+	a.Add64Imm(bpf.R2, stackID)
+	a.Call(bpf.FuncMapLookupElem)
+	a.JumpImm(unix.BPF_JEQ, bpf.R0, 0, "pass")
+	a.Load(bpf.W, bpf.R1, bpf.R0, actSource)
+	a.Load(bpf.W, bpf.R2, bpf.R10, stackDst)
+	a.Jump(unix.BPF_JNE, bpf.R1, bpf.R2, "pass")
+	a.Load(bpf.W, bpf.R1, bpf.R0, actRoute)
+	a.Store(bpf.W, bpf.R10, bpf.R1, stackRoute)
+
+	// контрольные суммы IP и UDP, нулевая сумма UDP остается нулевой
+	a.Mov64(bpf.R1, bpf.R6)
+	a.Mov64Imm(bpf.R2, ipCsum)
+	a.Load(bpf.W, bpf.R3, bpf.R10, stackDst)
+	a.Load(bpf.W, bpf.R4, bpf.R10, stackRoute)
+	a.Mov64Imm(bpf.R5, 4)
+	a.Call(bpf.FuncL3CsumReplace)
+	a.JumpImm(unix.BPF_JNE, bpf.R0, 0, "pass")
+	a.Load(bpf.W, bpf.R1, bpf.R10, stackProto)
+	a.JumpImm(unix.BPF_JNE, bpf.R1, unix.IPPROTO_UDP, "store")
+	a.Mov64(bpf.R1, bpf.R6)
+	a.Load(bpf.W, bpf.R2, bpf.R10, stackL4)
+	a.Add64Imm(bpf.R2, udpCsum)
+	a.Load(bpf.W, bpf.R3, bpf.R10, stackDst)
+	a.Load(bpf.W, bpf.R4, bpf.R10, stackRoute)
+	a.Mov64Imm(bpf.R5, unix.BPF_F_PSEUDO_HDR|unix.BPF_F_MARK_MANGLED_0|4)
+	a.Call(bpf.FuncL4CsumReplace)
+	a.JumpImm(unix.BPF_JNE, bpf.R0, 0, "pass")
+
+	// новый адрес назначения
+	a.Label("store")
+	a.Mov64(bpf.R1, bpf.R6)
+	a.Mov64Imm(bpf.R2, ipDst)
+	a.Mov64(bpf.R3, bpf.R10)
+	a.Add64Imm(bpf.R3, stackRoute)
+	a.Mov64Imm(bpf.R4, 4)
+	a.Mov64Imm(bpf.R5, 0)
+	a.Call(bpf.FuncSkbStoreBytes)
+	a.JumpImm(unix.BPF_JNE, bpf.R0, 0, "pass")
+	a.AtomicAdd64(bpf.R7, bpf.R8, valFwdBytes)
+	a.Mov64Imm(bpf.R1, 1)
+	a.AtomicAdd64(bpf.R7, bpf.R1, valFwdPackets)
+	a.Mov64Imm(bpf.R0, tcActOK)
+	a.Exit()
+
+	a.Label("pass")
+	a.Mov64Imm(bpf.R0, tcActUnspec)
+	a.Exit()
+	return a.Assemble()
+}
@@ -0,0 +1,185 @@
+package bpf_forward
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/jashakimov/multiswitcher/internal/bpf"
+	"golang.org/x/sys/unix"
+)
+
+type insn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func (i insn) class() uint8 {
+	return i.code & 0x07
+}
+
+func (i insn) op() uint8 {
+	return i.code & 0xf0
+}
+
+// jump условный или безусловный переход, не вызов и не выход
+func (i insn) jump() bool {
+	return i.class() == unix.BPF_JMP && i.op() != unix.BPF_CALL && i.op() != unix.BPF_EXIT
+}
+
+// dst регистр назначения: в младших битах regs, на big endian - в старших
+func (i insn) dst() uint8 {
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		return i.regs >> 4
+	}
+	return i.regs & 0xf
+}
+
+func (i insn) loadMap() bool {
+	return i.code == unix.BPF_LD|unix.BPF_DW|unix.BPF_IMM
+}
+
+func assembled(t *testing.T) []insn {
+	b, err := program(&bpf.Map{}, &bpf.Map{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)%8 != 0 {
+		t.Fatalf("длина %d не кратна 8", len(b))
+	}
+	var result []insn
+	for i := 0; i < len(b); i += 8 {
+		result = append(result, insn{
+			code: b[i],
+			regs: b[i+1],
+			off:  int16(binary.NativeEndian.Uint16(b[i+2:])),
+			imm:  int32(binary.NativeEndian.Uint32(b[i+4:])),
+		})
+	}
+	return result
+}
+
+func TestProgramLayout(t *testing.T) {
+	insns := assembled(t)
+	n := len(insns)
+	exit := insn{code: unix.BPF_JMP | unix.BPF_EXIT}
+	movR0 := func(imm int32) insn {
+		return insn{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, imm: imm}
+	}
+
+	tests := []struct {
+		name  string
+		check func() string
+	}{
+		{
+			name: "конец программы: пропуск и форвардинг",
+			check: func() string {
+				tail := insns[n-4:]
+				if !reflect.DeepEqual(tail, []insn{movR0(tcActOK), exit, movR0(tcActUnspec), exit}) {
+					return "ожидались mov r0, 0; exit; mov r0, -1; exit"
+				}
+				return ""
+			},
+		},
+		{
+			name: "переходы внутри программы",
+			check: func() string {
+				for pc, i := range insns {
+					if !i.jump() {
+						continue
+					}
+					target := pc + int(i.off) + 1
+					if target <= pc || target >= n {
+						return "переход вне программы или назад"
+					}
+					if insns[target-1].loadMap() {
+						return "переход во второй слот загрузки map"
+					}
+				}
+				return ""
+			},
+		},
+		{
+			name: "переходы на pass или store",
+			check: func() string {
+				store := -1
+				for pc, i := range insns {
+					if !i.jump() {
+						continue
+					}
+					target := pc + int(i.off) + 1
+					if target == n-2 {
+						continue
+					}
+					if store >= 0 && target != store {
+						return "переход не на pass и не на store"
+					}
+					store = target
+				}
+				if store < 0 || insns[store].code != unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X {
+					return "store не начинается с mov r1, r6"
+				}
+				return ""
+			},
+		},
+		{
+			name: "загрузка map в два слота",
+			check: func() string {
+				count := 0
+				for pc, i := range insns {
+					if !i.loadMap() {
+						continue
+					}
+					count++
+					if i.regs>>4 != unix.BPF_PSEUDO_MAP_FD && i.regs&0xf != unix.BPF_PSEUDO_MAP_FD {
+						return "загрузка map без BPF_PSEUDO_MAP_FD"
+					}
+					if pc+1 >= n || insns[pc+1] != (insn{}) {
+						return "второй слот загрузки map не пустой"
+					}
+				}
+				if count != 2 {
+					return "ожидались две загрузки map"
+				}
+				return ""
+			},
+		},
+		{
+			name: "вызовы по порядку",
+			check: func() string {
+				var calls []int32
+				for _, i := range insns {
+					if i.class() == unix.BPF_JMP && i.op() == unix.BPF_CALL {
+						calls = append(calls, i.imm)
+					}
+				}
+				want := []int32{bpf.FuncMapLookupElem, bpf.FuncMapLookupElem, bpf.FuncL3CsumReplace,
+					bpf.FuncL4CsumReplace, bpf.FuncSkbStoreBytes}
+				if !reflect.DeepEqual(calls, want) {
+					return "вызовы helper функций не по порядку"
+				}
+				return ""
+			},
+		},
+		{
+			name: "стек в пределах 512 байт",
+			check: func() string {
+				for _, i := range insns {
+					if i.class() == unix.BPF_STX && i.dst() == bpf.R10 && (i.off >= 0 || i.off < -512) {
+						return "запись на стек за его пределами"
+					}
+				}
+				return ""
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg := tt.check(); msg != "" {
+				t.Fatal(msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"time"
+)
+
+// bitrateCheck счетчик опросов подряд, на которых битрейт активного источника вне порогов
+type bitrateCheck struct {
+	key     string
+	poll    time.Time
+	outside int
+	failed  bool
+}
+
+// OutsideBitrate битрейт вне порогов источника, без порогов всегда false
+func (src *Source) OutsideBitrate(bitrate float64) bool {
+	min, max := src.bitrateLimits()
+	return (min > 0 && bitrate < min) || (max > 0 && bitrate > max)
+}
+
+// bitrateLimits пороги битрейта источника, они меняются при перечитывании конфига
+func (src *Source) bitrateLimits() (float64, float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return src.MinBitrate, src.MaxBitrate
+}
+
+// SetBitrateLimits новые пороги битрейта i-го источника из конфига
+func (f *Filter) SetBitrateLimits(i int, min, max float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f.Sources[i].MinBitrate, f.Sources[i].MaxBitrate = min, max
+}
+
+// bitrateFailed true, когда битрейт источника вне порогов bitrateSamples опросов подряд.
+// Каждый опрос статистики учитывается один раз, счетчик сбрасывается при смене источника
+func (s *service) bitrateFailed(f *Filter, src *Source, c *bitrateCheck) bool {
+	min, max := src.bitrateLimits()
+	if min == 0 && max == 0 {
+		return false
+	}
+	if c.key != src.Key() {
+		*c = bitrateCheck{key: src.Key()}
+	}
+	poll := s.statManager.LastPoll()
+	if poll.Equal(c.poll) {
+		return c.failed
+	}
+	c.poll = poll
+	c.failed = false
+
+	stats, err := s.statManager.GetSourceStatsByIP(f.StatKey(src))
+	if err != nil || !src.OutsideBitrate(stats.Bitrate) {
+		c.outside = 0
+		return false
+	}
+	c.outside++
+
+	samples := f.GetCfg().BitrateSamples
+	if samples < 1 {
+		samples = 1
+	}
+	if c.outside < samples {
+		return false
+	}
+	c.failed = true
+	f.Log(log).Warn("Битрейт источника вне порогов", logging.KeySourceIP, src.Key(), "bitrate", stats.Bitrate,
+		"minBitrate", min, "maxBitrate", max, "samples", c.outside)
+	return true
+}
+
+// bitrateOK для выбора следующего источника: последний опрос его битрейта в пределах порогов
+func (s *service) bitrateOK(f *Filter, src *Source) bool {
+	stats, err := s.statManager.GetSourceStatsByIP(f.StatKey(src))
+	return err != nil || !src.OutsideBitrate(stats.Bitrate)
+}
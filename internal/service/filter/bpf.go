@@ -0,0 +1,36 @@
+package filter
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/service/bpf_forward"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// IsBPFBackend форвардинг связки классификатором eBPF вместо nat фильтра
+func (f *Filter) IsBPFBackend() bool {
+	return f.Cfg.Backend == config.BackendBPF
+}
+
+// startBPF запись связки в map классификатора с восстановленного активного источника, по умолчанию с мастера.
+// Nat фильтры снимаются только после запуска
+func (s *service) startBPF(f *Filter, installed map[int]traffic_control.Rule) error {
+	active := 0
+	if f.ActiveSource != "" {
+		active = f.GetActiveIndex()
+	}
+	fwd := bpf_forward.Forward{
+		Id:     f.Id,
+		Active: active,
+		Route:  f.DstIP,
+	}
+	for _, src := range f.Sources {
+		fwd.Sources = append(fwd.Sources, src.IP)
+	}
+	if err := s.bpf.Start(fwd); err != nil {
+		return errors.Newf("запуск классификатора: %s", err)
+	}
+	s.dropNat(f, installed)
+	f.SetActual(active)
+	return nil
+}
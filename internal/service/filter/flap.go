@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"time"
+)
+
+// Lockout блокировка связки защитой от постоянных переключений.
+// AutoSwitch - было ли включено автопереключение до блокировки, оно вернется при снятии
+type Lockout struct {
+	Since      time.Time `json:"since"`
+	Reason     string    `json:"reason"`
+	Source     string    `json:"source"`
+	AutoSwitch bool      `json:"autoSwitch"`
+}
+
+func (f *Filter) GetLockout() *Lockout {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Lockout
+}
+
+func (f *Filter) SetLockout(l *Lockout) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f.Lockout = l
+	f.switchTimes = nil
+}
+
+// countFlap запоминает автоматическое переключение, true - переключений за окно больше допустимого
+func (f *Filter) countFlap(now time.Time) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	flap := f.Cfg.Flap
+	if flap.MaxSwitches <= 0 || f.Lockout != nil {
+		return false
+	}
+	window := time.Duration(flap.WindowMs) * time.Millisecond
+	times := f.switchTimes[:0]
+	for _, t := range f.switchTimes {
+		if now.Sub(t) < window {
+			times = append(times, t)
+		}
+	}
+	f.switchTimes = append(times, now)
+	return len(f.switchTimes) > flap.MaxSwitches
+}
+
+// checkFlap после успешного переключения. Ручные переключения и переустановка при перечитывании
+// конфига не считаются
+func (s *service) checkFlap(f *Filter, reason Reason) {
+	if reason == ReasonManual || reason == ReasonReload || reason == ReasonFlapLock {
+		return
+	}
+	if !f.countFlap(time.Now()) {
+		return
+	}
+
+	flap := f.GetCfg().Flap
+	lockout := &Lockout{
+		Since:      time.Now(),
+		Reason:     fmt.Sprintf("больше %d переключений за %s", flap.MaxSwitches, time.Duration(flap.WindowMs)*time.Millisecond),
+		Source:     f.GetActual().Name,
+		AutoSwitch: f.GetAutoSwitch(),
+	}
+	f.SetAutoSwitch(false)
+	s.TurnOffAutoSwitch(f)
+
+	if i, ok := f.SourceIndex(flap.LockTo); ok && flap.LockTo != "" && f.Sources[i] != f.GetActual() {
+		if err := s.SwitchTo(f, i, ReasonFlapLock, ""); err == nil {
+			lockout.Source = f.Sources[i].Name
+		}
+	}
+	f.SetLockout(lockout)
+	f.Log(log).Error("Связка заблокирована, автопереключение выключено",
+		logging.KeyReason, lockout.Reason, "source", lockout.Source)
+	s.state.Save()
+}
+
+// ClearLockout снимает блокировку и возвращает автопереключение, если оно было включено
+func (s *service) ClearLockout(f *Filter) {
+	lockout := f.GetLockout()
+	if lockout == nil {
+		return
+	}
+	f.SetLockout(nil)
+	f.Log(log).Info("Блокировка связки снята", "autoSwitch", lockout.AutoSwitch)
+	s.SetAutoSwitch(f, lockout.AutoSwitch)
+}
@@ -0,0 +1,84 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jashakimov/multiswitcher/internal/config"
+)
+
+func TestCountFlap(t *testing.T) {
+	tests := []struct {
+		name string
+		flap config.Flap
+		// switchesMs моменты переключений от начала, lockoutAfter - блокировка связки перед переключением с этим номером
+		switchesMs   []int
+		lockoutAfter int
+		want         []bool
+	}{
+		{
+			name:       "без защиты",
+			switchesMs: []int{0, 1, 2, 3},
+			want:       []bool{false, false, false, false},
+		},
+		{
+			name:       "переключений не больше допустимого",
+			flap:       config.Flap{MaxSwitches: 3, WindowMs: 1000},
+			switchesMs: []int{0, 100, 200},
+			want:       []bool{false, false, false},
+		},
+		{
+			name:       "превышение за окно",
+			flap:       config.Flap{MaxSwitches: 2, WindowMs: 1000},
+			switchesMs: []int{0, 100, 200},
+			want:       []bool{false, false, true},
+		},
+		{
+			name:       "старые переключения выходят из окна",
+			flap:       config.Flap{MaxSwitches: 2, WindowMs: 1000},
+			switchesMs: []int{0, 500, 1000, 1400, 2500},
+			want:       []bool{false, false, false, true, false},
+		},
+		{
+			name:       "граница окна не входит",
+			flap:       config.Flap{MaxSwitches: 1, WindowMs: 1000},
+			switchesMs: []int{0, 1000, 2000},
+			want:       []bool{false, false, false},
+		},
+		{
+			name:         "заблокированная связка не считается",
+			flap:         config.Flap{MaxSwitches: 1, WindowMs: 1000},
+			switchesMs:   []int{0, 100, 200},
+			lockoutAfter: 1,
+			want:         []bool{false, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			f := &Filter{Cfg: Cfg{Flap: tt.flap}}
+			var got []bool
+			for i, ms := range tt.switchesMs {
+				if tt.lockoutAfter > 0 && i == tt.lockoutAfter {
+					f.Lockout = &Lockout{}
+				}
+				got = append(got, f.countFlap(start.Add(time.Duration(ms)*time.Millisecond)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetLockoutResetsSwitches(t *testing.T) {
+	start := time.Now()
+	f := &Filter{Cfg: Cfg{Flap: config.Flap{MaxSwitches: 1, WindowMs: 1000}}}
+	f.countFlap(start)
+	f.SetLockout(&Lockout{})
+	f.SetLockout(nil)
+	if f.countFlap(start.Add(100 * time.Millisecond)) {
+		t.Fatal("переключения до блокировки не должны учитываться после ее снятия")
+	}
+}
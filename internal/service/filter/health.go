@@ -0,0 +1,54 @@
+package filter
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/service/net_listener"
+)
+
+// watchesStream нужен ли разбор потоков источников net_listener
+func (c Cfg) watchesStream() bool {
+	return c.TSMaxErrorRate > 0 || c.RTPMaxLossRate > 0 || c.RTPMaxJitterMs > 0
+}
+
+// streamFailure причина, по которой поток источника считается битым, пустая - поток в порядке.
+// verbose - записать в лог, что именно не так
+func (s *service) streamFailure(f *Filter, ip string, verbose bool) Reason {
+	if health, broken := s.tsBroken(f, ip); broken {
+		if verbose {
+			f.Log(log).Warn("Ошибки TS выше допустимых", logging.KeySourceIP, ip, "errorRate", health.ErrorRate,
+				"ccErrors", health.CCErrors, "syncLoss", health.SyncLoss, "pcrGaps", health.PCRGaps)
+		}
+		return ReasonTSErrors
+	}
+	if stats, broken := s.rtpBroken(f, ip); broken {
+		if verbose {
+			f.Log(log).Warn("Потери или джиттер RTP выше допустимых", logging.KeySourceIP, ip,
+				"lossRate", stats.LossRate, "jitterMs", stats.JitterMs, "lost", stats.Lost, "reordered", stats.Reordered)
+		}
+		return ReasonRTP
+	}
+	return ""
+}
+
+func (s *service) tsBroken(f *Filter, ip string) (net_listener.TSHealth, bool) {
+	maxRate := f.GetCfg().TSMaxErrorRate
+	if maxRate <= 0 {
+		return net_listener.TSHealth{}, false
+	}
+	health, ok := s.listener.Health(ip)
+	return health, ok && health.ErrorRate > maxRate
+}
+
+// rtpBroken поток без RTP заголовков по этим порогам не проверяется
+func (s *service) rtpBroken(f *Filter, ip string) (net_listener.RTPStats, bool) {
+	cfg := f.GetCfg()
+	if cfg.RTPMaxLossRate <= 0 && cfg.RTPMaxJitterMs <= 0 {
+		return net_listener.RTPStats{}, false
+	}
+	stats, ok := s.listener.RTP(ip)
+	if !ok {
+		return stats, false
+	}
+	return stats, (cfg.RTPMaxLossRate > 0 && stats.LossRate > cfg.RTPMaxLossRate) ||
+		(cfg.RTPMaxJitterMs > 0 && stats.JitterMs > cfg.RTPMaxJitterMs)
+}
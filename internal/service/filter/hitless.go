@@ -0,0 +1,41 @@
+package filter
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/multicast"
+	"github.com/jashakimov/multiswitcher/internal/service/hitless"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"time"
+)
+
+// ErrHitless переключение связки, которая объединяет потоки всех источников
+var ErrHitless = errors.New("связка объединяет потоки источников (hitless), переключать нечего")
+
+// IsHitless поток связки собирается из всех источников в userspace, nat фильтра нет
+func (f *Filter) IsHitless() bool {
+	return f.Cfg.Hitless != nil
+}
+
+// startHitless запуск объединения вместо nat фильтра. Фильтры связки, оставшиеся
+// от обычного режима, снимаются только после запуска, активным считается мастер
+func (s *service) startHitless(f *Filter, installed map[int]traffic_control.Rule) error {
+	m := hitless.Merge{
+		Id:      f.Id,
+		Port:    f.Cfg.Hitless.Port,
+		Route:   f.DstIP,
+		InLink:  f.CopyFromInterface,
+		OutLink: f.InterfaceName,
+		Buffer:  time.Duration(f.Cfg.Hitless.BufferMs) * time.Millisecond,
+		TTL:     f.Cfg.Hitless.TTL,
+		Outputs: multicastOutputs(f.GetOutputs()),
+	}
+	for _, src := range f.Sources {
+		m.Sources = append(m.Sources, multicast.Group{IP: src.IP, Source: src.SourceIP})
+	}
+	if err := s.merger.Start(m); err != nil {
+		return errors.Newf("запуск объединения потоков: %s", err)
+	}
+	s.dropNat(f, installed)
+	f.SetActual(0)
+	return nil
+}
@@ -1,58 +1,345 @@
 package filter
 
 import (
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"log/slog"
 	"math/big"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Cfg struct {
-	Tries      int  `json:"tries"`
-	MsToSwitch int  `json:"msToSwitch"`
-	MasterPrio int  `json:"-"`
-	SlavePrio  int  `json:"-"`
-	AutoSwitch bool `json:"autoSwitch"`
+	Tries          int           `json:"tries"`
+	MsToSwitch     int           `json:"msToSwitch"`
+	AutoSwitch     bool          `json:"autoSwitch"`
+	TSMaxErrorRate float64       `json:"tsMaxErrorRate"`
+	RTPMaxLossRate float64       `json:"rtpMaxLossRate"`
+	RTPMaxJitterMs float64       `json:"rtpMaxJitterMs"`
+	BitrateSamples int           `json:"bitrateSamples"`
+	Revert         config.Revert `json:"revert"`
+	Flap           config.Flap   `json:"flap"`
+	// Backend форвардинг связки: tc, udp или bpf, UDP - параметры форвардинга сокетами
+	Backend string      `json:"backend"`
+	UDP     *config.UDP `json:"udp,omitempty"`
+	// Hitless объединение потоков источников вместо nat фильтра, nil - обычное переключение
+	Hitless *config.Hitless `json:"hitless,omitempty"`
+}
+
+type Source struct {
+	Name       string   `json:"name"`
+	IP         string   `json:"ip"`
+	SourceIP   string   `json:"sourceIP,omitempty"`
+	Port       int      `json:"port,omitempty"`
+	VLAN       int      `json:"vlan,omitempty"`
+	Prio       int      `json:"priority"`
+	MirrorPrio int      `json:"mirrorPriority"`
+	Bytes      *big.Int `json:"bytes"`
+	MinBitrate float64  `json:"minBitrate,omitempty"`
+	MaxBitrate float64  `json:"maxBitrate,omitempty"`
+}
+
+// Key ключ потока источника в счетчиках, прослушке и разборе потоков: без уточнений - ip группы
+func (s *Source) Key() string {
+	return traffic_control.Key(s.IP, s.SourceIP, s.Port, s.VLAN)
+}
+
+// Match фильтр на link с prio, совпадающий только с потоком источника, без действия
+func (s *Source) Match(link string, prio int) traffic_control.Rule {
+	return traffic_control.Rule{
+		Link:      link,
+		Priority:  prio,
+		MatchIP:   s.IP,
+		MatchSrc:  s.SourceIP,
+		MatchPort: s.Port,
+		VLAN:      s.VLAN,
+	}
+}
+
+// Output дополнительный выход связки: поток активного источника уходит и в Route через Interface
+type Output struct {
+	Route     string `json:"route"`
+	Interface string `json:"interface"`
 }
 
 type Filter struct {
-	Id                int      `json:"id"`
-	InterfaceName     string   `json:"interfaceName"`
-	CopyFromInterface string   `json:"-"`
-	MasterIP          string   `json:"masterIP"`
-	Hostname          string   `json:"hostname"`
-	SlaveIP           string   `json:"slaveIP"`
-	DstIP             string   `json:"dstIP"`
-	Title             string   `json:"title"`
-	IsMasterActual    bool     `json:"isMasterActual"`
-	IsIgmpOn          bool     `json:"isIgmpOn"`
-	IsReturnToMaster  bool     `json:"isReturnToMaster"`
-	MasterBytes       *big.Int `json:"masterBytes"`
-	SlaveBytes        *big.Int `json:"slaveBytes"`
-	Cfg               Cfg      `json:"config"`
+	Id                int       `json:"id"`
+	InterfaceName     string    `json:"interfaceName"`
+	CopyFromInterface string    `json:"-"`
+	Hostname          string    `json:"hostname"`
+	Sources           []*Source `json:"sources"`
+	Active            int       `json:"active"`
+	ActiveSource      string    `json:"activeSource"`
+	DstIP             string    `json:"dstIP"`
+	Outputs           []Output  `json:"outputs,omitempty"`
+	Title             string    `json:"title"`
+	IsIgmpOn          bool      `json:"isIgmpOn"`
+	IsReturnToMaster  bool      `json:"isReturnToMaster"`
+	// ActiveSince когда активным стал текущий источник
+	ActiveSince time.Time `json:"activeSince"`
+	// PendingRevert ожидание возврата на мастер, nil - возврат не ожидается
+	PendingRevert *PendingRevert `json:"pendingRevert,omitempty"`
+	// Lockout блокировка защитой от постоянных переключений, nil - связка не заблокирована
+	Lockout     *Lockout `json:"lockout,omitempty"`
+	switchTimes []time.Time
+	Cfg         Cfg `json:"config"`
+	// Switches количество переключений по причинам, отдается в /metrics
+	Switches map[Reason]uint64 `json:"-"`
 }
 
+// Reason причина переключения
+type Reason string
+
+const (
+	ReasonAuto           Reason = "auto"
+	ReasonManual         Reason = "manual"
+	ReasonReturnToMaster Reason = "return_to_master"
+	ReasonReload         Reason = "reload"
+	ReasonTSErrors       Reason = "ts_errors"
+	ReasonBitrate        Reason = "bitrate"
+	ReasonFlapLock       Reason = "flap_lock"
+	ReasonRTP            Reason = "rtp"
+)
+
 var mu sync.Mutex
 
+// FromConfig связка из конфига, prio источников из конфига, остальные выделяются ReservePrio
+func FromConfig(id int, cfg *config.Config, f config.Filter) *Filter {
+	var sources []*Source
+	for _, src := range f.GetSources() {
+		sources = append(sources, &Source{
+			Name:       src.Name,
+			IP:         src.IP,
+			SourceIP:   src.SourceIP,
+			Port:       src.Port,
+			VLAN:       src.VLAN,
+			Prio:       src.Priority,
+			MinBitrate: src.MinBitrate,
+			MaxBitrate: src.MaxBitrate,
+		})
+	}
+
+	var outputs []Output
+	for _, o := range f.GetOutputs(cfg.Interface) {
+		outputs = append(outputs, Output{Route: o.Route, Interface: o.Interface})
+	}
+
+	return &Filter{
+		Id:                id,
+		InterfaceName:     cfg.Interface,
+		Hostname:          cfg.Hostname,
+		Sources:           sources,
+		DstIP:             f.Route,
+		Outputs:           outputs,
+		Title:             f.Title,
+		CopyFromInterface: cfg.CopyTrafficFrom,
+		Cfg: Cfg{
+			Tries:          f.SwitchTries,
+			MsToSwitch:     cfg.StatFrequencySec,
+			AutoSwitch:     f.AutoSwitch,
+			TSMaxErrorRate: f.TSMaxErrorRate,
+			RTPMaxLossRate: f.RTPMaxLossRate,
+			RTPMaxJitterMs: f.RTPMaxJitterMs,
+			BitrateSamples: f.BitrateSamples,
+			Revert:         f.GetRevert(),
+			Flap:           f.GetFlap(),
+			Backend:        f.GetBackend(),
+			UDP:            f.GetUDP(),
+			Hitless:        f.GetHitless(),
+		},
+	}
+}
+
 func (f *Filter) SetBytes(val *big.Int) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	if f.IsMasterActual {
-		f.MasterBytes = val
-	} else {
-		f.SlaveBytes = val
-	}
+	f.Sources[f.Active].Bytes = val
 }
 
 func (f *Filter) GetBytes() *big.Int {
-	if f.IsMasterActual {
-		return f.MasterBytes
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Sources[f.Active].Bytes
+}
+
+// GetActualKey ключ потока активного источника
+func (f *Filter) GetActualKey() string {
+	return f.GetActual().Key()
+}
+
+// StatKey ключ счетчиков источника связки в статистике
+func (f *Filter) StatKey(src *Source) string {
+	return statistic.Key(f.Id, src.Key())
+}
+
+func (f *Filter) GetActual() *Source {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Sources[f.Active]
+}
+
+// GetOutputs копия выходов, выходы меняются через API во время работы
+func (f *Filter) GetOutputs() []Output {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return append([]Output(nil), f.Outputs...)
+}
+
+func (f *Filter) setOutputs(outputs []Output) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f.Outputs = append([]Output(nil), outputs...)
+}
+
+// GetCfg копия параметров связки: пороги и условия меняются при перечитывании конфига во время работы
+func (f *Filter) GetCfg() Cfg {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Cfg
+}
+
+// SetCfg замена параметров и названия из конфига разом. Автопереключение не меняется:
+// его переключают API и защита от переключений через SetAutoSwitch
+func (f *Filter) SetCfg(cfg Cfg, title string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	cfg.AutoSwitch = f.Cfg.AutoSwitch
+	f.Cfg = cfg
+	f.Title = title
+}
+
+// GetTitle название связки, оно меняется при перечитывании конфига
+func (f *Filter) GetTitle() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Title
+}
+
+// GetAutoSwitch включено ли автопереключение, флаг меняют API, конфиг и защита от переключений
+func (f *Filter) GetAutoSwitch() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Cfg.AutoSwitch
+}
+
+func (f *Filter) SetAutoSwitch(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f.Cfg.AutoSwitch = on
+}
+
+func (f *Filter) GetReturnToMaster() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.IsReturnToMaster
+}
+
+func (f *Filter) SetReturnToMaster(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f.IsReturnToMaster = on
+}
+
+// GetActiveIndex номер активного источника, его меняют автопереключение, API и возврат на мастер
+func (f *Filter) GetActiveIndex() int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Active
+}
+
+func (f *Filter) SetActual(i int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if f.Active != i || f.ActiveSince.IsZero() {
+		f.ActiveSince = time.Now()
 	}
-	return f.SlaveBytes
+	f.Active = i
+	f.ActiveSource = f.Sources[i].Name
+}
+
+func (f *Filter) GetActiveSince() time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.ActiveSince
+}
+
+func (f *Filter) SetPendingRevert(p *PendingRevert) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f.PendingRevert = p
+}
+
+func (f *Filter) GetPendingRevert() *PendingRevert {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.PendingRevert
+}
+
+func (f *Filter) CountSwitch(reason Reason) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if f.Switches == nil {
+		f.Switches = make(map[Reason]uint64)
+	}
+	f.Switches[reason]++
+}
+
+// GetSwitches копия счетчиков переключений
+func (f *Filter) GetSwitches() map[Reason]uint64 {
+	mu.Lock()
+	defer mu.Unlock()
+
+	switches := make(map[Reason]uint64, len(f.Switches))
+	for reason, n := range f.Switches {
+		switches[reason] = n
+	}
+	return switches
+}
+
+// Log логгер с полями связки: filter_id, title и dst_ip
+func (f *Filter) Log(l *slog.Logger) *slog.Logger {
+	return l.With(logging.KeyFilterID, f.Id, logging.KeyTitle, f.GetTitle(), logging.KeyDstIP, f.DstIP)
+}
+
+func (f *Filter) Master() *Source {
+	return f.Sources[0]
+}
+
+func (f *Filter) IsMasterActual() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return f.Active == 0
 }
 
-func (f *Filter) GetActualIP() string {
-	if f.IsMasterActual {
-		return f.MasterIP
+// SourceIndex поиск источника по имени или по номеру в списке (с единицы)
+func (f *Filter) SourceIndex(name string) (int, bool) {
+	for i, src := range f.Sources {
+		if strings.EqualFold(src.Name, name) || strconv.Itoa(i+1) == name {
+			return i, true
+		}
 	}
-	return f.SlaveIP
+	return 0, false
 }
@@ -0,0 +1,109 @@
+package filter
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/multicast"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// ErrBPFOutputs выходы у связки с классификатором eBPF, он отправляет поток только в route
+var ErrBPFOutputs = errors.New("backend bpf отправляет поток только в route, выходы не поддерживаются")
+
+// natRule nat фильтр потока src в route связки: перед nat поток копируется в каждый выход
+func natRule(f *Filter, src *Source, outputs []Output) traffic_control.Rule {
+	rule := src.Match(f.InterfaceName, src.Prio)
+	rule.NatTo = f.DstIP
+	rule.Copies = copies(outputs)
+	return rule
+}
+
+func copies(outputs []Output) []traffic_control.Copy {
+	var result []traffic_control.Copy
+	for _, o := range outputs {
+		result = append(result, traffic_control.Copy{To: o.Route, Link: o.Interface})
+	}
+	return result
+}
+
+// sameOutputs копии установленного фильтра идут ровно в outputs
+func sameOutputs(rule traffic_control.Rule, outputs []Output) bool {
+	if len(rule.Copies) != len(outputs) {
+		return false
+	}
+	for i, o := range outputs {
+		if rule.Copies[i].To != o.Route || rule.Copies[i].Link != o.Interface {
+			return false
+		}
+	}
+	return true
+}
+
+func multicastOutputs(outputs []Output) []multicast.Output {
+	result := make([]multicast.Output, 0, len(outputs))
+	for _, o := range outputs {
+		result = append(result, multicast.Output{Route: o.Route, Link: o.Interface})
+	}
+	return result
+}
+
+// SetOutputs новые выходы видны переключениям сразу, при ошибке возвращаются прежние
+func (s *service) SetOutputs(f *Filter, outputs []Output) error {
+	if f.IsBPFBackend() && len(outputs) > 0 {
+		return ErrBPFOutputs
+	}
+	old := f.GetOutputs()
+	f.setOutputs(outputs)
+
+	var err error
+	switch {
+	case f.IsHitless():
+		err = s.merger.SetOutputs(f.Id, multicastOutputs(outputs))
+	case f.IsUDPBackend():
+		err = s.forwarder.SetOutputs(f.Id, multicastOutputs(outputs))
+	case f.IsBPFBackend():
+	default:
+		actual := f.GetActual()
+		for i, rule := range s.installedSources(f) {
+			if f.Sources[i] == actual && !sameOutputs(rule, outputs) {
+				err = s.replaceNat(f, rule, outputs)
+			}
+		}
+	}
+	if err != nil {
+		f.setOutputs(old)
+		f.Log(log).Error("Ошибка замены выходов", logging.Err(err))
+		return err
+	}
+	f.Log(log).Info("Выходы связки изменены", "outputs", len(outputs))
+	s.state.Save()
+	return nil
+}
+
+// replaceNat замена установленного nat фильтра old на фильтр с копиями в outputs.
+// Новый фильтр ставится до удаления старого, чтобы поток в route не прерывался.
+// Flower не держит два фильтра с одним ключом на одном prio, тогда старый снимается первым
+func (s *service) replaceNat(f *Filter, old traffic_control.Rule, outputs []Output) error {
+	rule := old
+	rule.Handle, rule.Stats, rule.Copies = 0, traffic_control.Stats{}, copies(outputs)
+
+	err := s.tc.Add(rule)
+	if err == nil {
+		return s.tc.Del(old)
+	}
+	if !traffic_control.IsExist(err) {
+		return err
+	}
+	if err := s.tc.Del(old); err != nil && !traffic_control.IsNotFound(err) {
+		return err
+	}
+	if err := s.tc.Add(rule); err != nil {
+		// возвращаем прежний фильтр, чтобы не остаться без потока
+		old.Handle = 0
+		if err := s.tc.Add(old); err != nil {
+			f.Log(log).Error("Ошибка восстановления фильтра", logging.KeySourceIP, old.Key(), logging.Err(err))
+		}
+		return err
+	}
+	return nil
+}
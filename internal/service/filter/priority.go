@@ -0,0 +1,100 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/jashakimov/multiswitcher/internal/priority"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+)
+
+// ReservePrio выделяет prio nat фильтрам и зеркалированию источников.
+// Prio из конфига (Source.Prio > 0) занимаются первыми у всех связок, затем раздаются свободные.
+// Зеркалирование по возможности получает тот же prio, что и nat фильтр источника.
+// При ошибке все выделенное этим вызовом освобождается
+func ReservePrio(alloc priority.Allocator, filters ...*Filter) error {
+	type reserved struct {
+		link string
+		prio int
+	}
+	var done []reserved
+	rollback := func(err error) error {
+		for _, r := range done {
+			alloc.Release(r.link, r.prio)
+		}
+		return err
+	}
+
+	for _, f := range filters {
+		for _, src := range f.Sources {
+			if src.Prio == 0 {
+				continue
+			}
+			if err := alloc.Reserve(f.InterfaceName, src.Prio, owner(f, src, "nat")); err != nil {
+				return rollback(err)
+			}
+			done = append(done, reserved{f.InterfaceName, src.Prio})
+		}
+	}
+
+	for _, f := range filters {
+		for _, src := range f.Sources {
+			if src.Prio != 0 {
+				continue
+			}
+			prio, err := alloc.Allocate(f.InterfaceName, owner(f, src, "nat"))
+			if err != nil {
+				return rollback(err)
+			}
+			src.Prio = prio
+			done = append(done, reserved{f.InterfaceName, src.Prio})
+		}
+	}
+
+	for _, f := range filters {
+		for _, src := range f.Sources {
+			if err := alloc.Reserve(f.CopyFromInterface, src.Prio, owner(f, src, "mirror")); err == nil {
+				src.MirrorPrio = src.Prio
+				done = append(done, reserved{f.CopyFromInterface, src.MirrorPrio})
+				continue
+			}
+			prio, err := alloc.Allocate(f.CopyFromInterface, owner(f, src, "mirror"))
+			if err != nil {
+				return rollback(err)
+			}
+			src.MirrorPrio = prio
+			done = append(done, reserved{f.CopyFromInterface, src.MirrorPrio})
+		}
+	}
+
+	return nil
+}
+
+func ReleasePrio(alloc priority.Allocator, f *Filter) {
+	for _, src := range f.Sources {
+		alloc.Release(f.InterfaceName, src.Prio)
+		alloc.Release(f.CopyFromInterface, src.MirrorPrio)
+	}
+}
+
+// Owners связки по prio их nat фильтров и зеркалирования, по ним статистика разводит счетчики связок
+// с общим источником
+func Owners(db *utils.SyncMap[int, *Filter]) statistic.Owners {
+	return func(link string) map[int]int {
+		owners := make(map[int]int)
+		for id, f := range db.Values() {
+			for _, src := range f.Sources {
+				if f.InterfaceName == link {
+					owners[src.Prio] = id
+				}
+				if f.CopyFromInterface == link {
+					owners[src.MirrorPrio] = id
+				}
+			}
+		}
+		return owners
+	}
+}
+
+func owner(f *Filter, src *Source, kind string) string {
+	return fmt.Sprintf("фильтр %d (%s) %s %s", f.Id, f.DstIP, src.Name, kind)
+}
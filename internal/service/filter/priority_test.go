@@ -0,0 +1,146 @@
+package filter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jashakimov/multiswitcher/internal/priority"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+)
+
+// newPrioFilter связка с источниками с prio из конфига prios, 0 - выделить
+func newPrioFilter(id int, prios ...int) *Filter {
+	f := &Filter{Id: id, InterfaceName: "eth0", CopyFromInterface: "eth1"}
+	for i, prio := range prios {
+		f.Sources = append(f.Sources, &Source{Name: fmt.Sprintf("src%d", i), Prio: prio})
+	}
+	return f
+}
+
+func TestReservePrio(t *testing.T) {
+	tests := []struct {
+		name string
+		// nat и mirror prio, занятые до вызова на eth0 и eth1
+		nat, mirror []int
+		filters     []*Filter
+		// prio и mirrorPrio источников по порядку связок, nil при ошибке
+		want       [][2]int
+		err        bool
+		usedNat    []int
+		usedMirror []int
+	}{
+		{
+			name:       "prio из конфига занимаются первыми",
+			filters:    []*Filter{newPrioFilter(1, 0, 0), newPrioFilter(2, 1)},
+			want:       [][2]int{{2, 2}, {3, 3}, {1, 1}},
+			usedNat:    []int{1, 2, 3},
+			usedMirror: []int{1, 2, 3},
+		},
+		{
+			name:       "зеркалирование на занятом prio получает свободный",
+			mirror:     []int{1},
+			filters:    []*Filter{newPrioFilter(1, 0, 0)},
+			want:       [][2]int{{1, 2}, {2, 3}},
+			usedNat:    []int{1, 2},
+			usedMirror: []int{1, 2, 3},
+		},
+		{
+			name:       "коллизия prio из конфига",
+			filters:    []*Filter{newPrioFilter(1, 0, 7), newPrioFilter(2, 7)},
+			err:        true,
+			usedNat:    []int{},
+			usedMirror: []int{},
+		},
+		{
+			name:       "коллизия с занятым до вызова не трогает чужое",
+			nat:        []int{4},
+			filters:    []*Filter{newPrioFilter(1, 3, 4)},
+			err:        true,
+			usedNat:    []int{4},
+			usedMirror: []int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := priority.NewAllocator()
+			for _, prio := range tt.nat {
+				alloc.Reserve("eth0", prio, "другой")
+			}
+			for _, prio := range tt.mirror {
+				alloc.Reserve("eth1", prio, "другой")
+			}
+
+			err := ReservePrio(alloc, tt.filters...)
+			if (err != nil) != tt.err {
+				t.Fatalf("ошибка %v, ожидалась %v", err, tt.err)
+			}
+			if !tt.err {
+				var got [][2]int
+				for _, f := range tt.filters {
+					for _, src := range f.Sources {
+						got = append(got, [2]int{src.Prio, src.MirrorPrio})
+					}
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("prio %v, ожидалось %v", got, tt.want)
+				}
+			}
+			if got := used(alloc, "eth0"); !reflect.DeepEqual(got, tt.usedNat) {
+				t.Fatalf("занято на eth0 %v, ожидалось %v", got, tt.usedNat)
+			}
+			if got := used(alloc, "eth1"); !reflect.DeepEqual(got, tt.usedMirror) {
+				t.Fatalf("занято на eth1 %v, ожидалось %v", got, tt.usedMirror)
+			}
+		})
+	}
+}
+
+func TestReleasePrio(t *testing.T) {
+	alloc := priority.NewAllocator()
+	first, second := newPrioFilter(1, 0, 0), newPrioFilter(2, 0)
+	if err := ReservePrio(alloc, first, second); err != nil {
+		t.Fatal(err)
+	}
+	ReleasePrio(alloc, first)
+	if got := used(alloc, "eth0"); !reflect.DeepEqual(got, []int{3}) {
+		t.Fatalf("занято на eth0 %v, ожидалось [3]", got)
+	}
+	if got := used(alloc, "eth1"); !reflect.DeepEqual(got, []int{3}) {
+		t.Fatalf("занято на eth1 %v, ожидалось [3]", got)
+	}
+}
+
+// used занятые prio на link в начале диапазона
+func used(alloc priority.Allocator, link string) []int {
+	result := []int{}
+	for prio := priority.Min; prio <= 16; prio++ {
+		if _, ok := alloc.Owner(link, prio); ok {
+			result = append(result, prio)
+		}
+	}
+	return result
+}
+
+func TestOwners(t *testing.T) {
+	// две связки с общим источником: у каждой свой nat фильтр и свое зеркалирование
+	db := utils.NewSyncMap[int, *Filter]()
+	first, second := newPrioFilter(1, 0), newPrioFilter(2, 0)
+	if err := ReservePrio(priority.NewAllocator(), first, second); err != nil {
+		t.Fatal(err)
+	}
+	first.Sources[0].MirrorPrio = 7
+	db.Set(1, first)
+	db.Set(2, second)
+
+	owners := Owners(db)
+	if got, want := owners("eth0"), map[int]int{1: 1, 2: 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("eth0 %v, ожидалось %v", got, want)
+	}
+	if got, want := owners("eth1"), map[int]int{7: 1, 2: 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("eth1 %v, ожидалось %v", got, want)
+	}
+	if key1, key2 := first.StatKey(first.Sources[0]), second.StatKey(second.Sources[0]); key1 == key2 {
+		t.Fatalf("у связок один ключ счетчиков %q", key1)
+	}
+}
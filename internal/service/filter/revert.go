@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"time"
+)
+
+const (
+	// revertTick как часто проверяются условия возврата на мастер
+	revertTick = 100 * time.Millisecond
+	// masterGap перерыв в пакетах мастера, после которого стабильность считается заново
+	masterGap = 500 * time.Millisecond
+)
+
+// чего ждет возврат на мастер
+const (
+	WaitStability = "stability"
+	WaitBackup    = "backup"
+	WaitSchedule  = "schedule"
+)
+
+// PendingRevert ожидание возврата на мастер: мастер идет, но условия revert еще не выполнены
+type PendingRevert struct {
+	MasterHealthySince time.Time `json:"masterHealthySince"`
+	RevertAt           time.Time `json:"revertAt"`
+	RemainingMs        int64     `json:"remainingMs"`
+	WaitingFor         string    `json:"waitingFor"`
+}
+
+// pendingRevert nil, если вернуться на мастер можно сейчас
+func pendingRevert(f *Filter, healthySince, now time.Time) *PendingRevert {
+	revert := f.GetCfg().Revert
+	p := &PendingRevert{MasterHealthySince: healthySince, RevertAt: now}
+
+	if at := healthySince.Add(time.Duration(revert.StableMs) * time.Millisecond); at.After(p.RevertAt) {
+		p.RevertAt, p.WaitingFor = at, WaitStability
+	}
+	if at := f.GetActiveSince().Add(time.Duration(revert.MinBackupMs) * time.Millisecond); at.After(p.RevertAt) {
+		p.RevertAt, p.WaitingFor = at, WaitBackup
+	}
+	// окна проверены при чтении конфига
+	windows, _ := revert.ParseWindows()
+	if len(windows) > 0 {
+		var next time.Time
+		allowed := false
+		for _, w := range windows {
+			if w.Contains(p.RevertAt) {
+				allowed = true
+				break
+			}
+			if start := w.Next(p.RevertAt); next.IsZero() || start.Before(next) {
+				next = start
+			}
+		}
+		if !allowed {
+			p.RevertAt, p.WaitingFor = next, WaitSchedule
+		}
+	}
+
+	if !p.RevertAt.After(now) {
+		return nil
+	}
+	p.RemainingMs = p.RevertAt.Sub(now).Milliseconds()
+	return p
+}
+
+// masterHealthy мастер без ошибок TS и RTP и с битрейтом в пределах порогов
+func (s *service) masterHealthy(f *Filter) bool {
+	master := f.Master()
+	return s.streamFailure(f, master.Key(), false) == "" && s.bitrateOK(f, master)
+}
+
+// returnToMasterListener пакеты мастера приходят из net_listener в c. Возврат происходит, когда мастер
+// идет без перерывов revert.stableMs, на резерве провели revert.minBackupMs и время попадает в окно
+func (s *service) returnToMasterListener(id int, c chan int, stop chan struct{}) {
+	t := time.NewTicker(revertTick)
+	defer t.Stop()
+
+	var lastPacket, healthySince time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c:
+			lastPacket = time.Now()
+			continue
+		case <-t.C:
+		}
+
+		fil, ok := s.db.Get(id)
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		if !fil.GetReturnToMaster() || fil.IsMasterActual() || fil.GetLockout() != nil ||
+			now.Sub(lastPacket) > masterGap || !s.masterHealthy(fil) {
+			healthySince = time.Time{}
+			fil.SetPendingRevert(nil)
+			continue
+		}
+		if healthySince.IsZero() {
+			healthySince = lastPacket
+		}
+		if pending := pendingRevert(fil, healthySince, now); pending != nil {
+			if fil.GetPendingRevert() == nil {
+				fil.Log(log).Info("Мастер восстановился, ожидаем возврата",
+					"waitingFor", pending.WaitingFor, "revertAt", pending.RevertAt)
+			}
+			fil.SetPendingRevert(pending)
+			continue
+		}
+
+		fil.SetPendingRevert(nil)
+		healthySince = time.Time{}
+		fil.Log(log).Info("Восстановился поток - возвращаем на мастер",
+			logging.KeySourceIP, fil.Master().Key(), logging.KeyReason, ReasonReturnToMaster)
+		s.SwitchTo(fil, 0, ReasonReturnToMaster, "")
+	}
+}
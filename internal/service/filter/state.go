@@ -0,0 +1,110 @@
+package filter
+
+import (
+	"encoding/json"
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"os"
+	"sync"
+)
+
+// FilterState решения оператора и автопереключения, которые должны пережить перезапуск
+type FilterState struct {
+	Route            string   `json:"route"`
+	ActiveSource     string   `json:"activeSource"`
+	AutoSwitch       bool     `json:"autoSwitch"`
+	IsIgmpOn         bool     `json:"isIgmpOn"`
+	IsReturnToMaster bool     `json:"isReturnToMaster"`
+	Lockout          *Lockout `json:"lockout,omitempty"`
+}
+
+type StateStore interface {
+	Save()
+	Restore() []int
+}
+
+type stateStore struct {
+	lock     sync.Mutex
+	fileName string
+	db       *utils.SyncMap[int, *Filter]
+	last     []byte
+}
+
+func NewStateStore(fileName string, db *utils.SyncMap[int, *Filter]) StateStore {
+	return &stateStore{
+		fileName: fileName,
+		db:       db,
+	}
+}
+
+// Save снимок состояния всех связок, файл перезаписывается только при изменениях
+func (s *stateStore) Save() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := make(map[int]FilterState)
+	for id, f := range s.db.Values() {
+		state[id] = FilterState{
+			Route:            f.DstIP,
+			ActiveSource:     f.GetActual().Name,
+			AutoSwitch:       f.GetAutoSwitch(),
+			IsIgmpOn:         f.IsIgmpOn,
+			IsReturnToMaster: f.GetReturnToMaster(),
+			Lockout:          f.GetLockout(),
+		}
+	}
+
+	bytes, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		log.Error("Ошибка сохранения состояния", logging.Err(err))
+		return
+	}
+	if string(bytes) == string(s.last) {
+		return
+	}
+	if err := config.WriteFileAtomic(s.fileName, bytes); err != nil {
+		log.Error("Ошибка сохранения состояния", logging.Err(err))
+		return
+	}
+	s.last = bytes
+}
+
+// Restore переносит сохраненное состояние на связки до их запуска.
+// Состояние связки применяется, только если у нее не изменился route.
+// Возвращает id связок, для которых был включен IGMP - его надо включить заново
+func (s *stateStore) Restore() []int {
+	bytes, err := os.ReadFile(s.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Error("Ошибка чтения состояния", logging.Err(err))
+		return nil
+	}
+
+	state := make(map[int]FilterState)
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		log.Error("Ошибка чтения состояния", logging.Err(err))
+		return nil
+	}
+
+	var igmp []int
+	for id, st := range state {
+		f, ok := s.db.Get(id)
+		if !ok || f.DstIP != st.Route {
+			continue
+		}
+		if i, ok := f.SourceIndex(st.ActiveSource); ok {
+			f.SetActual(i)
+		}
+		f.SetAutoSwitch(st.AutoSwitch)
+		f.SetReturnToMaster(st.IsReturnToMaster)
+		f.Lockout = st.Lockout
+		if st.IsIgmpOn {
+			igmp = append(igmp, id)
+		}
+		f.Log(log).Info("Восстановлено состояние связки", "source", f.ActiveSource, "autoSwitch", f.GetAutoSwitch())
+	}
+	return igmp
+}
@@ -1,166 +1,385 @@
 package filter
 
 import (
+	"github.com/jashakimov/multiswitcher/internal/journal"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/service/bpf_forward"
+	"github.com/jashakimov/multiswitcher/internal/service/hitless"
 	"github.com/jashakimov/multiswitcher/internal/service/net_listener"
 	"github.com/jashakimov/multiswitcher/internal/service/statistic"
-	"log"
-	"os/exec"
-	"strconv"
+	"github.com/jashakimov/multiswitcher/internal/service/udp_forward"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"gopkg.in/errgo.v2/fmt/errors"
 	"sync"
 	"time"
 )
 
+var log = logging.For(logging.Filter)
+
 type Service interface {
-	Add(interfaceName string, priority int, ip, route string)
-	Del(interfaceName string, priority int, ip, route string)
-	IsExistFilters(data *Filter) (bool, bool)
+	Add(f *Filter, src *Source) error
+	Del(f *Filter, src *Source) error
+	// SetOutputs замена выходов связки во время работы, активный источник не меняется
+	SetOutputs(f *Filter, outputs []Output) error
+	Installed(interfaceName string) ([]traffic_control.Rule, error)
+	IsExistFilters(data *Filter) []bool
 	AutoSwitch(f *Filter)
-	ChangeFilter(f *Filter)
+	ChangeFilter(f *Filter, reason Reason) error
+	SwitchTo(f *Filter, i int, reason Reason, client string) error
+	RecordSwitch(f *Filter, from *Source, reason Reason, client string, err error)
 	TurnOffAutoSwitch(f *Filter)
-	ReturnToMaster(info *Filter, toggle bool)
+	ReturnToMaster(info *Filter, toggle bool) error
+	SetAutoSwitch(f *Filter, on bool)
+	// WatchHealth включает или выключает разбор потоков источников по порогам TS и RTP в Cfg
+	WatchHealth(f *Filter)
+	// ClearLockout снятие блокировки защиты от постоянных переключений
+	ClearLockout(f *Filter)
+	Start(f *Filter) error
+	Stop(f *Filter)
+	Shutdown()
 }
 
 type service struct {
-	workersQueue           map[string]struct{}
-	turnOff                chan *Filter
-	statManager            statistic.Service
-	listener               net_listener.Listener
-	db                     map[int]*Filter
-	returnToMasterChannels map[string]chan int
+	tc          traffic_control.TrafficControl
+	lock        sync.Mutex
+	workers     map[int]chan struct{}
+	statManager statistic.Service
+	listener    net_listener.Listener
+	db          *utils.SyncMap[int, *Filter]
+	state       StateStore
+	journal     journal.Journal
+	merger      hitless.Service
+	forwarder   udp_forward.Service
+	bpf         bpf_forward.Service
+	// каналы для прослушки мастер ip и остановки их обработчиков
+	returnToMasterChannels map[int]chan int
+	returnToMasterStop     map[int]chan struct{}
 }
 
-func NewService(statManager statistic.Service, db map[int]*Filter, listener net_listener.Listener) Service {
+func NewService(
+	tc traffic_control.TrafficControl,
+	statManager statistic.Service,
+	db *utils.SyncMap[int, *Filter],
+	listener net_listener.Listener,
+	state StateStore,
+	journal journal.Journal,
+	merger hitless.Service,
+	forwarder udp_forward.Service,
+	bpf bpf_forward.Service,
+) Service {
 	s := &service{
-		turnOff:                make(chan *Filter),
+		tc:                     tc,
 		statManager:            statManager,
-		workersQueue:           make(map[string]struct{}),
+		workers:                make(map[int]chan struct{}),
 		listener:               listener,
 		db:                     db,
-		returnToMasterChannels: map[string]chan int{},
+		state:                  state,
+		journal:                journal,
+		merger:                 merger,
+		forwarder:              forwarder,
+		bpf:                    bpf,
+		returnToMasterChannels: make(map[int]chan int),
+		returnToMasterStop:     make(map[int]chan struct{}),
+	}
+	time.Sleep(time.Second * 2)
+	for _, data := range db.Values() {
+		if err := s.Start(data); err != nil {
+			data.Log(log).Error("Ошибка запуска связки", logging.Err(err))
+		}
 	}
-	s.configureFilters(db)
-	s.returnToMasterListener()
 
 	return s
 }
 
-func (s *service) Add(interfaceName string, priority int, ip, route string) {
-	cmd := exec.Command(
-		"tc", "filter", "add", "dev", interfaceName, "parent", "ffff:",
-		"protocol", "ip",
-		"prio", strconv.Itoa(priority), "u32",
-		"match", "ip", "dst", ip,
-		"action", "nat", "ingress", ip, route,
-	)
-	log.Println("Создание фильтра", cmd.String())
-	if _, err := cmd.Output(); err != nil {
-		log.Println("Ошибка добавление фильтра")
+// Add nat фильтр потока src в route связки с копиями в ее выходы
+func (s *service) Add(f *Filter, src *Source) error {
+	rule := natRule(f, src, f.GetOutputs())
+	log.Debug("Создание фильтра", ruleAttrs(rule)...)
+	if err := s.tc.Add(rule); err != nil {
+		log.Error("Ошибка добавления фильтра", append(ruleAttrs(rule), logging.Err(err))...)
+		return err
 	}
+	return nil
 }
 
-func (s *service) Del(interfaceName string, priority int, ip, route string) {
-	cmd := exec.Command(
-		"tc", "filter", "delete", "dev", interfaceName, "parent", "ffff:",
-		"protocol", "ip",
-		"prio", strconv.Itoa(priority), "u32",
-		"match", "ip", "dst", ip,
-		"action", "nat", "ingress", ip, route,
-	)
-	log.Println("Удаление фильтра", cmd.String())
-	if _, err := cmd.Output(); err != nil {
-		log.Println("Ошибка удаления фильтра")
+func (s *service) Del(f *Filter, src *Source) error {
+	rule := natRule(f, src, f.GetOutputs())
+	log.Debug("Удаление фильтра", ruleAttrs(rule)...)
+	if err := s.tc.Del(rule); err != nil {
+		log.Error("Ошибка удаления фильтра", append(ruleAttrs(rule), logging.Err(err))...)
+		return err
 	}
+	return nil
 }
 
-func (s *service) addIP(ip string) {
-	var lock sync.Mutex
-	lock.Lock()
-	defer lock.Unlock()
+func ruleAttrs(rule traffic_control.Rule) []any {
+	return []any{"link", rule.Link, "priority", rule.Priority, logging.KeySourceIP, rule.Key(), logging.KeyDstIP, rule.NatTo}
+}
 
-	s.workersQueue[ip] = struct{}{}
+func (s *service) Installed(interfaceName string) ([]traffic_control.Rule, error) {
+	return s.tc.List(interfaceName)
 }
 
-func (s *service) deleteIP(ip string) {
-	var lock sync.Mutex
-	lock.Lock()
-	defer lock.Unlock()
-	log.Println("Удаляем из очереди", ip)
-	delete(s.workersQueue, ip)
+func (s *service) IsExistFilters(data *Filter) []bool {
+	exist := make([]bool, len(data.Sources))
+	for i := range s.installedSources(data) {
+		exist[i] = true
+	}
+	return exist
 }
 
-func (s *service) IsExistFilters(data *Filter) (bool, bool) {
-	_, masterErr := s.statManager.GetBytesByIP(data.MasterIP)
-	_, slaveErr := s.statManager.GetBytesByIP(data.SlaveIP)
-	return masterErr == nil, slaveErr == nil
+// installedSources установленные nat фильтры связки по номеру источника
+func (s *service) installedSources(data *Filter) map[int]traffic_control.Rule {
+	installed := make(map[int]traffic_control.Rule)
+	rules, err := s.tc.List(data.InterfaceName)
+	if err != nil {
+		data.Log(log).Error("Ошибка чтения фильтров", logging.Err(err))
+		return installed
+	}
+	for _, rule := range rules {
+		if rule.NatTo != data.DstIP {
+			continue
+		}
+		for i, src := range data.Sources {
+			if src.Key() == rule.Key() {
+				installed[i] = rule
+			}
+		}
+	}
+	return installed
 }
 
+// TurnOffAutoSwitch останавливает обработчик автопереключения связки
 func (s *service) TurnOffAutoSwitch(f *Filter) {
-	s.turnOff <- f
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if stop, ok := s.workers[f.Id]; ok {
+		close(stop)
+		delete(s.workers, f.Id)
+	}
 }
 
-func (s *service) configureFilters(db map[int]*Filter) {
-	time.Sleep(time.Second * 2)
-	for _, data := range db {
-		// проверяем текущие фильтры
-		isMaster, isSlave := s.IsExistFilters(data)
-		log.Println("Exist filters", isMaster, isSlave)
+// Start установка фильтра и запуск обработчиков связки.
+// Если для связки восстановлен активный источник, установленные nat фильтры приводятся к нему.
+// Если форвардинг в обход nat не запустился, обработчики не запускаются, nat фильтры и состояние не трогаются
+func (s *service) Start(data *Filter) error {
+	installed := s.installedSources(data)
+	data.Log(log).Info("Запуск связки", "installed", len(installed), "hitless", data.IsHitless())
 
-		switch {
-		case isSlave:
-			data.IsMasterActual = false
-		case isMaster:
-			data.IsMasterActual = true
-			// установка мастер фильтров по умолчанию
-		case !isSlave && !isMaster:
-			data.IsMasterActual = true
-			s.Add(data.InterfaceName, data.Cfg.MasterPrio, data.MasterIP, data.DstIP)
-		}
-		go s.AutoSwitch(data)
+	var err error
+	switch {
+	case data.IsHitless():
+		err = s.startHitless(data, installed)
+	case data.IsUDPBackend():
+		err = s.startUDP(data, installed)
+	case data.IsBPFBackend():
+		err = s.startBPF(data, installed)
+	default:
+		s.install(data, installed)
+	}
+	if err != nil {
+		return err
+	}
+	s.WatchHealth(data)
+	go s.AutoSwitch(data)
 
-		//инициализация каналов для прослушки мастер ip
-		s.returnToMasterChannels[data.MasterIP] = make(chan int)
+	//инициализация каналов для прослушки мастер ip
+	s.lock.Lock()
+	receiveChan, stop := make(chan int), make(chan struct{})
+	s.returnToMasterChannels[data.Id] = receiveChan
+	s.returnToMasterStop[data.Id] = stop
+	s.lock.Unlock()
+	go s.returnToMasterListener(data.Id, receiveChan, stop)
+
+	if data.GetReturnToMaster() {
+		if err := s.ReturnToMaster(data, true); err != nil {
+			data.Log(log).Error("Ошибка включения возврата на мастер", logging.Err(err))
+		}
 	}
+	s.state.Save()
+	return nil
 }
 
-func (s *service) addBytes(f *Filter) {
-	t := time.NewTicker(time.Duration(f.Cfg.MsToSwitch) * time.Millisecond)
-	for range t.C {
-		actualIP := f.GetActualIP()
-		bytes, err := s.statManager.GetBytesByIP(actualIP)
-		if err != nil {
+// install nat фильтр активного источника, лишние фильтры связки снимаются
+func (s *service) install(data *Filter, installed map[int]traffic_control.Rule) {
+	active := -1
+	if data.ActiveSource != "" {
+		active = data.GetActiveIndex()
+	}
+	// без сохраненного состояния: если переключались на резерв - остаемся на нем
+	if active < 0 {
+		for i := range data.Sources {
+			if _, ok := installed[i]; ok {
+				active = i
+			}
+		}
+	}
+	// установка мастер фильтров по умолчанию
+	if active < 0 {
+		active = 0
+	}
+	if rule, ok := installed[active]; !ok {
+		s.Add(data, data.Sources[active])
+	} else if outputs := data.GetOutputs(); !sameOutputs(rule, outputs) {
+		// выходы поменялись в конфиге, пока приложение не работало
+		if err := s.replaceNat(data, rule, outputs); err != nil {
+			data.Log(log).Error("Ошибка замены выходов", logging.Err(err))
+		}
+	}
+	for i, rule := range installed {
+		if i == active {
 			continue
 		}
-		f.SetBytes(bytes)
+		data.Log(log).Info("Удаление лишнего фильтра", logging.KeySourceIP, rule.Key())
+		if err := s.tc.Del(rule); err != nil {
+			data.Log(log).Error("Ошибка удаления фильтра", logging.KeySourceIP, rule.Key(), logging.Err(err))
+		}
+	}
+	data.SetActual(active)
+}
+
+func (s *service) SetAutoSwitch(f *Filter, on bool) {
+	f.SetAutoSwitch(on)
+	if on {
+		go s.AutoSwitch(f)
+	}
+	s.state.Save()
+}
+
+func (s *service) WatchHealth(f *Filter) {
+	for _, src := range f.Sources {
+		if f.GetCfg().watchesStream() {
+			s.listener.Watch(src.Key())
+		} else {
+			s.listener.Unwatch(src.Key())
+		}
+	}
+}
+
+// Stop остановка обработчиков связки и удаление ее nat фильтра, записи в классификаторе или объединения потоков
+func (s *service) Stop(f *Filter) {
+	s.TurnOffAutoSwitch(f)
+	for _, src := range f.Sources {
+		s.listener.Unwatch(src.Key())
+	}
+	if f.GetReturnToMaster() {
+		s.ReturnToMaster(f, false)
+	}
+
+	s.lock.Lock()
+	if stop, ok := s.returnToMasterStop[f.Id]; ok {
+		close(stop)
+	}
+	delete(s.returnToMasterStop, f.Id)
+	delete(s.returnToMasterChannels, f.Id)
+	s.lock.Unlock()
+
+	if f.IsHitless() {
+		s.merger.Stop(f.Id)
+		return
+	}
+	if f.IsUDPBackend() {
+		s.forwarder.Stop(f.Id)
+		return
+	}
+	if f.IsBPFBackend() {
+		s.bpf.Stop(f.Id)
+		return
+	}
+	actual := f.GetActual()
+	s.Del(f, actual)
+}
+
+// Shutdown остановка обработчиков всех связок при выходе.
+// Фильтры, классификатор eBPF и сохраненное состояние не трогаются,
+// форвардинг в userspace без процесса не работает и останавливается
+func (s *service) Shutdown() {
+	s.merger.Shutdown()
+	s.forwarder.Shutdown()
+
+	for _, f := range s.db.Values() {
+		if f.GetReturnToMaster() {
+			s.listener.Stop(f.Master().Key())
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, stop := range s.workers {
+		close(stop)
+		delete(s.workers, id)
+	}
+	for id, stop := range s.returnToMasterStop {
+		close(stop)
+		delete(s.returnToMasterStop, id)
+		delete(s.returnToMasterChannels, id)
 	}
 }
 
+// AutoSwitch обработчик автопереключения, на связку запускается только один.
+// Связке с объединением потоков переключаться некуда
 func (s *service) AutoSwitch(f *Filter) {
+	if f.IsHitless() {
+		return
+	}
+	s.lock.Lock()
+	if _, ok := s.workers[f.Id]; ok {
+		s.lock.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	s.workers[f.Id] = stop
+	s.lock.Unlock()
+
 	var tries int
+	var bitrate bitrateCheck
+
+	t := time.NewTicker(time.Duration(f.GetCfg().MsToSwitch) * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
 
-	t := time.NewTicker(time.Duration(f.Cfg.MsToSwitch) * time.Millisecond)
-	for range t.C {
-		actualIP := f.GetActualIP()
-		bytes, err := s.statManager.GetBytesByIP(actualIP)
+		actualKey := f.GetActualKey()
+		statKey := statistic.Key(f.Id, actualKey)
+		bytes, err := s.statManager.GetBytesByIP(statKey)
 
 		if err != nil {
-			log.Println(err)
+			f.Log(log).Debug("Нет статистики активного источника", logging.KeySourceIP, actualKey, logging.Err(err))
 			continue
 		}
 		if f.GetBytes() == nil {
 			f.SetBytes(bytes)
 			continue
 		}
-		// если количество новых байтов не изменилось
-		if f.GetBytes().Cmp(bytes) == 0 && f.Cfg.AutoSwitch {
+		// если количество новых байтов не изменилось, поток идет с ошибками TS или RTP или битрейт вне порогов
+		reason := ReasonAuto
+		failed := f.GetBytes().Cmp(bytes) == 0
+		lowBitrate := s.bitrateFailed(f, f.GetActual(), &bitrate)
+		if !failed {
+			if r := s.streamFailure(f, actualKey, true); r != "" {
+				reason, failed = r, true
+			}
+		}
+		if !failed && lowBitrate {
+			reason, failed = ReasonBitrate, true
+		}
+		if failed && f.GetAutoSwitch() {
 			tries++
-			if tries >= f.Cfg.Tries {
+			if tries >= f.GetCfg().Tries {
 				f.SetBytes(nil)
-				s.ChangeFilter(f)
-				f.IsMasterActual = !f.IsMasterActual
-				s.statManager.DelBytesByIP(actualIP)
-				s.deleteIP(actualIP)
-				go s.AutoSwitch(f)
-				return
+				tries = 0
+				if err := s.ChangeFilter(f, reason); err != nil {
+					continue
+				}
+				s.statManager.DelBytesByIP(statKey)
+				f.SetBytes(nil)
+				continue
 			}
 		} else {
 			tries = 0
@@ -169,61 +388,142 @@ func (s *service) AutoSwitch(f *Filter) {
 	}
 }
 
-func (s *service) ChangeFilter(f *Filter) {
-	var actualIP, newIP string
-	var actualPrio, newPrio int
+// ChangeFilter переключение на следующий живой источник по списку,
+// если живых нет - просто на следующий. Источники с ошибками TS или RTP и битрейтом вне порогов тоже пропускаются
+func (s *service) ChangeFilter(f *Filter, reason Reason) error {
+	active := f.GetActiveIndex()
+	next := -1
+	for step := 1; step < len(f.Sources); step++ {
+		i := (active + step) % len(f.Sources)
+		alive, err := s.statManager.IsSourceAlive(f.StatKey(f.Sources[i]))
+		if (err != nil || alive) && s.streamFailure(f, f.Sources[i].Key(), true) == "" && s.bitrateOK(f, f.Sources[i]) {
+			next = i
+			break
+		}
+		f.Log(log).Info("Источник не активен, пропускаем", "source", f.Sources[i].Name, logging.KeySourceIP, f.Sources[i].Key())
+	}
+	if next < 0 {
+		next = (active + 1) % len(f.Sources)
+	}
+	if next == active {
+		return nil
+	}
+	return s.SwitchTo(f, next, reason, "")
+}
+
+// SwitchTo переключение на i-й источник, client - кто переключил через API
+func (s *service) SwitchTo(f *Filter, i int, reason Reason, client string) error {
+	if f.IsHitless() {
+		return ErrHitless
+	}
+	actual := f.GetActual()
+	newSrc := f.Sources[i]
+	f.Log(log).Info("Переключение",
+		"from", actual.Name, "from_ip", actual.Key(), "to", newSrc.Name, logging.KeySourceIP, newSrc.Key(),
+		logging.KeyReason, reason, "client", client)
+	// счетчики на момент решения, до переустановки фильтра
+	event := s.newEvent(f, actual, newSrc, reason, client)
 
-	if f.IsMasterActual {
-		actualIP = f.MasterIP
-		actualPrio = f.Cfg.MasterPrio
+	var err error
+	switch {
+	case f.IsUDPBackend():
+		err = s.forwarder.Switch(f.Id, i)
+	case f.IsBPFBackend():
+		err = s.bpf.Switch(f.Id, i)
+	default:
+		err = s.switchNat(f, actual, newSrc)
+	}
+	if err != nil {
+		s.addEvent(f, event, err)
+		return err
+	}
+	f.SetActual(i)
+	s.addEvent(f, event, nil)
+	s.state.Save()
+	time.Sleep(250 * time.Millisecond)
+	return nil
+}
 
-		newIP = f.SlaveIP
-		newPrio = f.Cfg.SlavePrio
-	} else {
-		actualIP = f.SlaveIP
-		actualPrio = f.Cfg.SlavePrio
+// switchNat переустановка nat фильтра с источника from на to
+func (s *service) switchNat(f *Filter, from, to *Source) error {
+	// фильтра может не быть, если предыдущее переключение не удалось
+	if err := s.Del(f, from); err != nil && !traffic_control.IsNotFound(err) {
+		return err
+	}
+	if err := s.Add(f, to); err != nil && !traffic_control.IsExist(err) {
+		// возвращаем прежний фильтр, чтобы не остаться без потока
+		s.Add(f, from)
+		return err
+	}
+	return nil
+}
 
-		newIP = f.MasterIP
-		newPrio = f.Cfg.MasterPrio
+// RecordSwitch запись переключения, сделанного в обход SwitchTo, с from на текущий активный источник
+func (s *service) RecordSwitch(f *Filter, from *Source, reason Reason, client string, err error) {
+	s.addEvent(f, s.newEvent(f, from, f.GetActual(), reason, client), err)
+}
+
+func (s *service) newEvent(f *Filter, from, to *Source, reason Reason, client string) journal.Event {
+	event := journal.Event{
+		Time:     time.Now(),
+		FilterId: f.Id,
+		Title:    f.GetTitle(),
+		Route:    f.DstIP,
+		From:     from.Name,
+		FromIP:   from.IP,
+		To:       to.Name,
+		ToIP:     to.IP,
+		Reason:   string(reason),
+		Client:   client,
+	}
+	if stats, err := s.statManager.GetSourceStatsByIP(f.StatKey(from)); err == nil {
+		event.FromBytes = stats.Bytes
 	}
+	if stats, err := s.statManager.GetSourceStatsByIP(f.StatKey(to)); err == nil {
+		event.ToBytes = stats.Bytes
+	}
+	if stats, err := s.statManager.GetStatsByIP(f.StatKey(from)); err == nil {
+		event.FilterBytes = stats.Bytes
+	}
+	return event
+}
 
-	s.Del(f.InterfaceName, actualPrio, actualIP, f.DstIP)
-	s.Add(f.InterfaceName, newPrio, newIP, f.DstIP)
-	time.Sleep(250 * time.Millisecond)
+func (s *service) addEvent(f *Filter, event journal.Event, err error) {
+	if err != nil {
+		event.Error = err.Error()
+		f.Log(log).Error("Ошибка переключения", logging.KeyReason, event.Reason, logging.Err(err))
+		s.journal.Add(event)
+		return
+	}
+	f.CountSwitch(Reason(event.Reason))
+	s.journal.Add(event)
+	s.checkFlap(f, Reason(event.Reason))
 }
 
-func (s *service) ReturnToMaster(info *Filter, toggleOn bool) {
+// ErrStopped связка уже остановлена, например удалена через API одновременно с запросом
+var ErrStopped = errors.New("связка остановлена")
+
+func (s *service) ReturnToMaster(info *Filter, toggleOn bool) error {
 	// если false, то выключить возврат на мастер
 	if toggleOn {
-		log.Printf("Для %s Включаем принудительный возврат на мастер\n", info.MasterIP)
-		info.IsReturnToMaster = true
-		receiveChan, ok := s.returnToMasterChannels[info.MasterIP]
+		info.Log(log).Info("Включаем принудительный возврат на мастер", logging.KeySourceIP, info.Master().Key())
+		s.lock.Lock()
+		receiveChan, ok := s.returnToMasterChannels[info.Id]
+		s.lock.Unlock()
 		if !ok {
-			panic("Нет канала для возврата на мастер для " + info.MasterIP)
+			info.Log(log).Error("Нет канала для возврата на мастер", logging.KeySourceIP, info.Master().Key())
+			return ErrStopped
 		}
-		s.listener.Receive(info.MasterIP, net_listener.Info{
+		info.SetReturnToMaster(true)
+		s.listener.Receive(info.Master().Key(), net_listener.Info{
 			Id:          info.Id,
 			ReceiveChan: receiveChan,
 		})
 	} else {
-		log.Printf("Для %s отключаем принудительный возврат на мастер\n", info.MasterIP)
-		s.listener.Stop(info.MasterIP)
-		info.IsReturnToMaster = false
-	}
-}
-
-func (s *service) returnToMasterListener() {
-	for _, ch := range s.returnToMasterChannels {
-		go func(c chan int) {
-			for filterId := range c {
-				if fil, ok := s.db[filterId]; ok {
-					if !fil.IsMasterActual {
-						log.Printf("Восстановился поток - возвращаем на мастер\n")
-						s.ChangeFilter(fil)
-						fil.IsMasterActual = !fil.IsMasterActual
-					}
-				}
-			}
-		}(ch)
+		info.Log(log).Info("Отключаем принудительный возврат на мастер", logging.KeySourceIP, info.Master().Key())
+		s.listener.Stop(info.Master().Key())
+		info.SetReturnToMaster(false)
 	}
+	s.state.Save()
+	return nil
 }
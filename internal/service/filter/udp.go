@@ -0,0 +1,53 @@
+package filter
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/multicast"
+	"github.com/jashakimov/multiswitcher/internal/service/udp_forward"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// IsUDPBackend форвардинг связки сокетами в userspace вместо nat фильтра
+func (f *Filter) IsUDPBackend() bool {
+	return f.Cfg.Backend == config.BackendUDP
+}
+
+// startUDP запуск форвардинга сокетами с восстановленного активного источника, по умолчанию с мастера.
+// Nat фильтры снимаются только после запуска
+func (s *service) startUDP(f *Filter, installed map[int]traffic_control.Rule) error {
+	active := 0
+	if f.ActiveSource != "" {
+		active = f.GetActiveIndex()
+	}
+	fwd := udp_forward.Forward{
+		Id:      f.Id,
+		Active:  active,
+		Port:    f.Cfg.UDP.Port,
+		Route:   f.DstIP,
+		InLink:  f.CopyFromInterface,
+		OutLink: f.InterfaceName,
+		TTL:     f.Cfg.UDP.TTL,
+		Outputs: multicastOutputs(f.GetOutputs()),
+	}
+	for _, src := range f.Sources {
+		fwd.Sources = append(fwd.Sources, multicast.Group{IP: src.IP, Source: src.SourceIP})
+	}
+	if err := s.forwarder.Start(fwd); err != nil {
+		return errors.Newf("запуск форвардинга: %s", err)
+	}
+	s.dropNat(f, installed)
+	f.SetActual(active)
+	return nil
+}
+
+// dropNat снятие nat фильтров связки, оставшихся от форвардинга tc, при форвардинге в обход nat
+func (s *service) dropNat(f *Filter, installed map[int]traffic_control.Rule) {
+	for _, rule := range installed {
+		f.Log(log).Info("Удаление nat фильтра, форвардинг в обход nat", logging.KeySourceIP, rule.Key())
+		if err := s.tc.Del(rule); err != nil {
+			f.Log(log).Error("Ошибка удаления фильтра", logging.KeySourceIP, rule.Key(), logging.Err(err))
+		}
+	}
+}
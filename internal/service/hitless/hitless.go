@@ -0,0 +1,273 @@
+package hitless
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/multicast"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var log = logging.For(logging.Hitless)
+
+// Merge объединение потоков одной связки: Sources - группы источников по приоритету,
+// принимаются на InLink, объединенный поток уходит в Route через OutLink и в дополнительные выходы Outputs
+type Merge struct {
+	Id      int
+	Sources []multicast.Group
+	Port    int
+	Route   string
+	InLink  string
+	OutLink string
+	Buffer  time.Duration
+	TTL     int
+	Outputs []multicast.Output
+}
+
+// LegStats путь от одного источника, IP - ключ его потока. Used - пакеты, пришедшие с этого пути первыми и ушедшие в поток
+type LegStats struct {
+	IP         string    `json:"ip"`
+	Packets    uint64    `json:"packets"`
+	Bytes      uint64    `json:"bytes"`
+	Used       uint64    `json:"used"`
+	LastPacket time.Time `json:"lastPacket"`
+}
+
+// Stats счетчики объединения с запуска. Lost - номера, не пришедшие ни с одного пути,
+// Duplicates - отброшенные копии, Invalid - пакеты без RTP заголовка
+type Stats struct {
+	Legs       []LegStats `json:"legs"`
+	Packets    uint64     `json:"packets"`
+	Bytes      uint64     `json:"bytes"`
+	Duplicates uint64     `json:"duplicates"`
+	Lost       uint64     `json:"lost"`
+	Invalid    uint64     `json:"invalid"`
+}
+
+type Service interface {
+	statistic.OutputCounter
+	Start(m Merge) error
+	// SetOutputs замена дополнительных выходов, без переподписки на группы
+	SetOutputs(id int, outputs []multicast.Output) error
+	Stop(id int)
+	Stats(id int) (Stats, bool)
+	Shutdown()
+}
+
+type packet struct {
+	leg  int
+	data []byte
+	at   time.Time
+}
+
+type worker struct {
+	lock    sync.Mutex
+	stats   Stats
+	legs    []net.PacketConn
+	out     *multicast.Sender
+	fanout  *multicast.Fanout
+	packets chan packet
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+type service struct {
+	lock    sync.Mutex
+	workers map[int]*worker
+}
+
+func NewService() Service {
+	return &service{workers: make(map[int]*worker)}
+}
+
+// Start подписка на группы источников и запуск объединения, повторный Start перезапускает связку
+func (s *service) Start(m Merge) error {
+	s.Stop(m.Id)
+
+	out, err := multicast.NewSender(m.OutLink, m.Route, m.TTL)
+	if err != nil {
+		return errors.Newf("отправка в %s: %s", m.Route, err)
+	}
+	w := &worker{
+		out:     out,
+		fanout:  multicast.NewFanout(m.Port, m.TTL),
+		packets: make(chan packet, 1024),
+		stop:    make(chan struct{}),
+	}
+	if err := w.fanout.Set(m.Outputs); err != nil {
+		w.close()
+		return err
+	}
+	keys := make([]string, 0, len(m.Sources))
+	for _, g := range m.Sources {
+		key := traffic_control.Key(g.IP, g.Source, 0, 0)
+		conn, err := multicast.ListenGroup(m.InLink, g, m.Port)
+		if err != nil {
+			w.close()
+			return errors.Newf("подписка на %s: %s", key, err)
+		}
+		keys = append(keys, key)
+		w.legs = append(w.legs, conn)
+		w.stats.Legs = append(w.stats.Legs, LegStats{IP: key})
+	}
+
+	dst := &net.UDPAddr{IP: net.ParseIP(m.Route), Port: m.Port}
+	w.done.Add(len(w.legs) + 1)
+	for i, conn := range w.legs {
+		go w.receive(i, conn)
+	}
+	go w.merge(newMerger(m.Buffer, &w.stats), dst)
+
+	s.lock.Lock()
+	s.workers[m.Id] = w
+	s.lock.Unlock()
+	log.Info("Запуск объединения потоков", logging.KeyFilterID, m.Id, logging.KeyDstIP, m.Route,
+		"sources", keys, "port", m.Port, "buffer", m.Buffer)
+	return nil
+}
+
+func (s *service) SetOutputs(id int, outputs []multicast.Output) error {
+	s.lock.Lock()
+	w, ok := s.workers[id]
+	s.lock.Unlock()
+	if !ok {
+		return errors.Newf("объединение потоков связки %d не запущено", id)
+	}
+	return w.fanout.Set(outputs)
+}
+
+func (s *service) Stop(id int) {
+	s.lock.Lock()
+	w, ok := s.workers[id]
+	delete(s.workers, id)
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	close(w.stop)
+	w.close()
+	w.done.Wait()
+	log.Info("Остановка объединения потоков", logging.KeyFilterID, id)
+}
+
+func (s *service) Stats(id int) (Stats, bool) {
+	s.lock.Lock()
+	w, ok := s.workers[id]
+	s.lock.Unlock()
+	if !ok {
+		return Stats{}, false
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats := w.stats
+	stats.Legs = append([]LegStats(nil), w.stats.Legs...)
+	return stats, true
+}
+
+// Outputs отправленное в дополнительные выходы всех связок
+func (s *service) Outputs() map[string]statistic.Counter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	counters := make(map[string]statistic.Counter)
+	for _, w := range s.workers {
+		for route, sent := range w.fanout.Sent() {
+			counters[route] = statistic.Counter{Bytes: sent.Bytes, Packets: sent.Packets}
+		}
+	}
+	return counters
+}
+
+func (s *service) Shutdown() {
+	s.lock.Lock()
+	ids := make([]int, 0, len(s.workers))
+	for id := range s.workers {
+		ids = append(ids, id)
+	}
+	s.lock.Unlock()
+	for _, id := range ids {
+		s.Stop(id)
+	}
+}
+
+// close закрытие сокетов, чтение путей завершается ошибкой
+func (w *worker) close() {
+	for _, conn := range w.legs {
+		conn.Close()
+	}
+	w.out.Close()
+	w.fanout.Close()
+}
+
+// receive чтение одного пути до закрытия сокета
+func (w *worker) receive(leg int, conn net.PacketConn) {
+	defer w.done.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case w.packets <- packet{leg: leg, data: data, at: time.Now()}:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// merge отправка объединенного потока, таймер будит по истечении ожидания пропущенного пакета
+func (w *worker) merge(m *merger, dst *net.UDPAddr) {
+	defer w.done.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		var out [][]byte
+		select {
+		case <-w.stop:
+			return
+		case p := <-w.packets:
+			w.lock.Lock()
+			out = m.push(p.leg, p.data, p.at)
+			w.lock.Unlock()
+		case now := <-timer.C:
+			w.lock.Lock()
+			out = m.expire(now)
+			w.lock.Unlock()
+		}
+
+		for _, data := range out {
+			w.fanout.Send(data)
+			if err := w.out.Send(data, dst); err != nil {
+				log.Debug("Ошибка отправки", logging.KeyDstIP, dst.IP.String(), logging.Err(err))
+				continue
+			}
+			w.lock.Lock()
+			w.stats.Packets++
+			w.stats.Bytes += uint64(len(data))
+			w.lock.Unlock()
+		}
+
+		w.lock.Lock()
+		at, ok := m.deadline()
+		w.lock.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if ok {
+			timer.Reset(time.Until(at))
+		} else {
+			timer.Reset(time.Hour)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package hitless
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// maxDropout скачок номера, после которого поток считается перезапущенным и счет начинается заново
+	maxDropout = 3000
+	// maxPending размер кольца ожидающих пакетов. Номера в буфере не дальше maxDropout от ожидаемого,
+	// поэтому у каждого свое место seq % maxPending, 65536 делится на размер без остатка
+	maxPending = 4096
+)
+
+// pendingPacket пакет в буфере, data == nil - место в кольце свободно
+type pendingPacket struct {
+	data []byte
+	at   time.Time
+}
+
+// merger склеивает пакеты всех путей в один поток по номерам RTP. Пакет с ожидаемым номером уходит сразу,
+// поэтому при целых путях задержки нет. При пропуске номера пакеты после него ждут в буфере, пока
+// пропущенный не придет с другого пути, но не дольше buffer - дальше пропуск считается потерянным
+type merger struct {
+	buffer  time.Duration
+	started bool
+	next    uint16
+	pending [maxPending]pendingPacket
+	count   int
+	stats   *Stats
+}
+
+func newMerger(buffer time.Duration, stats *Stats) *merger {
+	return &merger{
+		buffer: buffer,
+		stats:  stats,
+	}
+}
+
+// push пакет пути leg, возвращает пакеты, готовые к отправке, по порядку
+func (m *merger) push(leg int, data []byte, now time.Time) [][]byte {
+	l := &m.stats.Legs[leg]
+	l.Packets++
+	l.Bytes += uint64(len(data))
+	l.LastPacket = now
+	if !isRTP(data) {
+		m.stats.Invalid++
+		return nil
+	}
+	seq := binary.BigEndian.Uint16(data[2:4])
+
+	var out [][]byte
+	if !m.started {
+		m.started = true
+		m.next = seq
+	}
+	delta := int16(seq - m.next)
+	if delta > maxDropout || delta < -maxDropout {
+		// номера скачком ушли далеко - источник перезапустился, буфер отдается как есть
+		out = m.flush()
+		m.next = seq
+		delta = 0
+	}
+	if delta < 0 {
+		m.stats.Duplicates++
+		return out
+	}
+	p := m.slot(seq)
+	if p.data != nil {
+		m.stats.Duplicates++
+		return out
+	}
+	l.Used++
+	*p = pendingPacket{data: data, at: now}
+	m.count++
+	return append(out, m.drain()...)
+}
+
+// expire выдает пакеты, ожидание пропуска перед которыми истекло
+func (m *merger) expire(now time.Time) [][]byte {
+	var out [][]byte
+	for {
+		at, ok := m.deadline()
+		if !ok || at.After(now) {
+			return out
+		}
+		out = append(out, m.skip()...)
+	}
+}
+
+// deadline когда истечет ожидание пропуска перед первым пакетом буфера, false - ничего не ждем
+func (m *merger) deadline() (time.Time, bool) {
+	first, ok := m.first()
+	if !ok {
+		return time.Time{}, false
+	}
+	return m.slot(first).at.Add(m.buffer), true
+}
+
+// drain выдает пакеты подряд с ожидаемого номера
+func (m *merger) drain() [][]byte {
+	var out [][]byte
+	for p := m.slot(m.next); p.data != nil; p = m.slot(m.next) {
+		out = append(out, p.data)
+		*p = pendingPacket{}
+		m.count--
+		m.next++
+	}
+	return out
+}
+
+// skip пропуск перед первым пакетом буфера считается потерянным
+func (m *merger) skip() [][]byte {
+	first, ok := m.first()
+	if !ok {
+		return nil
+	}
+	m.stats.Lost += uint64(first - m.next)
+	m.next = first
+	return m.drain()
+}
+
+// first номер первого пакета буфера после пропуска, поиск идет от ожидаемого номера по кольцу
+func (m *merger) first() (uint16, bool) {
+	if m.count == 0 {
+		return 0, false
+	}
+	seq := m.next
+	for m.slot(seq).data == nil {
+		seq++
+	}
+	return seq, true
+}
+
+// flush выдает весь буфер по порядку, пропуски считаются потерянными
+func (m *merger) flush() [][]byte {
+	var out [][]byte
+	for m.count > 0 {
+		out = append(out, m.skip()...)
+	}
+	return out
+}
+
+func (m *merger) slot(seq uint16) *pendingPacket {
+	return &m.pending[seq%maxPending]
+}
+
+// isRTP версия 2 и заголовок целиком
+func isRTP(b []byte) bool {
+	return len(b) >= 12 && b[0]>>6 == 2
+}
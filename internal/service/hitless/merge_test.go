@@ -0,0 +1,162 @@
+package hitless
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testBuffer = 100 * time.Millisecond
+
+// step пакет seq с пути leg в момент atMs, expire - вместо пакета проверка ожидания
+type step struct {
+	leg    int
+	seq    uint16
+	atMs   int
+	expire bool
+	raw    []byte
+}
+
+func rtp(seq uint16) []byte {
+	b := []byte{0x80, 33, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(b[2:4], seq)
+	return b
+}
+
+func seqs(packets [][]byte) []uint16 {
+	result := make([]uint16, 0, len(packets))
+	for _, p := range packets {
+		result = append(result, binary.BigEndian.Uint16(p[2:4]))
+	}
+	return result
+}
+
+// overflow один пропуск и maxPending+1 пакетов за ним
+func overflow() []step {
+	steps := []step{{seq: 1}}
+	for seq := 3; seq <= maxPending+3; seq++ {
+		steps = append(steps, step{seq: uint16(seq)})
+	}
+	return steps
+}
+
+func sequence(from, to int) []uint16 {
+	var result []uint16
+	for seq := from; seq <= to; seq++ {
+		result = append(result, uint16(seq))
+	}
+	return result
+}
+
+func TestMerger(t *testing.T) {
+	tests := []struct {
+		name       string
+		steps      []step
+		out        []uint16
+		lost       uint64
+		duplicates uint64
+		invalid    uint64
+		used       []uint64
+	}{
+		{
+			name:       "одинаковые пути",
+			steps:      []step{{leg: 0, seq: 1}, {leg: 1, seq: 1}, {leg: 0, seq: 2}, {leg: 1, seq: 2}},
+			out:        []uint16{1, 2},
+			duplicates: 2,
+			used:       []uint64{2, 0},
+		},
+		{
+			name:       "пропуск закрыт другим путем",
+			steps:      []step{{leg: 0, seq: 1}, {leg: 0, seq: 3}, {leg: 1, seq: 2}, {leg: 1, seq: 3}},
+			out:        []uint16{1, 2, 3},
+			duplicates: 1,
+			used:       []uint64{2, 1},
+		},
+		{
+			name:  "ожидание пропуска не истекло",
+			steps: []step{{seq: 1}, {seq: 3, atMs: 10}, {expire: true, atMs: 100}},
+			out:   []uint16{1},
+			used:  []uint64{2, 0},
+		},
+		{
+			name:  "пропуск потерян",
+			steps: []step{{seq: 1}, {seq: 3, atMs: 10}, {seq: 4, atMs: 20}, {expire: true, atMs: 111}},
+			out:   []uint16{1, 3, 4},
+			lost:  1,
+			used:  []uint64{3, 0},
+		},
+		{
+			name:       "опоздавший после пропуска",
+			steps:      []step{{seq: 1}, {seq: 3}, {expire: true, atMs: 150}, {leg: 1, seq: 2, atMs: 160}},
+			out:        []uint16{1, 3},
+			lost:       1,
+			duplicates: 1,
+			used:       []uint64{2, 0},
+		},
+		{
+			name:  "переход через 65535",
+			steps: []step{{seq: 65534}, {leg: 1, seq: 0}, {seq: 65535}, {seq: 1}},
+			out:   []uint16{65534, 65535, 0, 1},
+			used:  []uint64{3, 1},
+		},
+		{
+			name:  "скачок вперед",
+			steps: []step{{seq: 1}, {seq: 3}, {seq: 10000}, {seq: 10001}},
+			out:   []uint16{1, 3, 10000, 10001},
+			lost:  1,
+			used:  []uint64{4, 0},
+		},
+		{
+			name:  "скачок назад",
+			steps: []step{{seq: 10000}, {seq: 1}, {seq: 2}},
+			out:   []uint16{10000, 1, 2},
+			used:  []uint64{3, 0},
+		},
+		{
+			name:    "не RTP",
+			steps:   []step{{seq: 1}, {raw: []byte{0x47, 0, 0}}, {leg: 1, raw: rtp(2)[:11]}, {seq: 2}},
+			out:     []uint16{1, 2},
+			invalid: 2,
+			used:    []uint64{2, 0},
+		},
+		{
+			name:  "переполнение буфера",
+			steps: overflow(),
+			out:   append([]uint16{1}, sequence(3, maxPending+3)...),
+			lost:  1,
+			used:  []uint64{maxPending + 2, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			stats := &Stats{Legs: make([]LegStats, 2)}
+			m := newMerger(testBuffer, stats)
+			var out [][]byte
+			for _, s := range tt.steps {
+				now := start.Add(time.Duration(s.atMs) * time.Millisecond)
+				switch {
+				case s.expire:
+					out = append(out, m.expire(now)...)
+				case s.raw != nil:
+					out = append(out, m.push(s.leg, s.raw, now)...)
+				default:
+					out = append(out, m.push(s.leg, rtp(s.seq), now)...)
+				}
+			}
+			if got := seqs(out); !reflect.DeepEqual(got, tt.out) {
+				t.Fatalf("поток %v, ожидался %v", got, tt.out)
+			}
+			if stats.Lost != tt.lost || stats.Duplicates != tt.duplicates || stats.Invalid != tt.invalid {
+				t.Fatalf("lost %d duplicates %d invalid %d, ожидалось %d %d %d",
+					stats.Lost, stats.Duplicates, stats.Invalid, tt.lost, tt.duplicates, tt.invalid)
+			}
+			for i, used := range tt.used {
+				if stats.Legs[i].Used != used {
+					t.Fatalf("путь %d used %d, ожидалось %d", i, stats.Legs[i].Used, used)
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package igmp
 
 import (
+	"github.com/jashakimov/multiswitcher/internal/ledger"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/vishvananda/netlink"
 	"golang.org/x/net/ipv4"
-	"log"
+	"golang.org/x/sys/unix"
+	"gopkg.in/errgo.v2/fmt/errors"
 	"net"
-	"os/exec"
 )
 
+var log = logging.For(logging.Igmp)
+
 type Connection interface {
 	Send(msg []byte, ip net.IP)
 	Leave(iface string, ip string)
@@ -15,23 +20,14 @@ type Connection interface {
 }
 
 type connection struct {
-	conn net.PacketConn
-	pack *ipv4.PacketConn
+	conn   net.PacketConn
+	pack   *ipv4.PacketConn
+	ledger ledger.Ledger
 }
 
-func NewConnection(ip string) (Connection, error) {
-	c := &connection{}
-	var err error
-
-	//c.conn, err = net.ListenPacket("ip4:igmp", ip)
-	//if err != nil {
-	//	fmt.Println("Failed to open raw socket:", err)
-	//	return nil, err
-	//}
-	//
-	//c.pack = ipv4.NewPacketConn(c.conn)
-
-	return c, err
+func NewConnection(ip string, l ledger.Ledger) (Connection, error) {
+	c := &connection{ledger: l}
+	return c, nil
 }
 
 func (c *connection) Send(msg []byte, ip net.IP) {
@@ -44,44 +40,47 @@ func (c *connection) Close() {
 }
 
 func (c *connection) Leave(iface string, ip string) {
-	//i, err := net.InterfaceByName(iface)
-	//if err != nil {
-	//	fmt.Printf("Ошибка при отписке от группы: %v\n", err)
-	//	return
-	//}
-	//
-	//if err := c.pack.LeaveGroup(i, &net.UDPAddr{IP: ip}); err != nil {
-	//	fmt.Printf("Ошибка при отписке от группы: %v\n", err)
-	//	return
-	//}
-
-	// sudo ip addr del 226.0.0.59 dev eth1
-	cmd := exec.Command(
-		"ip", "addr", "del", ip, "dev", iface,
-	)
-	log.Println("Отписка от потока", cmd.String())
-	if _, err := cmd.Output(); err != nil {
-		log.Println("Ошибка отписки")
+	log.Info("Отписка от потока", logging.KeyDstIP, ip, "link", iface, "protocol", protocol(ip))
+	if err := autojoin(iface, ip, netlink.AddrDel); err != nil && err != unix.EADDRNOTAVAIL {
+		log.Error("Ошибка отписки", logging.KeyDstIP, ip, "link", iface, logging.Err(err))
+		return
 	}
+	c.ledger.Forget(ledger.Entry{Kind: ledger.Membership, Link: iface, IP: ip})
 }
 
 func (c *connection) Join(iface string, ip string) {
-	//sudo ip addr add 226.0.0.59 dev eth1 autojoin
-	cmd := exec.Command(
-		"ip", "addr", "add", ip, "dev", iface, "autojoin",
-	)
-	log.Println("Подписка на поток", cmd.String())
-	if _, err := cmd.Output(); err != nil {
-		log.Println("Ошибка подписки")
+	log.Info("Подписка на поток", logging.KeyDstIP, ip, "link", iface, "protocol", protocol(ip))
+	if err := autojoin(iface, ip, netlink.AddrAdd); err != nil && err != unix.EEXIST {
+		log.Error("Ошибка подписки", logging.KeyDstIP, ip, "link", iface, logging.Err(err))
+		return
+	}
+	c.ledger.Record(ledger.Entry{Kind: ledger.Membership, Link: iface, IP: ip})
+}
+
+// autojoin адрес группы ip с флагом IFA_F_MCAUTOJOIN на iface, как ip addr add ip dev iface autojoin:
+// подписку держит ядро, она переживает остановку процесса до удаления адреса
+func autojoin(iface, ip string, op func(netlink.Link, *netlink.Addr) error) error {
+	lnk, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+	group := net.ParseIP(ip)
+	if group == nil {
+		return errors.Newf("неверный адрес группы %s", ip)
+	}
+	mask := net.CIDRMask(32, 32)
+	if v4 := group.To4(); v4 != nil {
+		group = v4
+	} else {
+		mask = net.CIDRMask(128, 128)
+	}
+	return op(lnk, &netlink.Addr{IPNet: &net.IPNet{IP: group, Mask: mask}, Flags: unix.IFA_F_MCAUTOJOIN})
+}
+
+// protocol чем ядро сообщает о подписке на группу ip
+func protocol(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return "mld"
 	}
-	//i, err := net.InterfaceByName(iface)
-	//if err != nil {
-	//	fmt.Printf("Ошибка при подписке на группу: %v\n", err)
-	//	return
-	//}
-	//
-	//if err := c.pack.JoinGroup(i, &net.UDPAddr{IP: ip}); err != nil {
-	//	fmt.Printf("Ошибка при подписке на группу: %v\n", err)
-	//	return
-	//}
+	return "igmp"
 }
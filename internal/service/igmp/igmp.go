@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"github.com/jashakimov/multiswitcher/internal/ledger"
 	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/utils"
 	"gopkg.in/errgo.v2/fmt/errors"
 	"net"
 )
 
+// JoinReport и LeaveGroup операции API по типам сообщений IGMPv2. Подписку делает ядро:
+// на IPv4 группы - IGMP, на IPv6 - MLD Report и Done версии mldVersion.
+// Источники с sourceIP подписываются только на поток этого адреса: IGMPv3 и MLDv2
 const JoinReport = 0x16
 const LeaveGroup = 0x17
 
@@ -18,15 +23,21 @@ type Service interface {
 }
 
 type service struct {
-	db                        map[int]*filter.Filter
+	db                        *utils.SyncMap[int, *filter.Filter]
+	state                     filter.StateStore
+	ledger                    ledger.Ledger
 	workingPool               map[int]Connection
+	sources                   *sourceJoins
 	stopSendingJoinPeportChan chan int
 }
 
-func NewService(db map[int]*filter.Filter) Service {
+func NewService(db *utils.SyncMap[int, *filter.Filter], state filter.StateStore, l ledger.Ledger) Service {
 	return &service{
 		db:                        db,
+		state:                     state,
+		ledger:                    l,
 		workingPool:               make(map[int]Connection),
+		sources:                   newSourceJoins(),
 		stopSendingJoinPeportChan: make(chan int),
 	}
 }
@@ -34,13 +45,13 @@ func NewService(db map[int]*filter.Filter) Service {
 func (s *service) ToggleAll(ctx context.Context, msg byte) {
 	// репорт на лив из группы
 	if msg == LeaveGroup {
-		for _, fil := range s.db {
+		for _, fil := range s.db.Values() {
 			if fil.IsIgmpOn {
 				go s.runLeaveWorker(fil)
 			}
 		}
 	} else {
-		for _, fil := range s.db {
+		for _, fil := range s.db.Values() {
 			if !fil.IsIgmpOn {
 				go s.runJoinWorker(fil)
 			}
@@ -50,7 +61,7 @@ func (s *service) ToggleAll(ctx context.Context, msg byte) {
 
 func (s *service) runJoinWorker(f *filter.Filter) {
 	// новый пул соединения
-	conn, err := NewConnection(f.DstIP)
+	conn, err := NewConnection(f.DstIP, s.ledger)
 	if err != nil {
 		return
 	}
@@ -64,11 +75,17 @@ func (s *service) runJoinWorker(f *filter.Filter) {
 	//masterPacketJoin := s.newIgmpMsg(JoinReport, masterIP)
 	//slavePacketJoin := s.newIgmpMsg(JoinReport, slaveIP)
 	// присоединяемся к группе
-	conn.Join(f.CopyFromInterface, f.MasterIP)
-	conn.Join(f.CopyFromInterface, f.SlaveIP)
+	for _, src := range f.Sources {
+		if src.SourceIP != "" {
+			s.sources.join(f.CopyFromInterface, src)
+			continue
+		}
+		conn.Join(f.CopyFromInterface, src.IP)
+	}
 
 	// меняем статус, что отправка igmp включена
 	f.IsIgmpOn = true
+	s.state.Save()
 
 	//for {
 	//	select {
@@ -84,7 +101,7 @@ func (s *service) runJoinWorker(f *filter.Filter) {
 }
 
 func (s *service) ToggleByID(ctx context.Context, id int, msg byte) error {
-	f, ok := s.db[id]
+	f, ok := s.db.Get(id)
 	if !ok {
 		return errors.New("Такого id не существует")
 	}
@@ -134,7 +151,7 @@ func (s *service) runLeaveWorker(f *filter.Filter) {
 	//if !ok {
 	//	return
 	//}
-	conn, err := NewConnection(f.DstIP)
+	conn, err := NewConnection(f.DstIP, s.ledger)
 	if err != nil {
 		return
 	}
@@ -145,14 +162,20 @@ func (s *service) runLeaveWorker(f *filter.Filter) {
 
 	// меняем статус, что отправка igmp выключен
 	f.IsIgmpOn = false
+	s.state.Save()
 
 	//masterIP := net.ParseIP(f.MasterIP)
 	//slaveIP := net.ParseIP(f.SlaveIP)
 
 	//go conn.Send(s.newIgmpMsg(LeaveGroup, masterIP), masterIP)
 	//go conn.Send(s.newIgmpMsg(LeaveGroup, slaveIP), slaveIP)
-	conn.Leave(f.CopyFromInterface, f.MasterIP)
-	conn.Leave(f.CopyFromInterface, f.SlaveIP)
+	for _, src := range f.Sources {
+		if src.SourceIP != "" {
+			s.sources.leave(f.CopyFromInterface, src)
+			continue
+		}
+		conn.Leave(f.CopyFromInterface, src.IP)
+	}
 
 	//conn.Close()
 	// удаляем соединение из пула
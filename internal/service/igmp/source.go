@@ -0,0 +1,54 @@
+package igmp
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/multicast"
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"net"
+	"sync"
+)
+
+// sourceJoins подписки (S,G) источников с sourceIP: адрес с флагом autojoin умеет только подписку на всю группу,
+// поэтому подписку держит сокет процесса. С остановкой процесса ядро само отправляет отписку,
+// в журнал такие подписки не пишутся
+type sourceJoins struct {
+	lock  sync.Mutex
+	conns map[string]net.PacketConn
+}
+
+func newSourceJoins() *sourceJoins {
+	return &sourceJoins{conns: make(map[string]net.PacketConn)}
+}
+
+func (j *sourceJoins) join(link string, src *filter.Source) {
+	key := link + " " + traffic_control.Key(src.IP, src.SourceIP, 0, 0)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, ok := j.conns[key]; ok {
+		return
+	}
+
+	log.Info("Подписка на поток источника", logging.KeyDstIP, src.IP, logging.KeySourceIP, src.SourceIP,
+		"link", link, "protocol", protocol(src.IP))
+	conn, err := multicast.ListenGroup(link, multicast.Group{IP: src.IP, Source: src.SourceIP}, 0)
+	if err != nil {
+		log.Error("Ошибка подписки", logging.KeyDstIP, src.IP, logging.KeySourceIP, src.SourceIP, "link", link, logging.Err(err))
+		return
+	}
+	j.conns[key] = conn
+}
+
+func (j *sourceJoins) leave(link string, src *filter.Source) {
+	key := link + " " + traffic_control.Key(src.IP, src.SourceIP, 0, 0)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	conn, ok := j.conns[key]
+	if !ok {
+		return
+	}
+	log.Info("Отписка от потока источника", logging.KeyDstIP, src.IP, logging.KeySourceIP, src.SourceIP,
+		"link", link, "protocol", protocol(src.IP))
+	conn.Close()
+	delete(j.conns, key)
+}
@@ -0,0 +1,641 @@
+package manager
+
+import (
+	"context"
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/interface_link"
+	"github.com/jashakimov/multiswitcher/internal/ledger"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/priority"
+	"github.com/jashakimov/multiswitcher/internal/service/bpf_forward"
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/igmp"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"github.com/vishvananda/netlink"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"reflect"
+	"sync"
+)
+
+var log = logging.For(logging.Manager)
+
+var (
+	ErrNotFound = errors.New("связка не найдена")
+	ErrInvalid  = errors.New("некорректная связка")
+)
+
+// Manager применяет изменения набора связок во время работы
+type Manager interface {
+	Reload(cfg *config.Config) error
+	Create(fc config.Filter) (*filter.Filter, error)
+	Update(id int, fc config.Filter) (*filter.Filter, error)
+	Delete(id int) error
+	// AddOutput и DelOutput изменение выходов связки без переустановки ее фильтров
+	AddOutput(id int, o config.Output) (*filter.Filter, error)
+	DelOutput(id int, route string) (*filter.Filter, error)
+	Shutdown()
+}
+
+type manager struct {
+	lock          sync.Mutex
+	fileName      string
+	cfg           *config.Config
+	db            *utils.SyncMap[int, *filter.Filter]
+	alloc         priority.Allocator
+	tc            traffic_control.TrafficControl
+	filterService filter.Service
+	igmpService   igmp.Service
+	state         filter.StateStore
+	ledger        ledger.Ledger
+	link          netlink.Link
+	copyFrom      netlink.Link
+	// file глобальные параметры из файла: после перечитывания они могут отличаться от работающих в cfg
+	// до перезапуска, в файл пишутся они, а не работающие
+	file config.Config
+}
+
+func NewManager(
+	fileName string,
+	cfg *config.Config,
+	db *utils.SyncMap[int, *filter.Filter],
+	alloc priority.Allocator,
+	tc traffic_control.TrafficControl,
+	filterService filter.Service,
+	igmpService igmp.Service,
+	state filter.StateStore,
+	l ledger.Ledger,
+	link, copyFrom netlink.Link,
+) Manager {
+	return &manager{
+		fileName:      fileName,
+		cfg:           cfg,
+		file:          *cfg,
+		db:            db,
+		alloc:         alloc,
+		tc:            tc,
+		filterService: filterService,
+		igmpService:   igmpService,
+		state:         state,
+		ledger:        l,
+		link:          link,
+		copyFrom:      copyFrom,
+	}
+}
+
+// Reload сравнивает связки старого и нового конфига и применяет только разницу.
+// Связки сопоставляются по id, а если id в файле нет - по route.
+// Удаленные связки снимаются, новые устанавливаются, у связок со сменой route или источников
+// переустанавливаются фильтры, у остальных обновляются только switchTries, autoSwitch, title и выходы
+func (m *manager) Reload(cfg *config.Config) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := cfg.Validate(); err != nil {
+		return errors.Because(err, ErrInvalid, "")
+	}
+
+	if needsRestart(m.cfg, cfg) {
+		log.Warn("Изменение interface, copyTrafficFrom, port, statsFrequencyMs, hostname, historySamples и webhooks применится после перезапуска")
+	}
+
+	oldByID := make(map[int]config.Filter)
+	for _, f := range m.cfg.Filters {
+		oldByID[f.Id] = f
+	}
+	d := diff(m.cfg.Filters, cfg.Filters)
+
+	for _, old := range d.removed {
+		if f, ok := m.db.Get(old.Id); ok {
+			f.Log(log).Info("Связка удалена из конфига")
+			m.remove(f)
+		}
+	}
+
+	newFilters := d.filters
+	for i, fc := range newFilters {
+		if d.isNew[i] {
+			log.Info("Новая связка в конфиге", logging.KeyTitle, fc.Title, logging.KeyDstIP, fc.Route)
+			if _, ok := oldByID[fc.Id]; ok || fc.Id == 0 {
+				newFilters[i].Id = m.nextID(newFilters...)
+			}
+			if err := m.add(newFilters[i]); err != nil {
+				log.Error("Ошибка установки связки", logging.KeyFilterID, newFilters[i].Id,
+					logging.KeyTitle, fc.Title, logging.KeyDstIP, fc.Route, logging.Err(err))
+			}
+			continue
+		}
+		if err := m.apply(oldByID[fc.Id], fc); err != nil {
+			log.Error("Ошибка установки связки", logging.KeyFilterID, fc.Id,
+				logging.KeyTitle, fc.Title, logging.KeyDstIP, fc.Route, logging.Err(err))
+		}
+	}
+
+	// глобальные параметры остаются прежними до перезапуска, кроме режима остановки и логов
+	applied := *m.cfg
+	applied.Filters = newFilters
+	if applied.ShutdownMode != cfg.ShutdownMode {
+		log.Info("Изменен режим остановки", "from", applied.ShutdownMode, "to", cfg.ShutdownMode)
+		applied.ShutdownMode = cfg.ShutdownMode
+	}
+	// уровни, измененные через API, сбрасываются только если секция log в конфиге поменялась
+	if !reflect.DeepEqual(applied.Log, cfg.Log) {
+		if err := logging.Configure(cfg.Log.Format, cfg.Log.Level, cfg.Log.Subsystems); err != nil {
+			log.Error("Ошибка настройки логов", logging.Err(err))
+		} else {
+			log.Info("Применены настройки логов", "format", cfg.Log.Format, "level", cfg.Log.Level)
+			applied.Log = cfg.Log
+		}
+	}
+	m.cfg = &applied
+	m.file = *cfg
+
+	return nil
+}
+
+func (m *manager) Create(fc config.Filter) (*filter.Filter, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.validate(fc); err != nil {
+		return nil, err
+	}
+	if fc.Id == 0 {
+		fc.Id = m.nextID()
+	} else if _, ok := m.index(fc.Id); ok {
+		return nil, errors.Because(nil, ErrInvalid, "связка с таким id уже есть")
+	}
+
+	if err := m.add(fc); err != nil {
+		return nil, err
+	}
+	m.cfg.Filters = append(m.cfg.Filters, fc)
+
+	f, _ := m.db.Get(fc.Id)
+	return f, m.save()
+}
+
+func (m *manager) Update(id int, fc config.Filter) (*filter.Filter, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	i, ok := m.index(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	fc.Id = id
+	if err := m.validate(fc); err != nil {
+		return nil, err
+	}
+
+	if err := m.apply(m.cfg.Filters[i], fc); err != nil {
+		return nil, err
+	}
+	m.cfg.Filters[i] = fc
+
+	f, _ := m.db.Get(id)
+	return f, m.save()
+}
+
+func (m *manager) Delete(id int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	i, ok := m.index(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if f, ok := m.db.Get(id); ok {
+		m.remove(f)
+	}
+	m.cfg.Filters = append(m.cfg.Filters[:i:i], m.cfg.Filters[i+1:]...)
+
+	return m.save()
+}
+
+func (m *manager) AddOutput(id int, o config.Output) (*filter.Filter, error) {
+	return m.changeOutputs(id, func(fc *config.Filter) error {
+		fc.Outputs = append(fc.Outputs[:len(fc.Outputs):len(fc.Outputs)], o)
+		return nil
+	})
+}
+
+func (m *manager) DelOutput(id int, route string) (*filter.Filter, error) {
+	return m.changeOutputs(id, func(fc *config.Filter) error {
+		for i, o := range fc.Outputs {
+			if o.Route == route {
+				fc.Outputs = append(fc.Outputs[:i:i], fc.Outputs[i+1:]...)
+				return nil
+			}
+		}
+		return errors.Because(nil, ErrNotFound, "у связки нет выхода "+route)
+	})
+}
+
+// changeOutputs применяет к связке id изменение выходов change так же, как Update
+func (m *manager) changeOutputs(id int, change func(fc *config.Filter) error) (*filter.Filter, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	i, ok := m.index(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	fc := m.cfg.Filters[i]
+	if err := change(&fc); err != nil {
+		return nil, err
+	}
+	if err := m.validate(fc); err != nil {
+		return nil, err
+	}
+
+	if err := m.apply(m.cfg.Filters[i], fc); err != nil {
+		return nil, err
+	}
+	m.cfg.Filters[i] = fc
+
+	f, _ := m.db.Get(id)
+	return f, m.save()
+}
+
+// apply приводит работающую связку old к fc, fc.Id == old.Id
+func (m *manager) apply(old, fc config.Filter) error {
+	f, ok := m.db.Get(old.Id)
+	if !ok {
+		return m.add(fc)
+	}
+	if needsReinstall(old, fc) {
+		f.Log(log).Info("Изменились route, источники или форвардинг, переустанавливаем")
+		actual := f.GetActual()
+		m.remove(f)
+		if err := m.add(fc); err != nil {
+			// возвращаем прежнюю связку, чтобы канал не остался без фильтров
+			if err := m.add(old); err != nil {
+				f.Log(log).Error("Ошибка восстановления связки", logging.Err(err))
+			}
+			return err
+		}
+		if installed, ok := m.db.Get(fc.Id); ok && installed.GetActual().Key() != actual.Key() {
+			m.filterService.RecordSwitch(installed, actual, filter.ReasonReload, "", nil)
+		}
+		return nil
+	}
+	if err := m.outputs(f, old, fc); err != nil {
+		return err
+	}
+	m.update(f, old, fc)
+	return nil
+}
+
+// Shutdown останавливает обработчики связок. В режиме teardown снимает по журналу
+// все установленное в обратном порядке, в режиме keep оставляет форвардинг на хосте
+func (m *manager) Shutdown() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.filterService.Shutdown()
+	if m.cfg.ShutdownMode == config.ShutdownKeep {
+		log.Info("Остановка с сохранением форвардинга, установленное остается на хосте")
+		return
+	}
+
+	log.Info("Остановка, снимаем все установленное")
+	entries := m.ledger.Entries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := m.teardown(entries[i]); err != nil {
+			log.Error("Ошибка снятия", "kind", entries[i].Kind, "link", entries[i].Link,
+				"priority", entries[i].Priority, "ip", entries[i].IP, logging.Err(err))
+		}
+	}
+}
+
+func (m *manager) teardown(e ledger.Entry) error {
+	if e.Kind == ledger.Filter {
+		rule := traffic_control.FromEntry(e)
+		log.Info("Удаление фильтра", "link", rule.Link, "priority", rule.Priority, "handle", rule.Handle,
+			logging.KeySourceIP, rule.Key(), logging.KeyDstIP, rule.NatTo)
+		if err := m.tc.Del(rule); err != nil && !traffic_control.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	lnk, err := netlink.LinkByName(e.Link)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		// интерфейса нет - вместе с ним пропало и все установленное на нем
+		m.ledger.Forget(e)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch e.Kind {
+	case ledger.Membership:
+		conn, err := igmp.NewConnection(e.IP, m.ledger)
+		if err != nil {
+			return err
+		}
+		conn.Leave(e.Link, e.IP)
+	case ledger.Route:
+		return interface_link.DelRoute(lnk, e.IP, m.ledger)
+	case ledger.Qdisc:
+		return interface_link.DelIngressQDisc(lnk, m.ledger)
+	case ledger.BPF:
+		return bpf_forward.Detach(lnk, e.Priority, m.ledger)
+	}
+	return nil
+}
+
+func (m *manager) add(fc config.Filter) error {
+	f := filter.FromConfig(fc.Id, m.cfg, fc)
+	if err := filter.ReservePrio(m.alloc, f); err != nil {
+		return errors.Because(err, ErrInvalid, "")
+	}
+
+	interface_link.MirrorFilter(m.tc, m.copyFrom, m.link, f)
+	if err := m.addRoutes(f.DstIP, f.Outputs); err != nil {
+		interface_link.UnmirrorFilter(m.tc, m.copyFrom, m.link, f)
+		filter.ReleasePrio(m.alloc, f)
+		return err
+	}
+	m.db.Set(f.Id, f)
+	if err := m.filterService.Start(f); err != nil {
+		m.remove(f)
+		return err
+	}
+	return nil
+}
+
+func (m *manager) remove(f *filter.Filter) {
+	m.filterService.Stop(f)
+	if f.IsIgmpOn {
+		if err := m.igmpService.ToggleByID(context.Background(), f.Id, igmp.LeaveGroup); err != nil {
+			f.Log(log).Error("Ошибка отписки от групп связки", logging.Err(err))
+		}
+	}
+	interface_link.UnmirrorFilter(m.tc, m.copyFrom, m.link, f)
+	if err := interface_link.DelRoute(m.link, f.DstIP, m.ledger); err != nil {
+		f.Log(log).Error("Ошибка удаления маршрута", logging.Err(err))
+	}
+	m.delRoutes(f, f.GetOutputs())
+	filter.ReleasePrio(m.alloc, f)
+	m.db.Del(f.Id)
+	m.state.Save()
+}
+
+// addRoutes маршруты route через интерфейс конфига и выходов через их интерфейсы, при ошибке добавленные снимаются
+func (m *manager) addRoutes(route string, outputs []filter.Output) error {
+	if err := interface_link.AddRoute(m.link, route, m.ledger); err != nil {
+		return err
+	}
+	for i, o := range outputs {
+		if err := interface_link.AddLinkRoute(o.Interface, o.Route, m.ledger); err != nil {
+			interface_link.DelRoute(m.link, route, m.ledger)
+			for _, added := range outputs[:i] {
+				interface_link.DelLinkRoute(added.Interface, added.Route, m.ledger)
+			}
+			return errors.Newf("маршрут выхода %s через %s: %s", o.Route, o.Interface, err)
+		}
+	}
+	return nil
+}
+
+func (m *manager) delRoutes(f *filter.Filter, outputs []filter.Output) {
+	for _, o := range outputs {
+		if err := interface_link.DelLinkRoute(o.Interface, o.Route, m.ledger); err != nil {
+			f.Log(log).Error("Ошибка удаления маршрута выхода", "output", o.Route, logging.Err(err))
+		}
+	}
+}
+
+// outputs смена выходов работающей связки: маршруты новых выходов ставятся до копий в них,
+// маршруты удаленных снимаются после
+func (m *manager) outputs(f *filter.Filter, old, fc config.Filter) error {
+	from, to := filterOutputs(old.GetOutputs(m.cfg.Interface)), filterOutputs(fc.GetOutputs(m.cfg.Interface))
+	if reflect.DeepEqual(from, to) {
+		return nil
+	}
+	added, removed := diffOutputs(from, to), diffOutputs(to, from)
+	for i, o := range added {
+		if err := interface_link.AddLinkRoute(o.Interface, o.Route, m.ledger); err != nil {
+			m.delRoutes(f, added[:i])
+			return errors.Newf("маршрут выхода %s через %s: %s", o.Route, o.Interface, err)
+		}
+	}
+	if err := m.filterService.SetOutputs(f, to); err != nil {
+		m.delRoutes(f, added)
+		return err
+	}
+	m.delRoutes(f, removed)
+	f.Log(log).Info("Изменены выходы", "added", len(added), "removed", len(removed))
+	return nil
+}
+
+func filterOutputs(outputs []config.Output) []filter.Output {
+	result := make([]filter.Output, 0, len(outputs))
+	for _, o := range outputs {
+		result = append(result, filter.Output{Route: o.Route, Interface: o.Interface})
+	}
+	return result
+}
+
+// diffOutputs выходы b, которых нет в a
+func diffOutputs(a, b []filter.Output) []filter.Output {
+	var diff []filter.Output
+	for _, o := range b {
+		found := false
+		for _, existing := range a {
+			if existing == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, o)
+		}
+	}
+	return diff
+}
+
+// update меняет только поля, измененные в конфиге, чтобы не сбросить переключения через API
+func (m *manager) update(f *filter.Filter, old, fc config.Filter) {
+	// пороги и условия собираются в копии и подменяются разом, автопереключение - отдельно ниже
+	cfg := f.GetCfg()
+	watchHealth := false
+	if old.SwitchTries != fc.SwitchTries {
+		f.Log(log).Info("Изменен switchTries", "from", old.SwitchTries, "to", fc.SwitchTries)
+		cfg.Tries = fc.SwitchTries
+	}
+	if old.AutoSwitch != fc.AutoSwitch {
+		f.Log(log).Info("Изменен autoSwitch", "from", old.AutoSwitch, "to", fc.AutoSwitch)
+		// у заблокированной связки автопереключение вернется при снятии блокировки
+		if lockout := f.GetLockout(); lockout != nil {
+			lockout.AutoSwitch = fc.AutoSwitch
+		} else {
+			f.SetAutoSwitch(fc.AutoSwitch)
+		}
+	}
+	if old.TSMaxErrorRate != fc.TSMaxErrorRate {
+		f.Log(log).Info("Изменен tsMaxErrorRate", "from", old.TSMaxErrorRate, "to", fc.TSMaxErrorRate)
+		cfg.TSMaxErrorRate = fc.TSMaxErrorRate
+		watchHealth = true
+	}
+	if old.RTPMaxLossRate != fc.RTPMaxLossRate || old.RTPMaxJitterMs != fc.RTPMaxJitterMs {
+		f.Log(log).Info("Изменены пороги RTP", "rtpMaxLossRate", fc.RTPMaxLossRate, "rtpMaxJitterMs", fc.RTPMaxJitterMs)
+		cfg.RTPMaxLossRate, cfg.RTPMaxJitterMs = fc.RTPMaxLossRate, fc.RTPMaxJitterMs
+		watchHealth = true
+	}
+	if old.BitrateSamples != fc.BitrateSamples {
+		f.Log(log).Info("Изменен bitrateSamples", "from", old.BitrateSamples, "to", fc.BitrateSamples)
+		cfg.BitrateSamples = fc.BitrateSamples
+	}
+	if old.GetFlap() != fc.GetFlap() {
+		f.Log(log).Info("Изменена защита от переключений")
+		cfg.Flap = fc.GetFlap()
+	}
+	if !reflect.DeepEqual(old.GetRevert(), fc.GetRevert()) {
+		f.Log(log).Info("Изменены условия возврата на мастер")
+		cfg.Revert = fc.GetRevert()
+	}
+	f.SetCfg(cfg, fc.Title)
+	if watchHealth {
+		m.filterService.WatchHealth(f)
+	}
+
+	oldSources := old.GetSources()
+	for i, src := range fc.GetSources() {
+		if oldSources[i].MinBitrate != src.MinBitrate || oldSources[i].MaxBitrate != src.MaxBitrate {
+			f.Log(log).Info("Изменены пороги битрейта", "source", src.Name,
+				"minBitrate", src.MinBitrate, "maxBitrate", src.MaxBitrate)
+			f.SetBitrateLimits(i, src.MinBitrate, src.MaxBitrate)
+		}
+	}
+}
+
+// reloadDiff разница связок старого и нового конфига. filters - связки нового конфига,
+// сопоставленные получают id из старого, isNew - связка новая, removed - связки старого без пары
+type reloadDiff struct {
+	filters []config.Filter
+	isNew   []bool
+	removed []config.Filter
+}
+
+// diff сопоставляет связки по id, а если id в старом конфиге нет - по route
+func diff(old, next []config.Filter) reloadDiff {
+	oldByID := make(map[int]config.Filter)
+	oldByRoute := make(map[string]config.Filter)
+	for _, f := range old {
+		oldByID[f.Id] = f
+		oldByRoute[f.Route] = f
+	}
+
+	d := reloadDiff{
+		filters: make([]config.Filter, len(next)),
+		isNew:   make([]bool, len(next)),
+	}
+	copy(d.filters, next)
+	paired := make(map[int]struct{})
+	for i, fc := range d.filters {
+		prev, ok := oldByID[fc.Id]
+		if !ok {
+			prev, ok = oldByRoute[fc.Route]
+		}
+		if _, used := paired[prev.Id]; !ok || used {
+			d.isNew[i] = true
+			continue
+		}
+		paired[prev.Id] = struct{}{}
+		d.filters[i].Id = prev.Id
+	}
+	for _, f := range old {
+		if _, ok := paired[f.Id]; !ok {
+			d.removed = append(d.removed, f)
+		}
+	}
+	return d
+}
+
+// needsReinstall у связки сменились route, источники или форвардинг, фильтры ставятся заново
+func needsReinstall(old, fc config.Filter) bool {
+	return old.Route != fc.Route || !sameSources(old.GetSources(), fc.GetSources()) ||
+		!reflect.DeepEqual(old.GetHitless(), fc.GetHitless()) ||
+		old.GetBackend() != fc.GetBackend() || !reflect.DeepEqual(old.GetUDP(), fc.GetUDP())
+}
+
+// needsRestart глобальные параметры, которые применяются только после перезапуска
+func needsRestart(old, cfg *config.Config) bool {
+	return cfg.Interface != old.Interface || cfg.CopyTrafficFrom != old.CopyTrafficFrom ||
+		cfg.Port != old.Port || cfg.StatFrequencySec != old.StatFrequencySec || cfg.Hostname != old.Hostname ||
+		cfg.HistorySamples != old.HistorySamples || !reflect.DeepEqual(cfg.Webhooks, old.Webhooks)
+}
+
+// sameSources совпадают ли источники без учета порогов битрейта
+func sameSources(a, b []config.Info) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].SameSource(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate проверка связки из API, в том числе на пересечение route с другими связками
+func (m *manager) validate(fc config.Filter) error {
+	if err := fc.Validate(); err != nil {
+		return errors.Because(err, ErrInvalid, "")
+	}
+	for _, other := range m.cfg.Filters {
+		if other.Id == fc.Id {
+			continue
+		}
+		for _, route := range fc.Routes() {
+			for _, used := range other.Routes() {
+				if route == used {
+					return errors.Because(nil, ErrInvalid, "route "+route+" уже используется связкой "+other.Title)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// save запись связок в файл, глобальные параметры - как в файле, даже если еще не применены
+func (m *manager) save() error {
+	file := m.file
+	file.Filters = m.cfg.Filters
+	if err := file.Save(m.fileName); err != nil {
+		log.Error("Ошибка записи конфига", logging.Err(err))
+		return err
+	}
+	return nil
+}
+
+func (m *manager) index(id int) (int, bool) {
+	for i, f := range m.cfg.Filters {
+		if f.Id == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (m *manager) nextID(pending ...config.Filter) int {
+	var id int
+	for i := range m.db.Values() {
+		if i > id {
+			id = i
+		}
+	}
+	for _, filters := range [][]config.Filter{m.cfg.Filters, pending} {
+		for _, f := range filters {
+			if f.Id > id {
+				id = f.Id
+			}
+		}
+	}
+	return id + 1
+}
@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jashakimov/multiswitcher/internal/config"
+)
+
+func testFilter(id int, route string) config.Filter {
+	return config.Filter{
+		Id:    id,
+		Title: "канал",
+		Route: route,
+		Sources: []config.Info{
+			{Name: "main", IP: "233.0.0.1"},
+			{Name: "backup", IP: "233.0.0.2"},
+		},
+	}
+}
+
+func TestReloadDiff(t *testing.T) {
+	withBackend := func(f config.Filter, backend string) config.Filter {
+		f.Backend = backend
+		return f
+	}
+	withTries := func(f config.Filter, tries int) config.Filter {
+		f.SwitchTries = tries
+		return f
+	}
+
+	tests := []struct {
+		name string
+		old  *config.Config
+		cfg  *config.Config
+		// id связок нового конфига после сопоставления, новые - с isNew
+		ids       []int
+		isNew     []bool
+		removed   []int
+		reinstall []bool
+		restart   bool
+	}{
+		{
+			name:      "добавлена связка",
+			old:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.1")}},
+			cfg:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.1"), testFilter(0, "239.0.0.2")}},
+			ids:       []int{1, 0},
+			isNew:     []bool{false, true},
+			reinstall: []bool{false, false},
+		},
+		{
+			name:      "удалена связка",
+			old:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.1"), testFilter(2, "239.0.0.2")}},
+			cfg:       &config.Config{Filters: []config.Filter{testFilter(2, "239.0.0.2")}},
+			ids:       []int{2},
+			isNew:     []bool{false},
+			removed:   []int{1},
+			reinstall: []bool{false},
+		},
+		{
+			name:      "смена route",
+			old:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.1")}},
+			cfg:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.9")}},
+			ids:       []int{1},
+			isNew:     []bool{false},
+			reinstall: []bool{true},
+		},
+		{
+			name:      "без id сопоставляется по route",
+			old:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.1")}},
+			cfg:       &config.Config{Filters: []config.Filter{withTries(testFilter(0, "239.0.0.1"), 5)}},
+			ids:       []int{1},
+			isNew:     []bool{false},
+			reinstall: []bool{false},
+		},
+		{
+			name:      "смена backend",
+			old:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.1")}},
+			cfg:       &config.Config{Filters: []config.Filter{withBackend(testFilter(1, "239.0.0.1"), config.BackendUDP)}},
+			ids:       []int{1},
+			isNew:     []bool{false},
+			reinstall: []bool{true},
+		},
+		{
+			name:      "backend по умолчанию",
+			old:       &config.Config{Filters: []config.Filter{testFilter(1, "239.0.0.1")}},
+			cfg:       &config.Config{Filters: []config.Filter{withBackend(testFilter(1, "239.0.0.1"), config.BackendTC)}},
+			ids:       []int{1},
+			isNew:     []bool{false},
+			reinstall: []bool{false},
+		},
+		{
+			name:      "только глобальные параметры",
+			old:       &config.Config{Port: "8080", Filters: []config.Filter{testFilter(1, "239.0.0.1")}},
+			cfg:       &config.Config{Port: "9090", Filters: []config.Filter{testFilter(1, "239.0.0.1")}},
+			ids:       []int{1},
+			isNew:     []bool{false},
+			reinstall: []bool{false},
+			restart:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diff(tt.old.Filters, tt.cfg.Filters)
+
+			var ids []int
+			for _, f := range d.filters {
+				ids = append(ids, f.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) || !reflect.DeepEqual(d.isNew, tt.isNew) {
+				t.Fatalf("id %v новые %v, ожидалось %v %v", ids, d.isNew, tt.ids, tt.isNew)
+			}
+			var removed []int
+			for _, f := range d.removed {
+				removed = append(removed, f.Id)
+			}
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Fatalf("удалены %v, ожидалось %v", removed, tt.removed)
+			}
+
+			oldByID := make(map[int]config.Filter)
+			for _, f := range tt.old.Filters {
+				oldByID[f.Id] = f
+			}
+			for i, fc := range d.filters {
+				if d.isNew[i] {
+					continue
+				}
+				if got := needsReinstall(oldByID[fc.Id], fc); got != tt.reinstall[i] {
+					t.Fatalf("связка %d: переустановка %v, ожидалось %v", fc.Id, got, tt.reinstall[i])
+				}
+			}
+			if got := needsRestart(tt.old, tt.cfg); got != tt.restart {
+				t.Fatalf("перезапуск %v, ожидалось %v", got, tt.restart)
+			}
+		})
+	}
+}
@@ -1,37 +1,56 @@
 package net_listener
 
 import (
-	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
 	"github.com/jashakimov/multiswitcher/internal/utils"
-	"log"
+	"time"
 )
 
+var log = logging.For(logging.NetListener)
+
+// Listener прослушка и разбор потоков по ключу потока источника traffic_control.Key:
+// группа или группа с адресом источника, UDP портом и VLAN
 type Listener interface {
 	Receive(ip string, info Info)
 	Stop(ip string)
+	// Watch разбор потока ip: ошибки TS, потери и джиттер RTP
+	Watch(ip string)
+	Unwatch(ip string)
+	// Health счетчики ошибок TS, false если поток ip не разбирается
+	Health(ip string) (TSHealth, bool)
+	// RTP потери и джиттер, false если поток ip не разбирается или в нем еще не было RTP
+	RTP(ip string) (RTPStats, bool)
+	// Feed UDP payload потока ip, принятый в обход захвата: сокетами форвардинга в userspace,
+	// у таких связок нет зеркалирования на интерфейс захвата
+	Feed(ip string, payload []byte, at time.Time)
 }
 
 type service struct {
 	ips          *utils.SyncMap[string, Info]
+	analyzers    *utils.SyncMap[string, *tsAnalyzer]
+	rtp          *utils.SyncMap[string, *rtpAnalyzer]
 	packetSource *gopacket.PacketSource
 }
 
 func NewService(iname string) Listener {
 	handle, err := pcap.OpenLive(iname, 65536, true, pcap.BlockForever)
 	if err != nil {
-		log.Fatal(err)
+		panic(err)
 	}
 
-	err = handle.SetBPFFilter("ip")
+	err = handle.SetBPFFilter("ip or ip6")
 	if err != nil {
 		panic(err)
 	}
 
 	s := service{
 		ips:          utils.NewSyncMap[string, Info](),
+		analyzers:    utils.NewSyncMap[string, *tsAnalyzer](),
+		rtp:          utils.NewSyncMap[string, *rtpAnalyzer](),
 		packetSource: gopacket.NewPacketSource(handle, handle.LinkType()),
 	}
 
@@ -41,26 +60,119 @@ func NewService(iname string) Listener {
 }
 
 func (s *service) Receive(ip string, info Info) {
-	fmt.Println("Добавляем прослушку ", ip)
+	log.Info("Добавляем прослушку", logging.KeySourceIP, ip, logging.KeyFilterID, info.Id)
 	s.ips.Set(ip, info)
 }
 
 func (s *service) Stop(ip string) {
-	fmt.Println("Останавливаем прослушку ", ip)
+	log.Info("Останавливаем прослушку", logging.KeySourceIP, ip)
 	s.ips.Del(ip)
 }
 
+func (s *service) Watch(ip string) {
+	if _, ok := s.analyzers.Get(ip); ok {
+		return
+	}
+	log.Info("Включаем разбор потока", logging.KeySourceIP, ip)
+	s.rtp.Set(ip, newRTPAnalyzer())
+	s.analyzers.Set(ip, newTSAnalyzer())
+}
+
+func (s *service) Unwatch(ip string) {
+	if _, ok := s.analyzers.Get(ip); !ok {
+		return
+	}
+	log.Info("Отключаем разбор потока", logging.KeySourceIP, ip)
+	s.analyzers.Del(ip)
+	s.rtp.Del(ip)
+}
+
+func (s *service) Health(ip string) (TSHealth, bool) {
+	a, ok := s.analyzers.Get(ip)
+	if !ok {
+		return TSHealth{}, false
+	}
+	return a.snapshot(time.Now()), true
+}
+
+func (s *service) RTP(ip string) (RTPStats, bool) {
+	a, ok := s.rtp.Get(ip)
+	if !ok {
+		return RTPStats{}, false
+	}
+	return a.snapshot(time.Now())
+}
+
 func (s *service) listen() {
 	for packet := range s.packetSource.Packets() {
-		if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-			pack, ok := ipLayer.(*layers.IPv4)
-			if !ok {
-				continue
-			}
-			dspIp := pack.DstIP.String()
-			if ch, ok := s.ips.Get(dspIp); ok {
-				ch.ReceiveChan <- ch.Id
+		var dstIP, srcIP string
+		switch pack := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			dstIP, srcIP = pack.DstIP.String(), pack.SrcIP.String()
+		case *layers.IPv6:
+			dstIP, srcIP = pack.DstIP.String(), pack.SrcIP.String()
+		default:
+			continue
+		}
+		udp, isUDP := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		var port, vlan int
+		if isUDP {
+			port = int(udp.DstPort)
+		}
+		if tag, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok {
+			vlan = int(tag.VLANIdentifier)
+		}
+
+		var payload []byte
+		if isUDP {
+			payload = udp.Payload
+		}
+		for _, key := range keys(dstIP, srcIP, port, vlan) {
+			s.handle(key, payload, isUDP, packet.Metadata().Timestamp)
+		}
+	}
+}
+
+func (s *service) Feed(ip string, payload []byte, at time.Time) {
+	s.handle(ip, payload, true, at)
+}
+
+// handle пакет потока key: уведомление о возврате на мастер и разбор UDP payload
+func (s *service) handle(key string, payload []byte, isUDP bool, at time.Time) {
+	if ch, ok := s.ips.Get(key); ok {
+		// разбор не ждет переключатель: пока он занят, пакеты источника ему не нужны
+		select {
+		case ch.ReceiveChan <- ch.Id:
+		default:
+		}
+	}
+	if !isUDP {
+		return
+	}
+	if a, ok := s.analyzers.Get(key); ok {
+		a.add(payload, at)
+	}
+	if r, ok := s.rtp.Get(key); ok {
+		r.add(payload, at)
+	}
+}
+
+// keys ключи, под которыми может быть заведен поток пакета: группа и все сочетания уточнений
+func keys(dst, src string, port, vlan int) []string {
+	ports, vlans := []int{0}, []int{0}
+	if port != 0 {
+		ports = append(ports, port)
+	}
+	if vlan != 0 {
+		vlans = append(vlans, vlan)
+	}
+	keys := make([]string, 0, 2*len(ports)*len(vlans))
+	for _, s := range []string{"", src} {
+		for _, p := range ports {
+			for _, v := range vlans {
+				keys = append(keys, traffic_control.Key(dst, s, p, v))
 			}
 		}
 	}
+	return keys
 }
@@ -0,0 +1,164 @@
+package net_listener
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// rtpClockRate частота RTP timestamp для джиттера, 90 кГц у MPEG-TS (RFC 2250) и видео
+	rtpClockRate = 90000
+	// rtpMaxDropout и rtpMaxMisorder скачки номера, после которых счет начинается заново (RFC 3550 A.1)
+	rtpMaxDropout  = 3000
+	rtpMaxMisorder = 100
+)
+
+// RTPStats потери, переупорядочивание и джиттер RTP потока источника с начала прослушки.
+// LossRate - доля потерянных пакетов за последнее полное окно в секунду, JitterMs - по RFC 3550
+type RTPStats struct {
+	SSRC        uint32    `json:"ssrc"`
+	PayloadType uint8     `json:"payloadType"`
+	Packets     uint64    `json:"packets"`
+	Expected    uint64    `json:"expected"`
+	Lost        int64     `json:"lost"`
+	Reordered   uint64    `json:"reordered"`
+	JitterMs    float64   `json:"jitterMs"`
+	LossRate    float64   `json:"lossRate"`
+	LastPacket  time.Time `json:"lastPacket"`
+}
+
+type rtpAnalyzer struct {
+	lock  sync.Mutex
+	stats RTPStats
+
+	started  bool
+	baseSeq  uint32
+	maxSeq   uint16
+	cycles   uint32
+	received uint64
+	// transit и jitter в единицах RTP timestamp
+	transit float64
+	jitter  float64
+	epoch   time.Time
+
+	windowStart    time.Time
+	windowExpected uint32
+	windowReceived uint64
+}
+
+func newRTPAnalyzer() *rtpAnalyzer {
+	return &rtpAnalyzer{windowStart: time.Now()}
+}
+
+// add payload - полезная нагрузка UDP, не RTP пакеты пропускаются
+func (a *rtpAnalyzer) add(payload []byte, now time.Time) {
+	if _, ok := rtpPayload(payload); !ok {
+		return
+	}
+	seq := binary.BigEndian.Uint16(payload[2:4])
+	timestamp := binary.BigEndian.Uint32(payload[4:8])
+	ssrc := binary.BigEndian.Uint32(payload[8:12])
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.roll(now)
+	a.stats.PayloadType = payload[1] & 0x7f
+	a.stats.LastPacket = now
+	a.stats.Packets++
+
+	if !a.started || ssrc != a.stats.SSRC {
+		a.reset(seq, ssrc, now)
+	} else {
+		switch delta := seq - a.maxSeq; {
+		case delta == 0:
+			// повтор последнего пакета
+			return
+		case delta < rtpMaxDropout:
+			if seq < a.maxSeq {
+				a.cycles += 1 << 16
+			}
+			a.maxSeq = seq
+		case delta <= 0xffff-rtpMaxMisorder:
+			// большой скачок номера - источник перезапустился
+			a.reset(seq, ssrc, now)
+		default:
+			// опоздавший пакет
+			a.stats.Reordered++
+			a.received++
+			a.windowReceived++
+			a.update()
+			return
+		}
+	}
+	a.received++
+	a.windowReceived++
+
+	// джиттер RFC 3550 6.4.1: J += (|D| - J) / 16
+	arrival := now.Sub(a.epoch).Seconds() * rtpClockRate
+	transit := arrival - float64(timestamp)
+	if a.received > 1 {
+		d := math.Abs(transit - a.transit)
+		// разница больше половины цикла timestamp - переполнение, а не джиттер
+		if d < 1<<31 {
+			a.jitter += (d - a.jitter) / 16
+		}
+	}
+	a.transit = transit
+	a.update()
+}
+
+func (a *rtpAnalyzer) reset(seq uint16, ssrc uint32, now time.Time) {
+	a.started = true
+	a.stats.SSRC = ssrc
+	a.baseSeq = uint32(seq)
+	a.maxSeq = seq
+	a.cycles = 0
+	a.received = 0
+	a.jitter = 0
+	a.epoch = now
+	a.windowExpected = uint32(seq)
+	a.windowReceived = 0
+}
+
+// extendedMax номер последнего пакета с учетом переполнений
+func (a *rtpAnalyzer) extendedMax() uint32 {
+	return a.cycles + uint32(a.maxSeq)
+}
+
+func (a *rtpAnalyzer) expected() uint32 {
+	return a.extendedMax() + 1 - a.baseSeq
+}
+
+func (a *rtpAnalyzer) update() {
+	a.stats.Expected = uint64(a.expected())
+	a.stats.Lost = int64(a.stats.Expected) - int64(a.received)
+	a.stats.JitterMs = a.jitter / rtpClockRate * 1000
+}
+
+// roll закрывает окно, если оно истекло, как у tsAnalyzer
+func (a *rtpAnalyzer) roll(now time.Time) {
+	if now.Sub(a.windowStart) < healthWindow {
+		return
+	}
+	a.stats.LossRate = 0
+	next := a.extendedMax() + 1
+	if a.started && now.Sub(a.windowStart) < 2*healthWindow {
+		if expected := next - a.windowExpected; expected > 0 && uint64(expected) > a.windowReceived {
+			a.stats.LossRate = float64(uint64(expected)-a.windowReceived) / float64(expected)
+		}
+	}
+	a.windowStart = now
+	a.windowExpected = next
+	a.windowReceived = 0
+}
+
+func (a *rtpAnalyzer) snapshot(now time.Time) (RTPStats, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.roll(now)
+	return a.stats, a.started
+}
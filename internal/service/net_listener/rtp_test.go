@@ -0,0 +1,122 @@
+package net_listener
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// frame интервал кадров 40 мс и его длина в единицах RTP timestamp
+const (
+	frame   = 40 * time.Millisecond
+	frameTS = 3600
+)
+
+func rtpPacket(seq uint16, timestamp, ssrc uint32) []byte {
+	b := []byte{0x80, 33, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, tsSyncByte}
+	binary.BigEndian.PutUint16(b[2:4], seq)
+	binary.BigEndian.PutUint32(b[4:8], timestamp)
+	binary.BigEndian.PutUint32(b[8:12], ssrc)
+	return b
+}
+
+func TestRTPAnalyzerSequence(t *testing.T) {
+	type packet struct {
+		seq  uint16
+		ssrc uint32
+	}
+	tests := []struct {
+		name      string
+		packets   []packet
+		expected  uint64
+		lost      int64
+		reordered uint64
+	}{
+		{name: "по порядку", packets: []packet{{seq: 1}, {seq: 2}, {seq: 3}, {seq: 4}}, expected: 4},
+		{name: "потери", packets: []packet{{seq: 1}, {seq: 2}, {seq: 5}, {seq: 6}}, expected: 6, lost: 2},
+		{name: "переход через 65535", packets: []packet{{seq: 65534}, {seq: 65535}, {seq: 0}, {seq: 1}}, expected: 4},
+		{name: "потеря на переходе", packets: []packet{{seq: 65534}, {seq: 1}}, expected: 4, lost: 2},
+		{name: "переупорядочивание", packets: []packet{{seq: 1}, {seq: 3}, {seq: 2}, {seq: 4}}, expected: 4, reordered: 1},
+		{name: "опоздавший через переход", packets: []packet{{seq: 65535}, {seq: 1}, {seq: 0}}, expected: 3, reordered: 1},
+		{name: "повтор", packets: []packet{{seq: 1}, {seq: 2}, {seq: 2}, {seq: 3}}, expected: 3},
+		{name: "скачок номера", packets: []packet{{seq: 1}, {seq: 2}, {seq: 10000}, {seq: 10001}}, expected: 2},
+		{name: "смена SSRC", packets: []packet{{seq: 1}, {seq: 5}, {seq: 500, ssrc: 2}, {seq: 501, ssrc: 2}}, expected: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			a := newRTPAnalyzer()
+			a.windowStart = start
+			for i, p := range tt.packets {
+				a.add(rtpPacket(p.seq, uint32(i)*frameTS, p.ssrc), start.Add(time.Duration(i)*frame))
+			}
+			got := a.stats
+			if got.Packets != uint64(len(tt.packets)) || got.Expected != tt.expected || got.Lost != tt.lost ||
+				got.Reordered != tt.reordered {
+				t.Fatalf("packets %d expected %d lost %d reordered %d, ожидалось %d %d %d %d", got.Packets,
+					got.Expected, got.Lost, got.Reordered, len(tt.packets), tt.expected, tt.lost, tt.reordered)
+			}
+		})
+	}
+}
+
+func TestRTPAnalyzerJitter(t *testing.T) {
+	tests := []struct {
+		name string
+		// delaysMs опоздание каждого пакета относительно его timestamp
+		delaysMs []int
+		start    uint32
+		want     float64
+	}{
+		{name: "ровный поток", delaysMs: []int{0, 0, 0, 0}, want: 0},
+		{name: "постоянная задержка", delaysMs: []int{5, 5, 5}, want: 0},
+		// D = 10 мс: J = 10/16
+		{name: "одно опоздание", delaysMs: []int{0, 10}, want: 0.625},
+		// второй D тоже 10 мс: J = 0.625 + (10 - 0.625)/16
+		{name: "опоздание и возврат", delaysMs: []int{0, 10, 0}, want: 0.625 + (10-0.625)/16},
+		{name: "переполнение timestamp", delaysMs: []int{0, 0, 0}, start: math.MaxUint32 - frameTS, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			a := newRTPAnalyzer()
+			for i, delay := range tt.delaysMs {
+				arrival := start.Add(time.Duration(i)*frame + time.Duration(delay)*time.Millisecond)
+				a.add(rtpPacket(uint16(i), tt.start+uint32(i)*frameTS, 1), arrival)
+			}
+			if got := a.stats.JitterMs; math.Abs(got-tt.want) > 1e-6 {
+				t.Fatalf("джиттер %v мс, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRTPAnalyzerLossRate(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		at   time.Duration
+		want float64
+	}{
+		{name: "окно не закрыто", seqs: []uint16{1, 2, 5}, at: 500 * time.Millisecond, want: 0},
+		{name: "без потерь", seqs: []uint16{1, 2, 3, 4}, at: 1100 * time.Millisecond, want: 0},
+		{name: "потери в окне", seqs: []uint16{1, 2, 3, 4, 8, 9, 10}, at: 1100 * time.Millisecond, want: 0.3},
+		{name: "опоздавший пакет не считается потерей", seqs: []uint16{1, 3, 2, 4}, at: 1100 * time.Millisecond, want: 0},
+		{name: "поток пропал дольше окна", seqs: []uint16{1, 5}, at: 2500 * time.Millisecond, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			a := newRTPAnalyzer()
+			a.windowStart = start
+			for i, seq := range tt.seqs {
+				a.add(rtpPacket(seq, uint32(i)*frameTS, 1), start.Add(time.Duration(i)*time.Millisecond))
+			}
+			stats, started := a.snapshot(start.Add(tt.at))
+			if !started || math.Abs(stats.LossRate-tt.want) > 1e-9 {
+				t.Fatalf("доля потерь %v, ожидалось %v", stats.LossRate, tt.want)
+			}
+		})
+	}
+}
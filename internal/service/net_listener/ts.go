@@ -0,0 +1,164 @@
+package net_listener
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	tsNullPID    = 0x1fff
+	// pcrMaxGap ISO/IEC 13818-1 требует PCR не реже чем раз в 100 мс
+	pcrMaxGap = 100 * time.Millisecond
+	// healthWindow окно, за которое считается доля ошибок
+	healthWindow = time.Second
+)
+
+// TSHealth счетчики ошибок MPEG-TS источника с начала прослушки.
+// ErrorRate - доля TS пакетов с ошибками за последнее полное окно в секунду
+type TSHealth struct {
+	Packets    uint64    `json:"packets"`
+	CCErrors   uint64    `json:"ccErrors"`
+	SyncLoss   uint64    `json:"syncLoss"`
+	PCRGaps    uint64    `json:"pcrGaps"`
+	ErrorRate  float64   `json:"errorRate"`
+	LastPacket time.Time `json:"lastPacket"`
+}
+
+// tsAnalyzer разбор UDP/RTP датаграмм источника на TS пакеты
+type tsAnalyzer struct {
+	lock   sync.Mutex
+	health TSHealth
+	cc     map[uint16]byte
+	pcr    map[uint16]time.Time
+
+	windowStart   time.Time
+	windowPackets uint64
+	windowErrors  uint64
+}
+
+func newTSAnalyzer() *tsAnalyzer {
+	return &tsAnalyzer{
+		cc:          make(map[uint16]byte),
+		pcr:         make(map[uint16]time.Time),
+		windowStart: time.Now(),
+	}
+}
+
+// add payload - полезная нагрузка UDP, с RTP заголовком или без
+func (a *tsAnalyzer) add(payload []byte, now time.Time) {
+	if rtp, ok := rtpPayload(payload); ok {
+		payload = rtp
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.roll(now)
+	a.health.LastPacket = now
+
+	// датаграмма должна состоять из целых TS пакетов, иначе синхронизация потеряна целиком
+	if len(payload) == 0 || len(payload)%tsPacketSize != 0 {
+		n := uint64(len(payload)/tsPacketSize + 1)
+		a.health.Packets += n
+		a.health.SyncLoss++
+		a.windowPackets += n
+		a.windowErrors += n
+		return
+	}
+	for i := 0; i < len(payload); i += tsPacketSize {
+		a.health.Packets++
+		a.windowPackets++
+		if !a.packet(payload[i:i+tsPacketSize], now) {
+			a.windowErrors++
+		}
+	}
+}
+
+// packet проверка одного TS пакета, false если в нем есть ошибка
+func (a *tsAnalyzer) packet(p []byte, now time.Time) bool {
+	if p[0] != tsSyncByte {
+		a.health.SyncLoss++
+		return false
+	}
+	pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+	if pid == tsNullPID {
+		return true
+	}
+
+	ok := true
+	control := (p[3] >> 4) & 0x3
+	cc := p[3] & 0xf
+	hasAdaptation := control&0x2 != 0 && p[4] > 0
+	discontinuity := hasAdaptation && p[5]&0x80 != 0
+
+	// счетчик растет только у пакетов с полезной нагрузкой, один повтор пакета допустим
+	if control&0x1 != 0 {
+		if last, seen := a.cc[pid]; seen && !discontinuity && cc != (last+1)&0xf && cc != last {
+			a.health.CCErrors++
+			ok = false
+		}
+		a.cc[pid] = cc
+	}
+
+	if hasAdaptation && p[4] >= 7 && p[5]&0x10 != 0 {
+		if last, seen := a.pcr[pid]; seen && !discontinuity && now.Sub(last) > pcrMaxGap {
+			a.health.PCRGaps++
+			ok = false
+		}
+		a.pcr[pid] = now
+	}
+	return ok
+}
+
+// roll закрывает окно, если оно истекло. Окно без пакетов дает нулевую долю ошибок,
+// пропадание потока целиком определяется по счетчикам tc
+func (a *tsAnalyzer) roll(now time.Time) {
+	if now.Sub(a.windowStart) < healthWindow {
+		return
+	}
+	a.health.ErrorRate = 0
+	if a.windowPackets > 0 && now.Sub(a.windowStart) < 2*healthWindow {
+		a.health.ErrorRate = float64(a.windowErrors) / float64(a.windowPackets)
+	}
+	a.windowStart = now
+	a.windowPackets = 0
+	a.windowErrors = 0
+}
+
+func (a *tsAnalyzer) snapshot(now time.Time) TSHealth {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.roll(now)
+	return a.health
+}
+
+// rtpPayload полезная нагрузка RTP пакета (RFC 3550), false если это не RTP.
+// TS без RTP начинается с 0x47, у которого версия RTP была бы 1
+func rtpPayload(b []byte) ([]byte, bool) {
+	if len(b) < 12 || b[0]>>6 != 2 {
+		return nil, false
+	}
+	offset := 12 + 4*int(b[0]&0xf)
+	if b[0]&0x10 != 0 {
+		if len(b) < offset+4 {
+			return nil, false
+		}
+		offset += 4 + 4*(int(b[offset+2])<<8|int(b[offset+3]))
+	}
+	if len(b) < offset {
+		return nil, false
+	}
+	payload := b[offset:]
+	// padding: последний байт - длина дополнения
+	if b[0]&0x20 != 0 && len(payload) > 0 {
+		pad := int(payload[len(payload)-1])
+		if pad > len(payload) {
+			return nil, false
+		}
+		payload = payload[:len(payload)-pad]
+	}
+	return payload, true
+}
@@ -0,0 +1,247 @@
+package net_listener
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// tsPacket TS пакет pid со счетчиком cc. control - adaptation_field_control,
+// adaptation - поле адаптации без байта длины, nil - без поля
+type tsPacket struct {
+	pid        uint16
+	cc         byte
+	control    byte
+	adaptation []byte
+}
+
+func (p tsPacket) bytes() []byte {
+	b := make([]byte, tsPacketSize)
+	b[0] = tsSyncByte
+	b[1] = byte(p.pid >> 8)
+	b[2] = byte(p.pid)
+	control := p.control
+	if control == 0 {
+		control = 0x1
+	}
+	b[3] = control<<4 | p.cc&0xf
+	if p.adaptation != nil {
+		b[4] = byte(len(p.adaptation))
+		copy(b[5:], p.adaptation)
+	}
+	return b
+}
+
+// pcr поле адаптации с PCR, discontinuity - флаг разрыва
+func pcr(discontinuity bool) []byte {
+	flags := byte(0x10)
+	if discontinuity {
+		flags |= 0x80
+	}
+	return []byte{flags, 0, 0, 0, 0, 0, 0}
+}
+
+func datagram(packets ...tsPacket) []byte {
+	var b []byte
+	for _, p := range packets {
+		b = append(b, p.bytes()...)
+	}
+	return b
+}
+
+func withRTP(payload []byte) []byte {
+	header := []byte{0x80, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}
+	return append(header, payload...)
+}
+
+// padded RTP пакет с n байтами дополнения
+func padded(packet []byte, n int) []byte {
+	packet = append(packet, make([]byte, n)...)
+	packet[0] |= 0x20
+	packet[len(packet)-1] = byte(n)
+	return packet
+}
+
+func TestTSAnalyzerAdd(t *testing.T) {
+	type datagramAt struct {
+		payload []byte
+		at      time.Duration
+	}
+	tests := []struct {
+		name      string
+		datagrams []datagramAt
+		want      TSHealth
+	}{
+		{
+			name: "непрерывный счетчик",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 0}, tsPacket{pid: 100, cc: 1}, tsPacket{pid: 101, cc: 7})},
+				{payload: datagram(tsPacket{pid: 100, cc: 2}, tsPacket{pid: 101, cc: 8})},
+			},
+			want: TSHealth{Packets: 5},
+		},
+		{
+			name: "переход счетчика через 15 и повтор пакета",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 14}, tsPacket{pid: 100, cc: 15}, tsPacket{pid: 100, cc: 15}, tsPacket{pid: 100, cc: 0})},
+			},
+			want: TSHealth{Packets: 4},
+		},
+		{
+			name: "пропуск пакетов",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 1}, tsPacket{pid: 100, cc: 3}, tsPacket{pid: 100, cc: 4})},
+			},
+			want: TSHealth{Packets: 3, CCErrors: 1},
+		},
+		{
+			name: "разрыв снимает проверку счетчика",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 1}, tsPacket{pid: 100, cc: 9, control: 0x3, adaptation: []byte{0x80}})},
+			},
+			want: TSHealth{Packets: 2},
+		},
+		{
+			name: "пакет без полезной нагрузки не двигает счетчик",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 1}, tsPacket{pid: 100, cc: 5, control: 0x2, adaptation: []byte{0}}, tsPacket{pid: 100, cc: 2})},
+			},
+			want: TSHealth{Packets: 3},
+		},
+		{
+			name: "null пакеты не проверяются",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: tsNullPID, cc: 3}, tsPacket{pid: tsNullPID, cc: 9})},
+			},
+			want: TSHealth{Packets: 2},
+		},
+		{
+			name: "неверный байт синхронизации",
+			datagrams: []datagramAt{
+				{payload: func() []byte {
+					b := datagram(tsPacket{pid: 100, cc: 0}, tsPacket{pid: 100, cc: 1})
+					b[tsPacketSize] = 0
+					return b
+				}()},
+			},
+			want: TSHealth{Packets: 2, SyncLoss: 1},
+		},
+		{
+			name: "датаграмма не из целых пакетов",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 0})[:100]},
+				{payload: append(datagram(tsPacket{pid: 100, cc: 0}), 0x47)},
+			},
+			want: TSHealth{Packets: 3, SyncLoss: 2},
+		},
+		{
+			name: "PCR чаще 100 мс",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 0, control: 0x3, adaptation: pcr(false)})},
+				{payload: datagram(tsPacket{pid: 100, cc: 1, control: 0x3, adaptation: pcr(false)}), at: 40 * time.Millisecond},
+				{payload: datagram(tsPacket{pid: 100, cc: 2, control: 0x3, adaptation: pcr(false)}), at: 140 * time.Millisecond},
+			},
+			want: TSHealth{Packets: 3},
+		},
+		{
+			name: "PCR реже 100 мс",
+			datagrams: []datagramAt{
+				{payload: datagram(tsPacket{pid: 100, cc: 0, control: 0x3, adaptation: pcr(false)})},
+				{payload: datagram(tsPacket{pid: 100, cc: 1, control: 0x3, adaptation: pcr(false)}), at: 150 * time.Millisecond},
+				{payload: datagram(tsPacket{pid: 100, cc: 2, control: 0x3, adaptation: pcr(true)}), at: 400 * time.Millisecond},
+			},
+			want: TSHealth{Packets: 3, PCRGaps: 1},
+		},
+		{
+			name: "TS в RTP",
+			datagrams: []datagramAt{
+				{payload: withRTP(datagram(tsPacket{pid: 100, cc: 0}, tsPacket{pid: 100, cc: 2}))},
+			},
+			want: TSHealth{Packets: 2, CCErrors: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			a := newTSAnalyzer()
+			a.windowStart = start
+			for _, d := range tt.datagrams {
+				a.add(d.payload, start.Add(d.at))
+			}
+			got := a.health
+			got.LastPacket = time.Time{}
+			if got != tt.want {
+				t.Fatalf("%+v, ожидалось %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTSAnalyzerWindow(t *testing.T) {
+	start := time.Now()
+	good := datagram(tsPacket{pid: 100, cc: 0}, tsPacket{pid: 100, cc: 1}, tsPacket{pid: 100, cc: 2})
+	bad := datagram(tsPacket{pid: 100, cc: 5})
+
+	tests := []struct {
+		name string
+		// датаграммы в первом окне, затем снимок в момент at
+		first [][]byte
+		at    time.Duration
+		want  float64
+	}{
+		{name: "окно не закрыто", first: [][]byte{good, bad}, at: 500 * time.Millisecond, want: 0},
+		{name: "доля ошибок закрытого окна", first: [][]byte{good, bad}, at: 1100 * time.Millisecond, want: 0.25},
+		{name: "без ошибок", first: [][]byte{good}, at: 1100 * time.Millisecond, want: 0},
+		{name: "окно без пакетов", at: 1100 * time.Millisecond, want: 0},
+		{name: "поток пропал дольше окна", first: [][]byte{good, bad}, at: 2500 * time.Millisecond, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTSAnalyzer()
+			a.windowStart = start
+			for _, d := range tt.first {
+				a.add(d, start.Add(100*time.Millisecond))
+			}
+			if got := a.snapshot(start.Add(tt.at)).ErrorRate; got != tt.want {
+				t.Fatalf("доля ошибок %v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRTPPayload(t *testing.T) {
+	payload := []byte{0x47, 1, 2, 3}
+	tests := []struct {
+		name   string
+		packet []byte
+		want   []byte
+		ok     bool
+	}{
+		{name: "TS без RTP", packet: datagram(tsPacket{pid: 100}), ok: false},
+		{name: "короче заголовка", packet: []byte{0x80, 33, 0, 1}, ok: false},
+		{name: "заголовок", packet: withRTP(payload), want: payload, ok: true},
+		{
+			name:   "CSRC",
+			packet: append([]byte{0x82, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}, payload...),
+			want:   payload,
+			ok:     true,
+		},
+		{
+			name:   "расширение заголовка",
+			packet: append([]byte{0x90, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0xbe, 0xde, 0, 1, 9, 9, 9, 9}, payload...),
+			want:   payload,
+			ok:     true,
+		},
+		{name: "обрезанное расширение", packet: []byte{0x90, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0xbe, 0xde, 0, 2, 9, 9}, ok: false},
+		{name: "дополнение", packet: padded(withRTP(payload), 3), want: payload, ok: true},
+		{name: "дополнение длиннее нагрузки", packet: []byte{0xa0, 33, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 5}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rtpPayload(tt.packet)
+			if ok != tt.ok || !bytes.Equal(got, tt.want) {
+				t.Fatalf("%v %v, ожидалось %v %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
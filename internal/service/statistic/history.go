@@ -0,0 +1,90 @@
+package statistic
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"sync"
+	"time"
+)
+
+// Sample битрейт (бит/с) и pps источника за один опрос
+type Sample struct {
+	Time    time.Time `json:"time"`
+	Bitrate float64   `json:"bitrate"`
+	Pps     float64   `json:"pps"`
+}
+
+// history кольцевые буферы сэмплов по ip источника
+type history struct {
+	lock     sync.Mutex
+	size     int
+	bySource map[string]*utils.Ring[Sample]
+}
+
+func newHistory(size int) *history {
+	return &history{
+		size:     size,
+		bySource: make(map[string]*utils.Ring[Sample]),
+	}
+}
+
+// add сэмплы одного опроса, буферы источников, которых больше нет, удаляются
+func (h *history) add(now time.Time, stats map[string]Stats) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for ip := range h.bySource {
+		if _, ok := stats[ip]; !ok {
+			delete(h.bySource, ip)
+		}
+	}
+	for ip, s := range stats {
+		ring, ok := h.bySource[ip]
+		if !ok {
+			ring = utils.NewRing[Sample](h.size)
+			h.bySource[ip] = ring
+		}
+		ring.Push(Sample{Time: now, Bitrate: s.Bitrate, Pps: s.Pps})
+	}
+}
+
+// get сэмплы источника в интервале [from, to], нулевая граница не ограничивает
+func (h *history) get(ip string, from, to time.Time) []Sample {
+	h.lock.Lock()
+	ring, ok := h.bySource[ip]
+	var samples []Sample
+	if ok {
+		samples = ring.Items()
+	}
+	h.lock.Unlock()
+
+	result := make([]Sample, 0, len(samples))
+	for _, s := range samples {
+		if !from.IsZero() && s.Time.Before(from) || !to.IsZero() && s.Time.After(to) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// Downsample усреднение сэмплов по интервалам step, время сэмпла - начало интервала
+func Downsample(samples []Sample, step time.Duration) []Sample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	var result []Sample
+	var n float64
+	for _, s := range samples {
+		bucket := s.Time.Truncate(step)
+		if len(result) == 0 || !result[len(result)-1].Time.Equal(bucket) {
+			result = append(result, Sample{Time: bucket})
+			n = 0
+		}
+		last := &result[len(result)-1]
+		n++
+		last.Bitrate += (s.Bitrate - last.Bitrate) / n
+		last.Pps += (s.Pps - last.Pps) / n
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+package statistic
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var base = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func sample(sec int, bitrate, pps float64) Sample {
+	return Sample{Time: base.Add(time.Duration(sec) * time.Second), Bitrate: bitrate, Pps: pps}
+}
+
+func TestDownsample(t *testing.T) {
+	samples := []Sample{sample(0, 100, 10), sample(1, 200, 20), sample(2, 300, 30), sample(5, 600, 60), sample(11, 50, 5)}
+
+	tests := []struct {
+		name    string
+		samples []Sample
+		step    time.Duration
+		want    []Sample
+	}{
+		{name: "без шага", samples: samples, step: 0, want: samples},
+		{name: "пусто", samples: nil, step: time.Second, want: nil},
+		{name: "шаг равен опросу", samples: samples[:3], step: time.Second, want: samples[:3]},
+		{
+			name:    "среднее по интервалам",
+			samples: samples,
+			step:    5 * time.Second,
+			want:    []Sample{sample(0, 200, 20), sample(5, 600, 60), sample(10, 50, 5)},
+		},
+		{
+			name:    "интервалы без сэмплов пропускаются",
+			samples: []Sample{sample(0, 100, 10), sample(30, 300, 30)},
+			step:    10 * time.Second,
+			want:    []Sample{sample(0, 100, 10), sample(30, 300, 30)},
+		},
+		{
+			name:    "время - начало интервала",
+			samples: []Sample{sample(61, 100, 10), sample(119, 300, 30)},
+			step:    time.Minute,
+			want:    []Sample{sample(60, 200, 20)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Downsample(tt.samples, tt.step); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	for sec := 0; sec < 4; sec++ {
+		stats := map[string]Stats{"233.0.0.1": {Bitrate: float64(sec), Pps: float64(sec)}}
+		if sec < 2 {
+			stats["233.0.0.2"] = Stats{Bitrate: 1}
+		}
+		h.add(base.Add(time.Duration(sec)*time.Second), stats)
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		from, to time.Time
+		want     []Sample
+	}{
+		{name: "последние size опросов", ip: "233.0.0.1", want: []Sample{sample(1, 1, 1), sample(2, 2, 2), sample(3, 3, 3)}},
+		{name: "с from", ip: "233.0.0.1", from: base.Add(2 * time.Second), want: []Sample{sample(2, 2, 2), sample(3, 3, 3)}},
+		{name: "по to", ip: "233.0.0.1", to: base.Add(2 * time.Second), want: []Sample{sample(1, 1, 1), sample(2, 2, 2)}},
+		{name: "пропавший источник удален", ip: "233.0.0.2", want: []Sample{}},
+		{name: "неизвестный источник", ip: "233.0.0.3", want: []Sample{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.get(tt.ip, tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
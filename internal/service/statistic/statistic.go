@@ -1,28 +1,117 @@
 package statistic
 
 import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
 	"github.com/jashakimov/multiswitcher/internal/utils"
 	"gopkg.in/errgo.v2/fmt/errors"
 	"math/big"
-	"os/exec"
-	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+var log = logging.For(logging.Statistic)
+
 type Service interface {
 	GetBytesByIP(ip string) (*big.Int, error)
+	GetStatsByIP(ip string) (Stats, error)
+	GetStatsByHandle(handle uint32) (Stats, error)
+	GetSourceStatsByIP(ip string) (Stats, error)
+	GetOutputStatsByIP(route string) (Stats, error)
 	DelBytesByIP(ip string)
+	IsSourceAlive(ip string) (bool, error)
+	LastPoll() time.Time
+	History(ip string, from, to time.Time) []Sample
+}
+
+// Counter байты и пакеты форвардинга не из tc
+type Counter struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+// Key ключ счетчиков источника связки filterId. Один поток может быть источником нескольких связок,
+// у каждой свои фильтры и свои счетчики, поэтому ключа потока, traffic_control.Key, недостаточно
+func Key(filterId int, stream string) string {
+	return strconv.Itoa(filterId) + " " + stream
+}
+
+// Owners связки, которым принадлежат фильтры на link, по prio фильтра
+type Owners func(link string) map[int]int
+
+// Forwarder форвардинг без nat фильтров: сокетами в userspace или классификатором eBPF. Forwarded - переданное
+// с активного источника, как счетчик nat фильтра, Received - принятое от каждого источника,
+// как счетчик зеркалирования. Ключ - Key связки и потока источника
+type Forwarder interface {
+	Forwarded() map[string]Counter
+	Received() map[string]Counter
+}
+
+// OutputCounter отправленное в дополнительные выходы связок форвардингом в userspace, ключ - route выхода
+type OutputCounter interface {
+	Outputs() map[string]Counter
+}
+
+// Stats счетчики фильтра, IP - ключ потока фильтра: адрес из match ip dst и уточнения источника, порта и VLAN.
+// Методы ...ByIP источников принимают Key связки и этого потока.
+// Bitrate (бит/с) и Pps считаются по разнице с предыдущим опросом
+type Stats struct {
+	IP         string  `json:"ip"`
+	Handle     uint32  `json:"handle"`
+	Priority   int     `json:"priority"`
+	Bytes      uint64  `json:"bytes"`
+	Packets    uint64  `json:"packets"`
+	Drops      uint32  `json:"drops"`
+	Overlimits uint32  `json:"overlimits"`
+	Bitrate    float64 `json:"bitrate"`
+	Pps        float64 `json:"pps"`
 }
 
 type service struct {
-	cache         *utils.SyncMap[string, *big.Int]
-	interfaceName string
+	tc                  traffic_control.TrafficControl
+	owners              Owners
+	byIP                *utils.SyncMap[string, Stats]
+	byHandle            *utils.SyncMap[uint32, Stats]
+	mirrorByIP          *utils.SyncMap[string, Stats]
+	outputByIP          *utils.SyncMap[string, Stats]
+	alive               *utils.SyncMap[string, bool]
+	interfaceName       string
+	mirrorInterfaceName string
+	history             *history
+	forwarders          []Forwarder
+	outputs             []OutputCounter
+	lock                sync.Mutex
+	lastPoll            time.Time
 }
 
-func NewService(linkName string, timeoutMs int) Service {
+// NewService linkName - интерфейс с nat фильтрами, mirrorLinkName - интерфейс с зеркалированием,
+// по счетчикам зеркалирования видно, идет ли поток от каждого источника.
+// historySize - сколько последних опросов битрейта хранится на источник.
+// Счетчики связок с форвардингом в обход nat фильтров берутся из forwarders,
+// счетчики выходов - из копий nat фильтров и outputs. Фильтры без связки в owners не учитываются
+func NewService(
+	tc traffic_control.TrafficControl,
+	owners Owners,
+	linkName, mirrorLinkName string,
+	timeoutMs, historySize int,
+	outputs []OutputCounter,
+	forwarders ...Forwarder,
+) Service {
 	s := &service{
-		interfaceName: linkName,
-		cache:         utils.NewSyncMap[string, *big.Int](),
+		tc:                  tc,
+		owners:              owners,
+		forwarders:          forwarders,
+		outputs:             outputs,
+		interfaceName:       linkName,
+		mirrorInterfaceName: mirrorLinkName,
+		byIP:                utils.NewSyncMap[string, Stats](),
+		byHandle:            utils.NewSyncMap[uint32, Stats](),
+		mirrorByIP:          utils.NewSyncMap[string, Stats](),
+		outputByIP:          utils.NewSyncMap[string, Stats](),
+		alive:               utils.NewSyncMap[string, bool](),
+		history:             newHistory(historySize),
 	}
 
 	go s.readStats(timeoutMs)
@@ -32,35 +121,214 @@ func NewService(linkName string, timeoutMs int) Service {
 }
 
 func (s *service) GetBytesByIP(ip string) (*big.Int, error) {
-	if bytes, ok := s.cache.Get(ip); ok {
-		return bytes, nil
+	stats, err := s.GetStatsByIP(ip)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.Newf("Uknown IP: %s\n", ip)
+	return new(big.Int).SetUint64(stats.Bytes), nil
+}
+
+func (s *service) GetStatsByIP(ip string) (Stats, error) {
+	if stats, ok := s.byIP.Get(ip); ok {
+		return stats, nil
+	}
+	return Stats{}, errors.Newf("Uknown IP: %s\n", ip)
+}
+
+func (s *service) GetStatsByHandle(handle uint32) (Stats, error) {
+	if stats, ok := s.byHandle.Get(handle); ok {
+		return stats, nil
+	}
+	return Stats{}, errors.Newf("Uknown handle: %x\n", handle)
+}
+
+// GetSourceStatsByIP счетчики зеркалирования источника, есть у всех источников, а не только у активного
+func (s *service) GetSourceStatsByIP(ip string) (Stats, error) {
+	if stats, ok := s.mirrorByIP.Get(ip); ok {
+		return stats, nil
+	}
+	return Stats{}, errors.Newf("Нет зеркалирования для IP: %s\n", ip)
+}
+
+// GetOutputStatsByIP счетчики дополнительного выхода связки по его route
+func (s *service) GetOutputStatsByIP(route string) (Stats, error) {
+	if stats, ok := s.outputByIP.Get(route); ok {
+		return stats, nil
+	}
+	return Stats{}, errors.Newf("Нет выхода: %s\n", route)
+}
+
+// LastPoll время последнего успешного опроса nat фильтров
+func (s *service) LastPoll() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.lastPoll
+}
+
+// History битрейт и pps источника по счетчикам зеркалирования
+func (s *service) History(ip string, from, to time.Time) []Sample {
+	return s.history.get(ip, from, to)
 }
 
 func (s *service) DelBytesByIP(ip string) {
-	s.cache.Del(ip)
+	if stats, ok := s.byIP.Get(ip); ok {
+		s.byHandle.Del(stats.Handle)
+	}
+	s.byIP.Del(ip)
+}
+
+func (s *service) IsSourceAlive(ip string) (bool, error) {
+	if alive, ok := s.alive.Get(ip); ok {
+		return alive, nil
+	}
+	return false, errors.Newf("Нет зеркалирования для IP: %s\n", ip)
 }
 
 func (s *service) readStats(timeoutMs int) {
 	t := time.NewTicker(time.Duration(timeoutMs) * time.Millisecond)
+	var mirrorPoll, poll time.Time
 
-	for range t.C {
-		cmd := exec.Command("tc", "-s", "-pretty", "filter", "show", "ingress", "dev", s.interfaceName)
-		// нам нужна инфа в скобках (match[1] и match[2])
-		reg := regexp.MustCompile(`dst (\S+)/\S+\n.+\n.+\n.+\n.+Sent (\d+)`)
+	for now := range t.C {
+		mirrorPoll = s.readMirrorStats(mirrorPoll, now)
 
-		statsOutput, err := cmd.CombinedOutput()
+		rules, err := s.tc.List(s.interfaceName)
 		if err != nil {
-			panic(err)
+			log.Error("Ошибка чтения статистики", logging.Err(err))
+			continue
+		}
+
+		owners := s.owners(s.interfaceName)
+		byIP := make(map[string]Stats, len(rules))
+		byHandle := make(map[uint32]Stats, len(rules))
+		outputs := make(map[string]Stats)
+		for _, rule := range rules {
+			// зеркалирование и чужие фильтры нас не интересуют
+			id, ok := owners[rule.Priority]
+			if rule.NatTo == "" || !ok {
+				continue
+			}
+			stats := fromRule(rule)
+			if prev, ok := s.byHandle.Get(stats.Handle); ok {
+				stats.setRate(prev, now.Sub(poll))
+			}
+			byIP[Key(id, stats.IP)] = stats
+			byHandle[stats.Handle] = stats
+			// копия в выход - mirred того же фильтра, при переключении счетчик начинается заново, как у фильтра
+			for _, c := range rule.Copies {
+				out := Stats{
+					IP:       c.To,
+					Handle:   rule.Handle,
+					Priority: rule.Priority,
+					Bytes:    c.Stats.Bytes,
+					Packets:  c.Stats.Packets,
+					Drops:    c.Stats.Drops,
+				}
+				if prev, ok := s.outputByIP.Get(out.IP); ok {
+					out.setRate(prev, now.Sub(poll))
+				}
+				outputs[out.IP] = out
+			}
+		}
+		// у форвардинга в обход nat нет handle, счетчик не сбрасывается при переключении
+		for _, forwarder := range s.forwarders {
+			for key, c := range forwarder.Forwarded() {
+				stats := Stats{IP: stream(key), Bytes: c.Bytes, Packets: c.Packets}
+				if prev, ok := s.byIP.Get(key); ok {
+					stats.setRate(prev, now.Sub(poll))
+				}
+				byIP[key] = stats
+			}
 		}
+		for _, counter := range s.outputs {
+			for route, c := range counter.Outputs() {
+				out := Stats{IP: route, Bytes: c.Bytes, Packets: c.Packets}
+				if prev, ok := s.outputByIP.Get(route); ok {
+					out.setRate(prev, now.Sub(poll))
+				}
+				outputs[route] = out
+			}
+		}
+		s.byIP.Reset(byIP)
+		s.byHandle.Reset(byHandle)
+		s.outputByIP.Reset(outputs)
 
-		matches := reg.FindAllStringSubmatch(string(statsOutput), -1)
+		poll = now
+		s.lock.Lock()
+		s.lastPoll = now
+		s.lock.Unlock()
+	}
+}
+
+// readMirrorStats источник жив, если счетчик зеркалирования вырос с прошлого опроса
+func (s *service) readMirrorStats(prevPoll, now time.Time) time.Time {
+	rules, err := s.tc.List(s.mirrorInterfaceName)
+	if err != nil {
+		log.Error("Ошибка чтения статистики зеркалирования", logging.Err(err))
+		return prevPoll
+	}
 
-		for _, match := range matches {
-			bytes := new(big.Int)
-			bytes.SetString(match[2], 10)
-			s.cache.Set(match[1], bytes)
+	owners := s.owners(s.mirrorInterfaceName)
+	current := make(map[string]Stats, len(rules))
+	alive := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		id, ok := owners[rule.Priority]
+		if rule.MirrorTo == "" || !ok {
+			continue
 		}
+		stats := fromRule(rule)
+		key := Key(id, stats.IP)
+		prev, ok := s.mirrorByIP.Get(key)
+		if ok {
+			stats.setRate(prev, now.Sub(prevPoll))
+		}
+		current[key] = stats
+		alive[key] = ok && stats.Bytes > prev.Bytes
+	}
+	for _, forwarder := range s.forwarders {
+		for key, c := range forwarder.Received() {
+			stats := Stats{IP: stream(key), Bytes: c.Bytes, Packets: c.Packets}
+			prev, ok := s.mirrorByIP.Get(key)
+			if ok {
+				stats.setRate(prev, now.Sub(prevPoll))
+			}
+			current[key] = stats
+			alive[key] = ok && stats.Bytes > prev.Bytes
+		}
+	}
+	s.mirrorByIP.Reset(current)
+	s.alive.Reset(alive)
+	s.history.add(now, current)
+
+	return now
+}
+
+// stream ключ потока из Key
+func stream(key string) string {
+	if i := strings.IndexByte(key, ' '); i >= 0 {
+		return key[i+1:]
+	}
+	return key
+}
+
+func fromRule(rule traffic_control.Rule) Stats {
+	return Stats{
+		IP:         rule.Key(),
+		Handle:     rule.Handle,
+		Priority:   rule.Priority,
+		Bytes:      rule.Stats.Bytes,
+		Packets:    rule.Stats.Packets,
+		Drops:      rule.Stats.Drops,
+		Overlimits: rule.Stats.Overlimits,
+	}
+}
+
+// setRate скорость по разнице с предыдущим опросом, после переустановки фильтра счетчик
+// начинается заново и скорость за этот опрос не считается
+func (s *Stats) setRate(prev Stats, elapsed time.Duration) {
+	if elapsed <= 0 || s.Handle != prev.Handle || s.Bytes < prev.Bytes || s.Packets < prev.Packets {
+		return
 	}
+	s.Bitrate = float64(s.Bytes-prev.Bytes) * 8 / elapsed.Seconds()
+	s.Pps = float64(s.Packets-prev.Packets) / elapsed.Seconds()
 }
@@ -0,0 +1,22 @@
+package stream
+
+import "github.com/jashakimov/multiswitcher/internal/service/filter"
+
+type notifyingState struct {
+	filter.StateStore
+	hub Hub
+}
+
+// NotifyingState состояние сохраняется при каждом переключении и смене флагов,
+// после сохранения изменения сразу рассылаются подписчикам
+func NotifyingState(state filter.StateStore, hub Hub) filter.StateStore {
+	return &notifyingState{
+		StateStore: state,
+		hub:        hub,
+	}
+}
+
+func (s *notifyingState) Save() {
+	s.StateStore.Save()
+	s.hub.Notify()
+}
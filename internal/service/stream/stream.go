@@ -0,0 +1,225 @@
+package stream
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer сколько сообщений может ждать медленный подписчик, дальше он отключается
+const subscriberBuffer = 256
+
+const (
+	EventUpdate  = "update"
+	EventRemoved = "removed"
+)
+
+type SourceState struct {
+	Name    string  `json:"name"`
+	IP      string  `json:"ip"`
+	Active  bool    `json:"active"`
+	Alive   bool    `json:"alive"`
+	Bytes   uint64  `json:"bytes"`
+	Bitrate float64 `json:"bitrate"`
+}
+
+// FilterState то, что видит пульт: активный источник, флаги и счетчики
+type FilterState struct {
+	Id               int    `json:"id"`
+	Title            string `json:"title"`
+	DstIP            string `json:"dstIP"`
+	ActiveSource     string `json:"activeSource"`
+	AutoSwitch       bool   `json:"autoSwitch"`
+	IsIgmpOn         bool   `json:"isIgmpOn"`
+	IsReturnToMaster bool   `json:"isReturnToMaster"`
+	// PendingRevert отсчет до возврата на мастер
+	PendingRevert *filter.PendingRevert `json:"pendingRevert,omitempty"`
+	Lockout       *filter.Lockout       `json:"lockout,omitempty"`
+	Bytes         uint64                `json:"bytes"`
+	Bitrate       float64               `json:"bitrate"`
+	Sources       []SourceState         `json:"sources"`
+}
+
+// Message изменение связки, у removed заполнен только Id
+type Message struct {
+	Event string
+	State FilterState
+}
+
+// Hub рассылает изменения состояния связок подписчикам
+type Hub interface {
+	// Notify состояние могло измениться, разослать разницу не дожидаясь опроса счетчиков
+	Notify()
+	// Subscribe снимок связок ids (пустой - все) и канал изменений, канал закрывается при отписке
+	// или если подписчик не успевает читать
+	Subscribe(ids []int) ([]FilterState, <-chan Message, func())
+}
+
+type subscriber struct {
+	ids map[int]struct{}
+	ch  chan Message
+}
+
+type hub struct {
+	lock        sync.Mutex
+	db          *utils.SyncMap[int, *filter.Filter]
+	statManager statistic.Service
+	notify      chan struct{}
+	last        map[int]FilterState
+	subscribers map[*subscriber]struct{}
+}
+
+// NewHub изменения рассылаются по Notify и каждые intervalMs, чтобы успевали счетчики
+func NewHub(db *utils.SyncMap[int, *filter.Filter], statManager statistic.Service, intervalMs int) Hub {
+	h := &hub{
+		db:          db,
+		statManager: statManager,
+		notify:      make(chan struct{}, 1),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+	h.last = h.snapshot()
+
+	go h.run(time.Duration(intervalMs) * time.Millisecond)
+
+	return h
+}
+
+func (h *hub) Notify() {
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *hub) Subscribe(ids []int) ([]FilterState, <-chan Message, func()) {
+	sub := &subscriber{
+		ids: make(map[int]struct{}, len(ids)),
+		ch:  make(chan Message, subscriberBuffer),
+	}
+	for _, id := range ids {
+		sub.ids[id] = struct{}{}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.subscribers[sub] = struct{}{}
+	states := make([]FilterState, 0, len(h.last))
+	for _, state := range h.last {
+		if sub.wants(state.Id) {
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Id < states[j].Id
+	})
+
+	unsubscribe := func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.remove(sub)
+	}
+	return states, sub.ch, unsubscribe
+}
+
+func (h *hub) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-h.notify:
+		}
+		h.broadcast(h.snapshot())
+	}
+}
+
+// broadcast рассылка связок, изменившихся с прошлого снимка
+func (h *hub) broadcast(current map[int]FilterState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var messages []Message
+	for id, state := range current {
+		if last, ok := h.last[id]; !ok || !reflect.DeepEqual(last, state) {
+			messages = append(messages, Message{Event: EventUpdate, State: state})
+		}
+	}
+	for id := range h.last {
+		if _, ok := current[id]; !ok {
+			messages = append(messages, Message{Event: EventRemoved, State: FilterState{Id: id}})
+		}
+	}
+	h.last = current
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].State.Id < messages[j].State.Id
+	})
+
+subscribers:
+	for sub := range h.subscribers {
+		for _, msg := range messages {
+			if !sub.wants(msg.State.Id) {
+				continue
+			}
+			select {
+			case sub.ch <- msg:
+			default:
+				h.remove(sub)
+				continue subscribers
+			}
+		}
+	}
+}
+
+func (h *hub) remove(sub *subscriber) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func (h *hub) snapshot() map[int]FilterState {
+	states := make(map[int]FilterState)
+	for id, f := range h.db.Values() {
+		actual := f.GetActual()
+		state := FilterState{
+			Id:               id,
+			Title:            f.GetTitle(),
+			DstIP:            f.DstIP,
+			ActiveSource:     actual.Name,
+			AutoSwitch:       f.GetAutoSwitch(),
+			IsIgmpOn:         f.IsIgmpOn,
+			IsReturnToMaster: f.GetReturnToMaster(),
+			PendingRevert:    f.GetPendingRevert(),
+			Lockout:          f.GetLockout(),
+		}
+		if stats, err := h.statManager.GetStatsByIP(f.StatKey(actual)); err == nil {
+			state.Bytes = stats.Bytes
+			state.Bitrate = stats.Bitrate
+		}
+		for _, src := range f.Sources {
+			srcState := SourceState{Name: src.Name, IP: src.IP, Active: src == actual}
+			if stats, err := h.statManager.GetSourceStatsByIP(f.StatKey(src)); err == nil {
+				srcState.Bytes = stats.Bytes
+				srcState.Bitrate = stats.Bitrate
+			}
+			srcState.Alive, _ = h.statManager.IsSourceAlive(f.StatKey(src))
+			state.Sources = append(state.Sources, srcState)
+		}
+		states[id] = state
+	}
+	return states
+}
+
+func (s *subscriber) wants(id int) bool {
+	if len(s.ids) == 0 {
+		return true
+	}
+	_, ok := s.ids[id]
+	return ok
+}
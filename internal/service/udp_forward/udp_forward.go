@@ -0,0 +1,258 @@
+package udp_forward
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/multicast"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/traffic_control"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var log = logging.For(logging.UDPForward)
+
+// Forward форвардинг одной связки: на группы Sources подписываются сокеты на InLink,
+// в Route через OutLink и в дополнительные выходы Outputs уходят пакеты только с сокета активного источника Active
+type Forward struct {
+	Id      int
+	Sources []multicast.Group
+	Active  int
+	Port    int
+	Route   string
+	InLink  string
+	OutLink string
+	TTL     int
+	Outputs []multicast.Output
+}
+
+type Service interface {
+	statistic.Forwarder
+	statistic.OutputCounter
+	Start(f Forward) error
+	// Switch смена сокета, который отправляется в route, без переподписки на группы
+	Switch(id, active int) error
+	// SetOutputs замена дополнительных выходов, без переподписки на группы
+	SetOutputs(id int, outputs []multicast.Output) error
+	Stop(id int)
+	Shutdown()
+}
+
+// leg сокет одного источника и его счетчики, key - ключ потока источника в статистике
+type leg struct {
+	key       string
+	conn      net.PacketConn
+	received  counter
+	forwarded counter
+}
+
+type counter struct {
+	bytes   atomic.Uint64
+	packets atomic.Uint64
+}
+
+func (c *counter) add(n int) {
+	c.bytes.Add(uint64(n))
+	c.packets.Add(1)
+}
+
+func (c *counter) get() statistic.Counter {
+	return statistic.Counter{Bytes: c.bytes.Load(), Packets: c.packets.Load()}
+}
+
+// Sink разбор принятого потока: прослушка возврата на мастер, проверки TS и RTP.
+// Зеркалирования у связок с форвардингом сокетами нет, поток до захвата не доходит
+type Sink func(key string, payload []byte, at time.Time)
+
+type worker struct {
+	legs   []*leg
+	active atomic.Int32
+	out    *multicast.Sender
+	dst    *net.UDPAddr
+	fanout *multicast.Fanout
+	sink   Sink
+	done   sync.WaitGroup
+}
+
+type service struct {
+	lock    sync.Mutex
+	workers map[int]*worker
+	sink    Sink
+}
+
+// NewService sink получает все принятое от источников, nil - без разбора
+func NewService(sink Sink) Service {
+	return &service{workers: make(map[int]*worker), sink: sink}
+}
+
+// Start подписка на группы всех источников, повторный Start перезапускает связку
+func (s *service) Start(f Forward) error {
+	s.Stop(f.Id)
+	if f.Active < 0 || f.Active >= len(f.Sources) {
+		return errors.Newf("нет источника %d", f.Active)
+	}
+
+	out, err := multicast.NewSender(f.OutLink, f.Route, f.TTL)
+	if err != nil {
+		return errors.Newf("отправка в %s: %s", f.Route, err)
+	}
+	w := &worker{
+		out:    out,
+		dst:    &net.UDPAddr{IP: net.ParseIP(f.Route), Port: f.Port},
+		fanout: multicast.NewFanout(f.Port, f.TTL),
+		sink:   s.sink,
+	}
+	w.active.Store(int32(f.Active))
+	if err := w.fanout.Set(f.Outputs); err != nil {
+		w.close()
+		return err
+	}
+	for _, g := range f.Sources {
+		key := traffic_control.Key(g.IP, g.Source, 0, 0)
+		conn, err := multicast.ListenGroup(f.InLink, g, f.Port)
+		if err != nil {
+			w.close()
+			return errors.Newf("подписка на %s: %s", key, err)
+		}
+		w.legs = append(w.legs, &leg{key: key, conn: conn})
+	}
+
+	w.done.Add(len(w.legs))
+	for i := range w.legs {
+		go w.receive(i)
+	}
+
+	s.lock.Lock()
+	s.workers[f.Id] = w
+	s.lock.Unlock()
+	log.Info("Запуск форвардинга", logging.KeyFilterID, f.Id, logging.KeyDstIP, f.Route,
+		logging.KeySourceIP, w.legs[f.Active].key, "port", f.Port)
+	return nil
+}
+
+func (s *service) Switch(id, active int) error {
+	s.lock.Lock()
+	w, ok := s.workers[id]
+	s.lock.Unlock()
+	if !ok {
+		return errors.Newf("форвардинг связки %d не запущен", id)
+	}
+	if active < 0 || active >= len(w.legs) {
+		return errors.Newf("нет источника %d", active)
+	}
+	w.active.Store(int32(active))
+	return nil
+}
+
+func (s *service) SetOutputs(id int, outputs []multicast.Output) error {
+	s.lock.Lock()
+	w, ok := s.workers[id]
+	s.lock.Unlock()
+	if !ok {
+		return errors.Newf("форвардинг связки %d не запущен", id)
+	}
+	return w.fanout.Set(outputs)
+}
+
+func (s *service) Stop(id int) {
+	s.lock.Lock()
+	w, ok := s.workers[id]
+	delete(s.workers, id)
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	w.close()
+	w.done.Wait()
+	log.Info("Остановка форвардинга", logging.KeyFilterID, id)
+}
+
+func (s *service) Shutdown() {
+	s.lock.Lock()
+	ids := make([]int, 0, len(s.workers))
+	for id := range s.workers {
+		ids = append(ids, id)
+	}
+	s.lock.Unlock()
+	for _, id := range ids {
+		s.Stop(id)
+	}
+}
+
+// Forwarded переданное в route с активного источника каждой связки
+func (s *service) Forwarded() map[string]statistic.Counter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	counters := make(map[string]statistic.Counter)
+	for id, w := range s.workers {
+		l := w.legs[w.active.Load()]
+		counters[statistic.Key(id, l.key)] = l.forwarded.get()
+	}
+	return counters
+}
+
+// Received принятое от всех источников
+func (s *service) Received() map[string]statistic.Counter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	counters := make(map[string]statistic.Counter)
+	for id, w := range s.workers {
+		for _, l := range w.legs {
+			counters[statistic.Key(id, l.key)] = l.received.get()
+		}
+	}
+	return counters
+}
+
+// Outputs отправленное в дополнительные выходы всех связок
+func (s *service) Outputs() map[string]statistic.Counter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	counters := make(map[string]statistic.Counter)
+	for _, w := range s.workers {
+		for route, sent := range w.fanout.Sent() {
+			counters[route] = statistic.Counter{Bytes: sent.Bytes, Packets: sent.Packets}
+		}
+	}
+	return counters
+}
+
+// close закрытие сокетов, чтение источников завершается ошибкой
+func (w *worker) close() {
+	for _, l := range w.legs {
+		l.conn.Close()
+	}
+	w.out.Close()
+	w.fanout.Close()
+}
+
+// receive чтение сокета источника до его закрытия, в route уходит только активный
+func (w *worker) receive(i int) {
+	defer w.done.Done()
+	l := w.legs[i]
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		l.received.add(n)
+		if w.sink != nil {
+			w.sink(l.key, buf[:n], time.Now())
+		}
+		if int(w.active.Load()) != i {
+			continue
+		}
+		w.fanout.Send(buf[:n])
+		if err := w.out.Send(buf[:n], w.dst); err != nil {
+			log.Debug("Ошибка отправки", logging.KeyDstIP, w.dst.IP.String(), logging.Err(err))
+			continue
+		}
+		l.forwarded.add(n)
+	}
+}
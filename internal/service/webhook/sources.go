@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"github.com/jashakimov/multiswitcher/internal/journal"
+	"time"
+)
+
+// watchSources события пропадания и восстановления источников по счетчикам зеркалирования
+// и блокировки связок защитой от переключений. Первый опрос только запоминает состояние,
+// all_sources_down отправляется один раз, пока не восстановится хотя бы один источник
+func (s *service) watchSources(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	alive := make(map[string]bool)
+	allDown := make(map[int]bool)
+	var locked map[int]bool
+	for range t.C {
+		s.watchLockouts(&locked)
+		seen := make(map[string]bool)
+		for id, f := range s.db.Values() {
+			down := 0
+			for _, src := range f.Sources {
+				isAlive, err := s.statManager.IsSourceAlive(f.StatKey(src))
+				if err != nil {
+					continue
+				}
+				seen[src.Key()] = isAlive
+				if !isAlive {
+					down++
+				}
+				was, known := alive[src.Key()]
+				if !known || was == isAlive {
+					continue
+				}
+				e := Event{
+					Type:     EventSourceRecovered,
+					Time:     time.Now(),
+					FilterId: id,
+					Title:    f.GetTitle(),
+					Route:    f.DstIP,
+					Source:   src.Name,
+					SourceIP: src.IP,
+				}
+				if !isAlive {
+					e.Type = EventSourceLost
+				}
+				s.Emit(e)
+			}
+
+			isAllDown := down == len(f.Sources)
+			if isAllDown && !allDown[id] {
+				s.Emit(Event{Type: EventAllSourcesDown, Time: time.Now(), FilterId: id, Title: f.GetTitle(), Route: f.DstIP})
+			}
+			allDown[id] = isAllDown
+		}
+		alive = seen
+	}
+}
+
+// watchLockouts flap_lockout при блокировке связки и lockout_cleared при снятии блокировки
+func (s *service) watchLockouts(locked *map[int]bool) {
+	current := make(map[int]bool)
+	for id, f := range s.db.Values() {
+		lockout := f.GetLockout()
+		current[id] = lockout != nil
+		if *locked == nil || (*locked)[id] == current[id] {
+			continue
+		}
+		e := Event{Type: EventLockoutCleared, Time: time.Now(), FilterId: id, Title: f.GetTitle(), Route: f.DstIP}
+		if lockout != nil {
+			e.Type = EventFlapLockout
+			e.Source = lockout.Source
+			e.Lockout = lockout
+		}
+		s.Emit(e)
+	}
+	*locked = current
+}
+
+type notifyingJournal struct {
+	journal.Journal
+	service Service
+}
+
+// Journal журнал, который каждое переключение дополнительно отправляет в webhook.
+// Неудачное переключение уходит как switch_failed: источник остался прежним, в Error - причина
+func Journal(j journal.Journal, s Service) journal.Journal {
+	return &notifyingJournal{
+		Journal: j,
+		service: s,
+	}
+}
+
+func (j *notifyingJournal) Add(e journal.Event) {
+	j.Journal.Add(e)
+	event := Event{
+		Type:     EventSwitch,
+		Time:     e.Time,
+		FilterId: e.FilterId,
+		Title:    e.Title,
+		Route:    e.Route,
+		Source:   e.To,
+		SourceIP: e.ToIP,
+		Switch:   &e,
+	}
+	if e.Error != "" {
+		event.Type = EventSwitchFailed
+		event.Source, event.SourceIP = e.From, e.FromIP
+		event.Error = e.Error
+	}
+	j.service.Emit(event)
+}
@@ -0,0 +1,314 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/journal"
+	"github.com/jashakimov/multiswitcher/internal/logging"
+	"github.com/jashakimov/multiswitcher/internal/service/filter"
+	"github.com/jashakimov/multiswitcher/internal/service/statistic"
+	"github.com/jashakimov/multiswitcher/internal/utils"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var log = logging.For(logging.Webhook)
+
+const (
+	EventSwitch          = "switch"
+	EventSwitchFailed    = "switch_failed"
+	EventSourceLost      = "source_lost"
+	EventSourceRecovered = "source_recovered"
+	EventAllSourcesDown  = "all_sources_down"
+	EventFlapLockout     = "flap_lockout"
+	EventLockoutCleared  = "lockout_cleared"
+)
+
+const (
+	defaultRetries   = 3
+	defaultTimeoutMs = 5000
+	queueSize        = 1000
+	recentDeliveries = 50
+	firstBackoff     = time.Second
+	maxBackoff       = time.Minute
+)
+
+// Event то, что уходит в webhook. Без шаблона отправляется как есть в JSON
+type Event struct {
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	FilterId int             `json:"filterId"`
+	Title    string          `json:"title"`
+	Route    string          `json:"route"`
+	Source   string          `json:"source,omitempty"`
+	SourceIP string          `json:"sourceIP,omitempty"`
+	Switch   *journal.Event  `json:"switch,omitempty"`
+	Lockout  *filter.Lockout `json:"lockout,omitempty"`
+	// Error причина неудачного переключения у switch_failed
+	Error string `json:"error,omitempty"`
+}
+
+// ErrTemplateJSON шаблон дал тело, которое не является JSON
+var ErrTemplateJSON = errors.New("шаблон дал невалидный JSON")
+
+type Delivery struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	FilterId int       `json:"filterId"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// TargetStatus состояние доставки по одному webhook, секрет не отдается
+type TargetStatus struct {
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	Events      []string   `json:"events"`
+	Delivered   uint64     `json:"delivered"`
+	Failed      uint64     `json:"failed"`
+	Dropped     uint64     `json:"dropped"`
+	Queued      int        `json:"queued"`
+	LastSuccess time.Time  `json:"lastSuccess"`
+	LastError   string     `json:"lastError,omitempty"`
+	Recent      []Delivery `json:"recent"`
+}
+
+type Service interface {
+	Emit(e Event)
+	Status() []TargetStatus
+}
+
+type target struct {
+	cfg      config.Webhook
+	events   map[string]struct{}
+	template *template.Template
+	client   *http.Client
+	queue    chan Event
+
+	lock        sync.Mutex
+	delivered   uint64
+	failed      uint64
+	dropped     uint64
+	lastSuccess time.Time
+	lastError   string
+	recent      *utils.Ring[Delivery]
+}
+
+type service struct {
+	targets     []*target
+	db          *utils.SyncMap[int, *filter.Filter]
+	statManager statistic.Service
+}
+
+// NewService intervalMs - частота проверки источников для source_lost, source_recovered и all_sources_down
+func NewService(
+	webhooks []config.Webhook,
+	db *utils.SyncMap[int, *filter.Filter],
+	statManager statistic.Service,
+	intervalMs int,
+) (Service, error) {
+	s := &service{
+		db:          db,
+		statManager: statManager,
+	}
+	for i, cfg := range webhooks {
+		t, err := newTarget(cfg)
+		if err != nil {
+			return nil, errors.Newf("webhook %d (%s): %s", i+1, cfg.URL, err)
+		}
+		s.targets = append(s.targets, t)
+	}
+
+	for _, t := range s.targets {
+		go t.run()
+	}
+	if len(s.targets) > 0 {
+		go s.watchSources(time.Duration(intervalMs) * time.Millisecond)
+	}
+
+	return s, nil
+}
+
+func newTarget(cfg config.Webhook) (*target, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.URL
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = defaultRetries
+	}
+	if cfg.TimeoutMs == 0 {
+		cfg.TimeoutMs = defaultTimeoutMs
+	}
+
+	t := &target{
+		cfg:    cfg,
+		events: make(map[string]struct{}),
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond},
+		queue:  make(chan Event, queueSize),
+		recent: utils.NewRing[Delivery](recentDeliveries),
+	}
+	for _, event := range cfg.Events {
+		switch event {
+		case EventSwitch, EventSwitchFailed, EventSourceLost, EventSourceRecovered, EventAllSourcesDown, EventFlapLockout, EventLockoutCleared:
+			t.events[event] = struct{}{}
+		default:
+			return nil, errors.Newf("неизвестное событие '%s'", event)
+		}
+	}
+	if cfg.Template != "" {
+		tmpl, err := template.New(cfg.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		t.template = tmpl
+	}
+	return t, nil
+}
+
+// Emit ставит событие в очереди подписанных webhook, при переполненной очереди событие теряется
+func (s *service) Emit(e Event) {
+	for _, t := range s.targets {
+		if !t.wants(e.Type) {
+			continue
+		}
+		select {
+		case t.queue <- e:
+		default:
+			t.lock.Lock()
+			t.dropped++
+			t.lock.Unlock()
+			log.Warn("Очередь webhook переполнена, событие потеряно",
+				"webhook", t.cfg.Name, "event", e.Type, logging.KeyFilterID, e.FilterId)
+		}
+	}
+}
+
+func (s *service) Status() []TargetStatus {
+	statuses := make([]TargetStatus, 0, len(s.targets))
+	for _, t := range s.targets {
+		t.lock.Lock()
+		statuses = append(statuses, TargetStatus{
+			Name:        t.cfg.Name,
+			URL:         t.cfg.URL,
+			Events:      t.cfg.Events,
+			Delivered:   t.delivered,
+			Failed:      t.failed,
+			Dropped:     t.dropped,
+			Queued:      len(t.queue),
+			LastSuccess: t.lastSuccess,
+			LastError:   t.lastError,
+			Recent:      t.recent.Items(),
+		})
+		t.lock.Unlock()
+	}
+	return statuses
+}
+
+func (t *target) wants(event string) bool {
+	if len(t.events) == 0 {
+		return true
+	}
+	_, ok := t.events[event]
+	return ok
+}
+
+// run доставка по очереди, с повторами и растущей паузой между ними
+func (t *target) run() {
+	for e := range t.queue {
+		body, err := t.render(e)
+		delivery := Delivery{Time: time.Now(), Event: e.Type, FilterId: e.FilterId}
+		if err != nil {
+			delivery.Error = err.Error()
+			t.finish(delivery)
+			continue
+		}
+
+		backoff := firstBackoff
+		for {
+			delivery.Attempts++
+			delivery.Status, err = t.send(e.Type, body)
+			if err == nil || delivery.Attempts > t.cfg.Retries {
+				break
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		t.finish(delivery)
+	}
+}
+
+// render ошибка шаблона или невалидный JSON не отправляются, а попадают в статус доставки.
+// Строки в шаблоне выводятся через {{json .Title}}, иначе кавычка в названии ломает тело
+func (t *target) render(e Event) ([]byte, error) {
+	if t.template == nil {
+		return json.Marshal(e)
+	}
+	var body bytes.Buffer
+	if err := t.template.Execute(&body, e); err != nil {
+		return nil, errors.Newf("шаблон: %s", err)
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, ErrTemplateJSON
+	}
+	return body.Bytes(), nil
+}
+
+// send подпись - HMAC-SHA256 тела в hex, заголовок X-Multiswitcher-Signature: sha256=<hex>
+func (t *target) send(event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Multiswitcher-Event", event)
+	if t.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(t.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Multiswitcher-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.Newf("ответ %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (t *target) finish(d Delivery) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.recent.Push(d)
+	if d.Error != "" {
+		t.failed++
+		t.lastError = d.Error
+		log.Error("Ошибка доставки webhook", "webhook", t.cfg.Name, "event", d.Event,
+			logging.KeyFilterID, d.FilterId, "attempts", d.Attempts, logging.KeyError, d.Error)
+		return
+	}
+	t.delivered++
+	t.lastSuccess = d.Time
+}
+
+// toJSON для шаблонов: {{json .Title}} дает строку в кавычках с экранированием
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jashakimov/multiswitcher/internal/config"
+	"github.com/jashakimov/multiswitcher/internal/journal"
+)
+
+func TestRender(t *testing.T) {
+	event := Event{Type: EventSwitch, FilterId: 7, Title: `канал "1"`, Route: "233.0.0.1"}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		err      bool
+	}{
+		{name: "без шаблона", want: ""},
+		{name: "строка через json", template: `{"text": {{json .Title}}, "id": {{.FilterId}}}`,
+			want: `{"text": "канал \"1\"", "id": 7}`},
+		{name: "кавычка без экранирования", template: `{"text": "{{.Title}}"}`, err: true},
+		{name: "не JSON", template: `switch {{.Route}}`, err: true},
+		{name: "ошибка выполнения", template: `{"x": {{.Missing}}}`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := newTarget(config.Webhook{URL: "http://localhost", Template: tt.template})
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := target.render(event)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ожидалась ошибка, тело %s", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				var got Event
+				if err := json.Unmarshal(body, &got); err != nil || got.Title != event.Title {
+					t.Fatalf("тело %s: %v", body, err)
+				}
+				return
+			}
+			if string(body) != tt.want {
+				t.Fatalf("тело %s, ожидалось %s", body, tt.want)
+			}
+		})
+	}
+}
+
+// emitted события, отправленные в webhook
+type emitted []Event
+
+func (e *emitted) Emit(event Event)       { *e = append(*e, event) }
+func (e *emitted) Status() []TargetStatus { return nil }
+
+type discardJournal struct{}
+
+func (discardJournal) Add(journal.Event)                   {}
+func (discardJournal) Query(journal.Query) []journal.Event { return nil }
+
+func TestJournalEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  journal.Event
+		want   string
+		source string
+	}{
+		{name: "переключение", event: journal.Event{From: "main", To: "backup"}, want: EventSwitch, source: "backup"},
+		{
+			name:   "неудачное переключение",
+			event:  journal.Event{From: "main", To: "backup", Error: "нет фильтра"},
+			want:   EventSwitchFailed,
+			source: "main",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent emitted
+			Journal(discardJournal{}, &sent).Add(tt.event)
+			if len(sent) != 1 {
+				t.Fatalf("событий %d, ожидалось 1", len(sent))
+			}
+			if e := sent[0]; e.Type != tt.want || e.Source != tt.source || e.Error != tt.event.Error {
+				t.Fatalf("%s %s %q, ожидалось %s %s %q", e.Type, e.Source, e.Error, tt.want, tt.source, tt.event.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package traffic_control
+
+import (
+	"encoding/binary"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// атрибуты flower из linux/pkt_cls.h, в x/sys их нет
+const (
+	tcaFlowerAct            = 3
+	tcaFlowerKeyEthType     = 8
+	tcaFlowerKeyIPProto     = 9
+	tcaFlowerKeyIPv4Src     = 10
+	tcaFlowerKeyIPv4SrcMask = 11
+	tcaFlowerKeyIPv4Dst     = 12
+	tcaFlowerKeyIPv4DstMask = 13
+	tcaFlowerKeyIPv6Src     = 14
+	tcaFlowerKeyIPv6SrcMask = 15
+	tcaFlowerKeyIPv6Dst     = 16
+	tcaFlowerKeyIPv6DstMask = 17
+	tcaFlowerKeyUDPDst      = 21
+	tcaFlowerKeyVlanID      = 23
+	tcaFlowerKeyVlanEthType = 25
+	tcaFlowerKeyUDPDstMask  = 38
+)
+
+// смещения в заголовках для u32: IPv4 без опций, IPv6 без extension headers
+const (
+	ip4Proto = 8
+	ip4Src   = 12
+	ip4Dst   = 16
+	ip4DPort = 20
+	ip6Proto = 4
+	ip6Src   = 8
+	ip6DPort = 40
+)
+
+// portMask порт назначения - младшие 2 байта слова с портами источника и назначения
+var portMask = []byte{0, 0, 0xff, 0xff}
+
+// Key ключ источника в счетчиках: группа и уточнения в синтаксисе tc.
+// Без уточнений - просто адрес группы, как до появления (S,G), порта и VLAN
+func Key(ip, src string, port, vlan int) string {
+	key := ip
+	if src != "" {
+		key += " src " + src
+	}
+	if port != 0 {
+		key += " port " + strconv.Itoa(port)
+	}
+	if vlan != 0 {
+		key += " vlan " + strconv.Itoa(vlan)
+	}
+	return key
+}
+
+func (r Rule) Key() string {
+	return Key(r.MatchIP, r.MatchSrc, r.MatchPort, r.VLAN)
+}
+
+// isMirror действие фильтра - зеркалирование, иначе замена адреса
+func (r Rule) isMirror() bool {
+	return r.MirrorTo != ""
+}
+
+func (r Rule) sameMatch(o Rule) bool {
+	return r.Key() == o.Key()
+}
+
+// classifier VLAN u32 не видит: ядро снимает тег в метаданные до ingress, его сравнивает только flower
+func classifier(rule Rule) string {
+	if rule.VLAN != 0 {
+		return "flower"
+	}
+	return "u32"
+}
+
+func protocol(rule Rule) uint16 {
+	switch {
+	case rule.VLAN != 0:
+		return unix.ETH_P_8021Q
+	case rule.IsIPv6():
+		return unix.ETH_P_IPV6
+	}
+	return unix.ETH_P_IP
+}
+
+// selector аналог "match ip dst <ip>/32" или "match ip6 dst <ip>/128",
+// с уточнениями - еще "match ip src", "match ip protocol 17 0xff" и "match ip dport"
+func selector(rule Rule) *nl.TcU32Sel {
+	sel := &nl.TcU32Sel{Flags: nl.TC_U32_TERMINAL}
+	dst, src := net.ParseIP(rule.MatchIP), net.ParseIP(rule.MatchSrc)
+	if !rule.IsIPv6() {
+		sel.Keys = addrKeys(sel.Keys, dst.To4(), ip4Dst)
+		if src != nil {
+			sel.Keys = addrKeys(sel.Keys, src.To4(), ip4Src)
+		}
+		if rule.MatchPort != 0 {
+			sel.Keys = append(sel.Keys,
+				maskedKey(ip4Proto, []byte{0, 0xff, 0, 0}, []byte{0, unix.IPPROTO_UDP, 0, 0}),
+				maskedKey(ip4DPort, portMask, binary.BigEndian.AppendUint32(nil, uint32(rule.MatchPort))))
+		}
+	} else {
+		sel.Keys = addrKeys(sel.Keys, dst, ip6Dst)
+		if src != nil {
+			sel.Keys = addrKeys(sel.Keys, src, ip6Src)
+		}
+		if rule.MatchPort != 0 {
+			sel.Keys = append(sel.Keys,
+				maskedKey(ip6Proto, []byte{0, 0, 0xff, 0}, []byte{0, 0, unix.IPPROTO_UDP, 0}),
+				maskedKey(ip6DPort, portMask, binary.BigEndian.AppendUint32(nil, uint32(rule.MatchPort))))
+		}
+	}
+	sel.Nkeys = uint8(len(sel.Keys))
+	return sel
+}
+
+// addrKeys ключи полного совпадения адреса по 4 байта начиная со смещения off
+func addrKeys(keys []nl.TcU32Key, ip net.IP, off int) []nl.TcU32Key {
+	for i := 0; i < len(ip); i += 4 {
+		keys = append(keys, maskedKey(off+i, []byte{0xff, 0xff, 0xff, 0xff}, ip[i:i+4]))
+	}
+	return keys
+}
+
+// maskedKey ключ u32, mask и val - байты слова заголовка в порядке сети
+func maskedKey(off int, mask, val []byte) nl.TcU32Key {
+	native := nl.NativeEndian()
+	return nl.TcU32Key{Mask: native.Uint32(mask), Val: native.Uint32(val), Off: int32(off)}
+}
+
+// parseSelector поля Rule из ключей u32, false - в селекторе нет адреса назначения
+func parseSelector(rule *Rule, ipv6 bool, sel *nl.TcU32Sel) bool {
+	dstOff, srcOff, portOff, size := ip4Dst, ip4Src, ip4DPort, net.IPv4len
+	if ipv6 {
+		dstOff, srcOff, portOff, size = ip6Dst, ip6Src, ip6DPort, net.IPv6len
+	}
+	dst, src := make(net.IP, size), make(net.IP, size)
+	var dstWords, srcWords int
+	for _, key := range sel.Keys {
+		off := int(key.Off)
+		val := keyIP(key.Val)
+		switch {
+		case key.Mask == 0xffffffff && off >= dstOff && off < dstOff+size && (off-dstOff)%4 == 0:
+			copy(dst[off-dstOff:], val)
+			dstWords++
+		case key.Mask == 0xffffffff && off >= srcOff && off < srcOff+size && (off-srcOff)%4 == 0:
+			copy(src[off-srcOff:], val)
+			srcWords++
+		case off == portOff && key.Mask == nl.NativeEndian().Uint32(portMask):
+			rule.MatchPort = int(binary.BigEndian.Uint16(val[2:]))
+		}
+	}
+	if srcWords == size/4 {
+		rule.MatchSrc = src.String()
+	}
+	if dstWords != size/4 {
+		return false
+	}
+	rule.MatchIP = dst.String()
+	return true
+}
+
+// flowerMatch аналог "flower vlan_id <vlan> vlan_ethtype ip dst_ip <ip> [src_ip <src>] [ip_proto udp dst_port <port>]"
+func flowerMatch(options *nl.RtAttr, rule Rule) {
+	ethType, dstAttr, srcAttr := uint16(unix.ETH_P_IP), tcaFlowerKeyIPv4Dst, tcaFlowerKeyIPv4Src
+	dst, src := net.ParseIP(rule.MatchIP).To4(), net.ParseIP(rule.MatchSrc).To4()
+	if rule.IsIPv6() {
+		ethType, dstAttr, srcAttr = unix.ETH_P_IPV6, tcaFlowerKeyIPv6Dst, tcaFlowerKeyIPv6Src
+		dst, src = net.ParseIP(rule.MatchIP), net.ParseIP(rule.MatchSrc)
+	}
+	options.AddRtAttr(tcaFlowerKeyEthType, htons(unix.ETH_P_8021Q))
+	options.AddRtAttr(tcaFlowerKeyVlanID, nl.Uint16Attr(uint16(rule.VLAN)))
+	options.AddRtAttr(tcaFlowerKeyVlanEthType, htons(ethType))
+	options.AddRtAttr(dstAttr, dst)
+	options.AddRtAttr(dstAttr+1, fullMask(len(dst)))
+	if src != nil {
+		options.AddRtAttr(srcAttr, src)
+		options.AddRtAttr(srcAttr+1, fullMask(len(src)))
+	}
+	if rule.MatchPort != 0 {
+		options.AddRtAttr(tcaFlowerKeyIPProto, []byte{unix.IPPROTO_UDP})
+		options.AddRtAttr(tcaFlowerKeyUDPDst, htons(uint16(rule.MatchPort)))
+		options.AddRtAttr(tcaFlowerKeyUDPDstMask, htons(0xffff))
+	}
+}
+
+// parseFlower поля Rule из ключей flower, false - в фильтре нет адреса назначения
+func parseFlower(rule *Rule, options []syscall.NetlinkRouteAttr) (bool, error) {
+	for _, opt := range options {
+		switch opt.Attr.Type & nlaTypeMask {
+		case tcaFlowerKeyIPv4Dst, tcaFlowerKeyIPv6Dst:
+			rule.MatchIP = net.IP(opt.Value).String()
+		case tcaFlowerKeyIPv4Src, tcaFlowerKeyIPv6Src:
+			rule.MatchSrc = net.IP(opt.Value).String()
+		case tcaFlowerKeyUDPDst:
+			if len(opt.Value) >= 2 {
+				rule.MatchPort = int(binary.BigEndian.Uint16(opt.Value))
+			}
+		case tcaFlowerKeyVlanID:
+			if len(opt.Value) >= 2 {
+				rule.VLAN = int(nl.NativeEndian().Uint16(opt.Value))
+			}
+		case tcaFlowerAct:
+			if err := parseActions(rule, opt.Value); err != nil {
+				return false, err
+			}
+		}
+	}
+	return rule.MatchIP != "", nil
+}
+
+func htons(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func fullMask(size int) []byte {
+	mask := make([]byte, size)
+	for i := range mask {
+		mask[i] = 0xff
+	}
+	return mask
+}
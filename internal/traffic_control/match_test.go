@@ -0,0 +1,134 @@
+package traffic_control
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+var matchRules = []struct {
+	name string
+	rule Rule
+	key  string
+}{
+	{name: "группа", rule: Rule{MatchIP: "233.0.0.1"}, key: "233.0.0.1"},
+	{name: "(S,G)", rule: Rule{MatchIP: "233.0.0.1", MatchSrc: "10.0.0.5"}, key: "233.0.0.1 src 10.0.0.5"},
+	{name: "порт", rule: Rule{MatchIP: "233.0.0.1", MatchPort: 1234}, key: "233.0.0.1 port 1234"},
+	{
+		name: "(S,G) и порт",
+		rule: Rule{MatchIP: "233.0.0.1", MatchSrc: "10.0.0.5", MatchPort: 65535},
+		key:  "233.0.0.1 src 10.0.0.5 port 65535",
+	},
+	{name: "IPv6 группа", rule: Rule{MatchIP: "ff3e::1234"}, key: "ff3e::1234"},
+	{
+		name: "IPv6 (S,G) и порт",
+		rule: Rule{MatchIP: "ff3e::1234", MatchSrc: "2001:db8::5", MatchPort: 5000},
+		key:  "ff3e::1234 src 2001:db8::5 port 5000",
+	},
+	{name: "VLAN", rule: Rule{MatchIP: "233.0.0.1", VLAN: 100}, key: "233.0.0.1 vlan 100"},
+	{
+		name: "VLAN, (S,G) и порт",
+		rule: Rule{MatchIP: "233.0.0.1", MatchSrc: "10.0.0.5", MatchPort: 1234, VLAN: 4094},
+		key:  "233.0.0.1 src 10.0.0.5 port 1234 vlan 4094",
+	},
+	{
+		name: "IPv6 VLAN и порт",
+		rule: Rule{MatchIP: "ff3e::1234", MatchPort: 5000, VLAN: 7},
+		key:  "ff3e::1234 port 5000 vlan 7",
+	},
+}
+
+func TestKey(t *testing.T) {
+	for _, tt := range matchRules {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Key(); got != tt.key {
+				t.Fatalf("%q, ожидалось %q", got, tt.key)
+			}
+		})
+	}
+}
+
+// TestMatchRoundTrip правило, собранное в u32 или flower и разобранное из netlink, совпадает с исходным
+func TestMatchRoundTrip(t *testing.T) {
+	for _, tt := range matchRules {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Rule
+			var ok bool
+			switch classifier(tt.rule) {
+			case "u32":
+				sel := nl.DeserializeTcU32Sel(selector(tt.rule).Serialize())
+				ok = parseSelector(&got, tt.rule.IsIPv6(), sel)
+			case "flower":
+				options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+				flowerMatch(options, tt.rule)
+				attrs, err := nl.ParseRouteAttr(options.Serialize()[4:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok, err = parseFlower(&got, attrs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !ok || got.Key() != tt.key {
+				t.Fatalf("%q %v, ожидалось %q", got.Key(), ok, tt.key)
+			}
+		})
+	}
+}
+
+func TestSelectorKeys(t *testing.T) {
+	native := nl.NativeEndian()
+	tests := []struct {
+		name string
+		rule Rule
+		// keys смещение, маска и значение в порядке сети
+		keys [][3]uint32
+	}{
+		{
+			name: "группа",
+			rule: Rule{MatchIP: "233.0.0.1"},
+			keys: [][3]uint32{{ip4Dst, 0xffffffff, 0xe9000001}},
+		},
+		{
+			name: "(S,G) и порт",
+			rule: Rule{MatchIP: "233.0.0.1", MatchSrc: "10.0.0.5", MatchPort: 1234},
+			keys: [][3]uint32{
+				{ip4Dst, 0xffffffff, 0xe9000001},
+				{ip4Src, 0xffffffff, 0x0a000005},
+				{ip4Proto, 0x00ff0000, 0x00110000},
+				{ip4DPort, 0x0000ffff, 1234},
+			},
+		},
+		{
+			name: "IPv6 порт",
+			rule: Rule{MatchIP: "ff3e::1234", MatchPort: 5000},
+			keys: [][3]uint32{
+				{ip6Dst, 0xffffffff, 0xff3e0000},
+				{ip6Dst + 4, 0xffffffff, 0},
+				{ip6Dst + 8, 0xffffffff, 0},
+				{ip6Dst + 12, 0xffffffff, 0x1234},
+				{ip6Proto, 0x0000ff00, 0x00001100},
+				{ip6DPort, 0x0000ffff, 5000},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := selector(tt.rule)
+			if int(sel.Nkeys) != len(tt.keys) || len(sel.Keys) != len(tt.keys) {
+				t.Fatalf("ключей %d, ожидалось %d", len(sel.Keys), len(tt.keys))
+			}
+			for i, key := range sel.Keys {
+				want := tt.keys[i]
+				mask, val := make([]byte, 4), make([]byte, 4)
+				native.PutUint32(mask, key.Mask)
+				native.PutUint32(val, key.Val)
+				got := [3]uint32{uint32(key.Off), binary.BigEndian.Uint32(mask), binary.BigEndian.Uint32(val)}
+				if got != want {
+					t.Fatalf("ключ %d: %#x, ожидалось %#x", i, got, want)
+				}
+			}
+		})
+	}
+}
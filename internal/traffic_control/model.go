@@ -0,0 +1,169 @@
+package traffic_control
+
+import (
+	"fmt"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"net"
+	"syscall"
+)
+
+var (
+	ErrExists      = errors.New("фильтр уже установлен")
+	ErrNotFound    = errors.New("фильтр не найден")
+	ErrInvalidRule = errors.New("некорректное описание фильтра")
+	// ErrNotSupported ядро не смогло загрузить классификатор или действие (act_nat, act_mirred)
+	ErrNotSupported = errors.New("классификатор или действие не поддерживается ядром")
+)
+
+// Rule описывает u32 фильтр на ingress интерфейса:
+// match ip dst MatchIP и одно действие - nat в NatTo или зеркалирование в MirrorTo.
+// Для IPv6 фильтр ставится с protocol ipv6, а вместо nat, которого у IPv6 нет, - pedit адреса и csum udp.
+// MatchSrc и MatchPort уточняют совпадение адресом источника и UDP портом назначения,
+// с VLAN вместо u32 ставится flower с protocol 802.1Q.
+// Copies - копии потока в дополнительные выходы перед основным действием, только вместе с NatTo
+type Rule struct {
+	Link      string `json:"link"`
+	Priority  int    `json:"priority"`
+	Handle    uint32 `json:"handle,omitempty"`
+	MatchIP   string `json:"matchIP"`
+	MatchSrc  string `json:"matchSrc,omitempty"`
+	MatchPort int    `json:"matchPort,omitempty"`
+	VLAN      int    `json:"vlan,omitempty"`
+	NatTo     string `json:"natTo,omitempty"`
+	MirrorTo  string `json:"mirrorTo,omitempty"`
+	Copies    []Copy `json:"copies,omitempty"`
+	Stats     Stats  `json:"stats"`
+}
+
+// Copy копия потока: адрес заменяется на To и пакет зеркалируется на ingress интерфейса Link,
+// где дальше уходит по маршруту To. Stats - счетчики зеркалирования копии
+type Copy struct {
+	To    string `json:"to"`
+	Link  string `json:"link"`
+	Stats Stats  `json:"stats"`
+}
+
+type Stats struct {
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint64 `json:"packets"`
+	Drops      uint32 `json:"drops"`
+	Overlimits uint32 `json:"overlimits"`
+}
+
+func (r Rule) String() string {
+	protocol, match := "ip", "u32 match ip dst "+r.MatchIP
+	action := rewriteAction(r.IsIPv6(), r.MatchIP, r.NatTo)
+	if r.IsIPv6() {
+		protocol, match = "ipv6", "u32 match ip6 dst "+r.MatchIP+"/128"
+	}
+	switch {
+	case r.VLAN != 0:
+		family := "ip"
+		if r.IsIPv6() {
+			family = "ipv6"
+		}
+		protocol, match = "802.1Q", fmt.Sprintf("flower vlan_id %d vlan_ethtype %s dst_ip %s", r.VLAN, family, r.MatchIP)
+		if r.MatchSrc != "" {
+			match += " src_ip " + r.MatchSrc
+		}
+		if r.MatchPort != 0 {
+			match += fmt.Sprintf(" ip_proto udp dst_port %d", r.MatchPort)
+		}
+	case r.IsIPv6():
+		if r.MatchSrc != "" {
+			match += " match ip6 src " + r.MatchSrc + "/128"
+		}
+		if r.MatchPort != 0 {
+			match += fmt.Sprintf(" match ip6 protocol 17 0xff match ip6 dport %d 0xffff", r.MatchPort)
+		}
+	default:
+		if r.MatchSrc != "" {
+			match += " match ip src " + r.MatchSrc
+		}
+		if r.MatchPort != 0 {
+			match += fmt.Sprintf(" match ip protocol 17 0xff match ip dport %d 0xffff", r.MatchPort)
+		}
+	}
+	if r.MirrorTo != "" {
+		action = "mirred egress mirror dev " + r.MirrorTo
+	}
+	var copies string
+	for _, c := range r.Copies {
+		copies += fmt.Sprintf("%s pipe action mirred ingress mirror dev %s pipe action %s pipe action ",
+			rewriteAction(r.IsIPv6(), r.MatchIP, c.To), c.Link, rewriteAction(r.IsIPv6(), c.To, r.MatchIP))
+	}
+	var handle string
+	if r.Handle != 0 {
+		handle = fmt.Sprintf(" handle %x:%x:%x", r.Handle>>20, (r.Handle>>12)&0xff, r.Handle&0xfff)
+	}
+	return fmt.Sprintf("dev %s parent ffff: protocol %s prio %d%s %s action %s%s",
+		r.Link, protocol, r.Priority, handle, match, copies, action)
+}
+
+func rewriteAction(ipv6 bool, from, to string) string {
+	if ipv6 {
+		return "pedit ex munge ip6 dst set " + to + " pipe action csum udp"
+	}
+	return "nat ingress " + from + " " + to
+}
+
+func (r Rule) sameCopies(o Rule) bool {
+	if len(r.Copies) != len(o.Copies) {
+		return false
+	}
+	for i := range r.Copies {
+		if r.Copies[i].To != o.Copies[i].To || r.Copies[i].Link != o.Copies[i].Link {
+			return false
+		}
+	}
+	return true
+}
+
+// IsIPv6 фильтр для IPv6 группы
+func (r Rule) IsIPv6() bool {
+	ip := net.ParseIP(r.MatchIP)
+	return ip != nil && ip.To4() == nil
+}
+
+// Error ошибка операции с фильтром, Err - ошибка ядра или одна из ErrXXX
+type Error struct {
+	Op   string
+	Rule Rule
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tc filter %s %s: %v", e.Op, e.Rule, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func IsExist(err error) bool {
+	return is(err, ErrExists, syscall.EEXIST)
+}
+
+func IsNotFound(err error) bool {
+	return is(err, ErrNotFound, syscall.ENOENT)
+}
+
+func IsNotSupported(err error) bool {
+	return is(err, ErrNotSupported, syscall.EOPNOTSUPP)
+}
+
+func is(err, target error, errno syscall.Errno) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return err == target
+	}
+	return e.Err == target || e.Err == errno
+}
+
+// kernelError переводит errno ядра в ошибки пакета там, где смысл однозначен
+func kernelError(op string, err error) error {
+	if op == "add" && (err == syscall.ENOENT || err == syscall.EOPNOTSUPP) {
+		return ErrNotSupported
+	}
+	return err
+}
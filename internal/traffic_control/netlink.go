@@ -0,0 +1,493 @@
+package traffic_control
+
+import (
+	"encoding/binary"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"syscall"
+)
+
+type TrafficControl interface {
+	Add(rule Rule) error
+	Del(rule Rule) error
+	List(link string) ([]Rule, error)
+}
+
+const (
+	tcaNatParms   = 1
+	tcaPeditParms = 2
+	tcaCsumParms  = 1
+	tcaStatsPkt64 = 8
+	sizeofTcNat   = nl.SizeofTcGen + 16
+	// tc_pedit_sel: tc_gen, nkeys, flags и выравнивание до ключей
+	sizeofTcPeditSel = nl.SizeofTcGen + 4
+	sizeofTcPeditKey = 24
+	sizeofTcCsum     = nl.SizeofTcGen + 4
+	csumUpdateUDP    = 16
+	// ip6Dst смещение адреса назначения в заголовке IPv6
+	ip6Dst = 24
+	// tcaActMaxPrio TCA_ACT_MAX_PRIO, больше действий в одном фильтре ядро не принимает
+	tcaActMaxPrio = 32
+	nlaTypeMask   = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+)
+
+type netlinkTC struct {
+	// add/del проверяют текущее состояние перед изменением
+	lock sync.Mutex
+}
+
+// NewNetlink управление u32 фильтрами через netlink, без бинарника tc
+func NewNetlink() TrafficControl {
+	return &netlinkTC{}
+}
+
+func (t *netlinkTC) Add(rule Rule) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	link, req, err := t.request(unix.RTM_NEWTFILTER, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK, rule)
+	if err != nil {
+		return &Error{Op: "add", Rule: rule, Err: err}
+	}
+
+	installed, err := t.list(link)
+	if err != nil {
+		return &Error{Op: "add", Rule: rule, Err: err}
+	}
+	for _, r := range installed {
+		if r.Priority == rule.Priority && r.sameMatch(rule) && r.NatTo == rule.NatTo && r.MirrorTo == rule.MirrorTo && r.sameCopies(rule) {
+			return &Error{Op: "add", Rule: r, Err: ErrExists}
+		}
+	}
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	var actions *nl.RtAttr
+	if classifier(rule) == "flower" {
+		flowerMatch(options, rule)
+		actions = options.AddRtAttr(tcaFlowerAct, nil)
+	} else {
+		options.AddRtAttr(nl.TCA_U32_SEL, selector(rule).Serialize())
+		actions = options.AddRtAttr(nl.TCA_U32_ACT, nil)
+	}
+	if err := addActions(actions, rule); err != nil {
+		return &Error{Op: "add", Rule: rule, Err: err}
+	}
+	req.AddData(options)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return &Error{Op: "add", Rule: rule, Err: kernelError("add", err)}
+	}
+	return nil
+}
+
+// addActions действия фильтра: копии в выходы Copies, затем mirred, nat или pedit с csum для IPv6
+func addActions(actions *nl.RtAttr, rule Rule) error {
+	tab := nl.TCA_ACT_TAB
+	add := func(kind string) *nl.RtAttr {
+		table := actions.AddRtAttr(tab, nil)
+		tab++
+		table.AddRtAttr(nl.TCA_ACT_KIND, nl.ZeroTerminated(kind))
+		return table.AddRtAttr(nl.TCA_ACT_OPTIONS, nil)
+	}
+	rewrite := func(from, to string, result netlink.TcAct) {
+		if rule.IsIPv6() {
+			// у IPv6 нет контрольной суммы заголовка, пересчитывается только UDP
+			add("pedit").AddRtAttr(tcaPeditParms, peditDst6(to))
+			add("csum").AddRtAttr(tcaCsumParms, csumUDP(result))
+			return
+		}
+		add("nat").AddRtAttr(tcaNatParms, natParms(from, to, result))
+	}
+	mirror := func(link string, eaction netlink.MirredAct) error {
+		to, err := netlink.LinkByName(link)
+		if err != nil {
+			return err
+		}
+		mirred := nl.TcMirred{
+			TcGen:   nl.TcGen{Action: int32(netlink.TC_ACT_PIPE)},
+			Eaction: int32(eaction),
+			Ifindex: uint32(to.Attrs().Index),
+		}
+		add("mirred").AddRtAttr(nl.TCA_MIRRED_PARMS, mirred.Serialize())
+		return nil
+	}
+
+	// копия уходит на ingress выхода уже с адресом выхода, потом адрес возвращается для следующих действий
+	for _, c := range rule.Copies {
+		rewrite(rule.MatchIP, c.To, netlink.TC_ACT_PIPE)
+		if err := mirror(c.Link, netlink.TCA_INGRESS_MIRROR); err != nil {
+			return err
+		}
+		rewrite(c.To, rule.MatchIP, netlink.TC_ACT_PIPE)
+	}
+	if rule.MirrorTo != "" {
+		return mirror(rule.MirrorTo, netlink.TCA_EGRESS_MIRROR)
+	}
+	rewrite(rule.MatchIP, rule.NatTo, netlink.TC_ACT_OK)
+	return nil
+}
+
+func (t *netlinkTC) Del(rule Rule) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	link, err := netlink.LinkByName(rule.Link)
+	if err != nil {
+		return &Error{Op: "delete", Rule: rule, Err: err}
+	}
+	installed, err := t.list(link)
+	if err != nil {
+		return &Error{Op: "delete", Rule: rule, Err: err}
+	}
+
+	r, ok := target(installed, rule)
+	if !ok {
+		return &Error{Op: "delete", Rule: rule, Err: ErrNotFound}
+	}
+	_, req, err := t.request(unix.RTM_DELTFILTER, unix.NLM_F_ACK, r)
+	if err != nil {
+		return &Error{Op: "delete", Rule: r, Err: err}
+	}
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return &Error{Op: "delete", Rule: r, Err: err}
+	}
+	return nil
+}
+
+// target один фильтр, который снимает Del: на prio с тем же совпадением, по handle или, без handle,
+// с тем же видом действия. Из нескольких подходящих - с теми же адресами замены и копиями
+func target(installed []Rule, rule Rule) (Rule, bool) {
+	var found []Rule
+	for _, r := range installed {
+		if r.Priority != rule.Priority || !r.sameMatch(rule) {
+			continue
+		}
+		if rule.Handle != 0 && r.Handle != rule.Handle {
+			continue
+		}
+		if rule.Handle == 0 && r.isMirror() != rule.isMirror() {
+			continue
+		}
+		found = append(found, r)
+	}
+	for _, r := range found {
+		if r.NatTo == rule.NatTo && r.MirrorTo == rule.MirrorTo && r.sameCopies(rule) {
+			return r, true
+		}
+	}
+	if len(found) == 0 {
+		return Rule{}, false
+	}
+	return found[0], true
+}
+
+func (t *netlinkTC) List(linkName string) ([]Rule, error) {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return nil, &Error{Op: "show", Rule: Rule{Link: linkName}, Err: err}
+	}
+	rules, err := t.list(link)
+	if err != nil {
+		return nil, &Error{Op: "show", Rule: Rule{Link: linkName}, Err: err}
+	}
+	return rules, nil
+}
+
+func (t *netlinkTC) request(proto, flags int, rule Rule) (netlink.Link, *nl.NetlinkRequest, error) {
+	if rule.Priority <= 0 || rule.Priority > 0xffff || net.ParseIP(rule.MatchIP) == nil {
+		return nil, nil, ErrInvalidRule
+	}
+	if proto == unix.RTM_NEWTFILTER && (rule.NatTo == "") == (rule.MirrorTo == "") {
+		return nil, nil, ErrInvalidRule
+	}
+	// nat и источник только внутри одного семейства
+	if rule.NatTo != "" && (net.ParseIP(rule.NatTo) == nil || (net.ParseIP(rule.NatTo).To4() == nil) != rule.IsIPv6()) {
+		return nil, nil, ErrInvalidRule
+	}
+	if rule.MatchSrc != "" && (net.ParseIP(rule.MatchSrc) == nil || (net.ParseIP(rule.MatchSrc).To4() == nil) != rule.IsIPv6()) {
+		return nil, nil, ErrInvalidRule
+	}
+	if rule.MatchPort < 0 || rule.MatchPort > 0xffff || rule.VLAN < 0 || rule.VLAN > 4094 {
+		return nil, nil, ErrInvalidRule
+	}
+	if proto == unix.RTM_NEWTFILTER && len(rule.Copies) > 0 {
+		if rule.NatTo == "" || actionCount(rule) > tcaActMaxPrio {
+			return nil, nil, ErrInvalidRule
+		}
+		for _, c := range rule.Copies {
+			if c.Link == "" || net.ParseIP(c.To) == nil || (net.ParseIP(c.To).To4() == nil) != rule.IsIPv6() {
+				return nil, nil, ErrInvalidRule
+			}
+		}
+	}
+	link, err := netlink.LinkByName(rule.Link)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := nl.NewNetlinkRequest(proto, flags)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Handle:  rule.Handle,
+		Parent:  netlink.HANDLE_INGRESS,
+		Info:    netlink.MakeHandle(uint16(rule.Priority), nl.Swap16(protocol(rule))),
+	})
+	if proto == unix.RTM_NEWTFILTER {
+		req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated(classifier(rule))))
+	}
+	return link, req, nil
+}
+
+func (t *netlinkTC) list(link netlink.Link) ([]Rule, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETTFILTER, unix.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  netlink.HANDLE_INGRESS,
+	})
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		prio, proto := netlink.MajorMinor(msg.Info)
+		rule := Rule{
+			Link:     link.Attrs().Name,
+			Priority: int(prio),
+			Handle:   msg.Handle,
+		}
+
+		var kind string
+		var options []syscall.NetlinkRouteAttr
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nlaTypeMask {
+			case nl.TCA_KIND:
+				kind = string(attr.Value[:len(attr.Value)-1])
+			case nl.TCA_OPTIONS:
+				if options, err = nl.ParseRouteAttr(attr.Value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		var ok bool
+		switch kind {
+		case "u32":
+			// в дампе u32 есть служебные записи хэш-таблиц без селектора
+			ok, err = parseU32(&rule, nl.Swap16(proto) == unix.ETH_P_IPV6, options)
+		case "flower":
+			ok, err = parseFlower(&rule, options)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+func parseU32(rule *Rule, ipv6 bool, options []syscall.NetlinkRouteAttr) (bool, error) {
+	var hasSel bool
+	for _, opt := range options {
+		switch opt.Attr.Type & nlaTypeMask {
+		case nl.TCA_U32_SEL:
+			hasSel = parseSelector(rule, ipv6, nl.DeserializeTcU32Sel(opt.Value))
+		case nl.TCA_U32_ACT:
+			if err := parseActions(rule, opt.Value); err != nil {
+				return false, err
+			}
+		}
+	}
+	return hasSel, nil
+}
+
+// actionCount число действий addActions: замена адреса - nat или pedit с csum, копия - две замены и mirred
+func actionCount(rule Rule) int {
+	rewrite := 1
+	if rule.IsIPv6() {
+		rewrite = 2
+	}
+	return rewrite + len(rule.Copies)*(2*rewrite+1)
+}
+
+// action одно действие из таблицы: адрес замены nat или pedit, интерфейс mirred и счетчики
+type action struct {
+	kind    string
+	to      string
+	link    string
+	ingress bool
+	stats   Stats
+}
+
+// parseActions таблица действий u32 или flower. NatTo - адрес последней замены, копии - mirred на ingress
+// с адресом замены перед ним, счетчики фильтра - счетчики последнего действия
+func parseActions(rule *Rule, data []byte) error {
+	tables, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return err
+	}
+	var to string
+	for _, table := range tables {
+		a, err := parseAction(table.Value)
+		if err != nil {
+			return err
+		}
+		switch {
+		case a.kind == "mirred" && a.ingress:
+			rule.Copies = append(rule.Copies, Copy{To: to, Link: a.link, Stats: a.stats})
+		case a.kind == "mirred":
+			rule.MirrorTo = a.link
+		case a.to != "":
+			to = a.to
+		}
+		rule.Stats = a.stats
+	}
+	rule.NatTo = to
+	return nil
+}
+
+func parseAction(data []byte) (action, error) {
+	var a action
+	attrs, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return a, err
+	}
+	native := nl.NativeEndian()
+
+	for _, attr := range attrs {
+		switch attr.Attr.Type & nlaTypeMask {
+		case nl.TCA_ACT_KIND:
+			a.kind = string(attr.Value[:len(attr.Value)-1])
+		case nl.TCA_ACT_OPTIONS:
+			opts, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return a, err
+			}
+			for _, opt := range opts {
+				switch {
+				case a.kind == "nat" && opt.Attr.Type == tcaNatParms && len(opt.Value) >= sizeofTcNat:
+					a.to = net.IP(opt.Value[nl.SizeofTcGen+4 : nl.SizeofTcGen+8]).String()
+				case a.kind == "pedit" && opt.Attr.Type&nlaTypeMask == tcaPeditParms && len(opt.Value) >= sizeofTcPeditSel:
+					if to := peditDst6To(opt.Value); to != nil {
+						a.to = to.String()
+					}
+				case a.kind == "mirred" && opt.Attr.Type == nl.TCA_MIRRED_PARMS && len(opt.Value) >= nl.SizeofTcMirred:
+					mirred := nl.DeserializeTcMirred(opt.Value)
+					a.ingress = mirred.Eaction == int32(netlink.TCA_INGRESS_MIRROR)
+					if to, err := netlink.LinkByIndex(int(mirred.Ifindex)); err == nil {
+						a.link = to.Attrs().Name
+					}
+				}
+			}
+		case nl.TCA_ACT_STATS:
+			stats, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return a, err
+			}
+			for _, st := range stats {
+				switch st.Attr.Type & nlaTypeMask {
+				case nl.TCA_STATS_BASIC:
+					if len(st.Value) >= 12 {
+						a.stats.Bytes = native.Uint64(st.Value[0:8])
+						if a.stats.Packets == 0 {
+							a.stats.Packets = uint64(native.Uint32(st.Value[8:12]))
+						}
+					}
+				case tcaStatsPkt64:
+					if len(st.Value) >= 8 {
+						a.stats.Packets = native.Uint64(st.Value[0:8])
+					}
+				case nl.TCA_STATS_QUEUE:
+					if len(st.Value) >= 20 {
+						a.stats.Drops = native.Uint32(st.Value[8:12])
+						a.stats.Overlimits = native.Uint32(st.Value[16:20])
+					}
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// peditDst6 struct tc_pedit_sel с ключами, заменяющими адрес назначения IPv6 целиком:
+// слово заголовка становится (слово & mask) ^ val, mask = 0
+func peditDst6(to string) []byte {
+	ip := net.ParseIP(to)
+	native := nl.NativeEndian()
+	gen := nl.TcGen{Action: int32(netlink.TC_ACT_PIPE)}
+	buf := make([]byte, sizeofTcPeditSel+net.IPv6len/4*sizeofTcPeditKey)
+	copy(buf, gen.Serialize())
+	buf[nl.SizeofTcGen] = net.IPv6len / 4
+	for i := 0; i < net.IPv6len/4; i++ {
+		key := buf[sizeofTcPeditSel+i*sizeofTcPeditKey:]
+		native.PutUint32(key[4:], native.Uint32(ip[i*4:]))
+		native.PutUint32(key[8:], uint32(ip6Dst+i*4))
+	}
+	return buf
+}
+
+// peditDst6To адрес из ключей pedit, nil - это не замена адреса назначения IPv6
+func peditDst6To(sel []byte) net.IP {
+	native := nl.NativeEndian()
+	nkeys := int(sel[nl.SizeofTcGen])
+	if len(sel) < sizeofTcPeditSel+nkeys*sizeofTcPeditKey {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	var found int
+	for i := 0; i < nkeys; i++ {
+		key := sel[sizeofTcPeditSel+i*sizeofTcPeditKey:]
+		off := int(native.Uint32(key[8:]))
+		if native.Uint32(key) != 0 || off < ip6Dst || off >= ip6Dst+net.IPv6len || off%4 != 0 {
+			continue
+		}
+		native.PutUint32(ip[off-ip6Dst:], native.Uint32(key[4:]))
+		found++
+	}
+	if found != net.IPv6len/4 {
+		return nil
+	}
+	return ip
+}
+
+// csumUDP struct tc_csum: пересчет контрольной суммы UDP после замены адреса, result - результат действия
+func csumUDP(result netlink.TcAct) []byte {
+	gen := nl.TcGen{Action: int32(result)}
+	buf := make([]byte, sizeofTcCsum)
+	copy(buf, gen.Serialize())
+	nl.NativeEndian().PutUint32(buf[nl.SizeofTcGen:], csumUpdateUDP)
+	return buf
+}
+
+// natParms struct tc_nat: tc_gen, old_addr, new_addr, mask, flags (ingress = 0), result - результат действия
+func natParms(from, to string, result netlink.TcAct) []byte {
+	gen := nl.TcGen{Action: int32(result)}
+	buf := make([]byte, sizeofTcNat)
+	copy(buf, gen.Serialize())
+	copy(buf[nl.SizeofTcGen:], net.ParseIP(from).To4())
+	copy(buf[nl.SizeofTcGen+4:], net.ParseIP(to).To4())
+	binary.BigEndian.PutUint32(buf[nl.SizeofTcGen+8:], 0xffffffff)
+	return buf
+}
+
+func keyIP(val uint32) net.IP {
+	ip := make(net.IP, 4)
+	nl.NativeEndian().PutUint32(ip, val)
+	return ip
+}
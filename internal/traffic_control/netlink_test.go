@@ -0,0 +1,38 @@
+package traffic_control
+
+import "testing"
+
+func TestDelTarget(t *testing.T) {
+	installed := []Rule{
+		{Priority: 10, Handle: 1, MatchIP: "233.0.0.1", MirrorTo: "eth1"},
+		{Priority: 10, Handle: 2, MatchIP: "233.0.0.1", MatchPort: 1234, NatTo: "239.0.0.1"},
+		{Priority: 10, Handle: 3, MatchIP: "233.0.0.1", NatTo: "239.0.0.1"},
+		{Priority: 10, Handle: 4, MatchIP: "233.0.0.1", NatTo: "239.0.0.1", Copies: []Copy{{To: "239.0.0.2", Link: "eth1"}}},
+		{Priority: 11, Handle: 5, MatchIP: "233.0.0.1", NatTo: "239.0.0.1"},
+	}
+	tests := []struct {
+		name   string
+		rule   Rule
+		handle uint32
+	}{
+		{name: "по handle", rule: Rule{Priority: 10, Handle: 4, MatchIP: "233.0.0.1"}, handle: 4},
+		{name: "handle с другим совпадением", rule: Rule{Priority: 10, Handle: 2, MatchIP: "233.0.0.1"}},
+		{name: "зеркалирование", rule: Rule{Priority: 10, MatchIP: "233.0.0.1", MirrorTo: "eth1"}, handle: 1},
+		{name: "nat без копий", rule: Rule{Priority: 10, MatchIP: "233.0.0.1", NatTo: "239.0.0.1"}, handle: 3},
+		{
+			name:   "nat с копиями",
+			rule:   Rule{Priority: 10, MatchIP: "233.0.0.1", NatTo: "239.0.0.1", Copies: []Copy{{To: "239.0.0.2", Link: "eth1"}}},
+			handle: 4,
+		},
+		{name: "порт", rule: Rule{Priority: 10, MatchIP: "233.0.0.1", MatchPort: 1234, NatTo: "239.0.0.9"}, handle: 2},
+		{name: "другой prio", rule: Rule{Priority: 12, MatchIP: "233.0.0.1", NatTo: "239.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := target(installed, tt.rule)
+			if ok != (tt.handle != 0) || r.Handle != tt.handle {
+				t.Fatalf("handle %d %v, ожидался %d", r.Handle, ok, tt.handle)
+			}
+		})
+	}
+}
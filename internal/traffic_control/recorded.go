@@ -0,0 +1,114 @@
+package traffic_control
+
+import "github.com/jashakimov/multiswitcher/internal/ledger"
+
+type recorded struct {
+	TrafficControl
+	ledger ledger.Ledger
+}
+
+// NewRecorded записывает в журнал установленные фильтры и вычеркивает снятые.
+// Фильтр, который уже стоял до нас, в журнал не попадает
+func NewRecorded(tc TrafficControl, l ledger.Ledger) TrafficControl {
+	return &recorded{
+		TrafficControl: tc,
+		ledger:         l,
+	}
+}
+
+func (r *recorded) Add(rule Rule) error {
+	if err := r.TrafficControl.Add(rule); err != nil {
+		return err
+	}
+	r.ledger.Record(entry(r.installed(rule)))
+	return nil
+}
+
+func (r *recorded) Del(rule Rule) error {
+	err := r.TrafficControl.Del(rule)
+	if err == nil || IsNotFound(err) {
+		r.forget(rule)
+	}
+	return err
+}
+
+// installed фильтр с handle, который ему выдало ядро: по handle при снятии удаляется именно он,
+// а не соседний фильтр на том же prio
+func (r *recorded) installed(rule Rule) Rule {
+	rules, err := r.List(rule.Link)
+	if err != nil {
+		return rule
+	}
+	for _, installed := range rules {
+		if installed.Priority == rule.Priority && installed.sameMatch(rule) && installed.NatTo == rule.NatTo &&
+			installed.MirrorTo == rule.MirrorTo && installed.sameCopies(rule) {
+			rule.Handle = installed.Handle
+			break
+		}
+	}
+	return rule
+}
+
+// forget вычеркивает фильтры на prio с тем же совпадением, которых больше нет на link:
+// при замене выходов новый фильтр ставится рядом со старым до его удаления и остается в журнале
+func (r *recorded) forget(rule Rule) {
+	// интерфейса нет - вместе с ним пропали и фильтры
+	rules, _ := r.List(rule.Link)
+	for _, e := range r.ledger.Entries() {
+		if e.Kind != ledger.Filter || e.Link != rule.Link || e.Priority != rule.Priority || FromEntry(e).Key() != rule.Key() {
+			continue
+		}
+		if !remains(rules, e) {
+			r.ledger.Forget(e)
+		}
+	}
+}
+
+// remains стоит ли еще фильтр из журнала, записи без handle - любой фильтр на prio с тем же совпадением
+func remains(rules []Rule, e ledger.Entry) bool {
+	for _, installed := range rules {
+		if installed.Priority == e.Priority && installed.Key() == FromEntry(e).Key() && (e.Handle == 0 || installed.Handle == e.Handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// entry запись фильтра в журнале установленного: совпадение, handle и действия целиком
+func entry(rule Rule) ledger.Entry {
+	e := ledger.Entry{
+		Kind:     ledger.Filter,
+		Link:     rule.Link,
+		Priority: rule.Priority,
+		Handle:   rule.Handle,
+		IP:       rule.MatchIP,
+		Src:      rule.MatchSrc,
+		Port:     rule.MatchPort,
+		VLAN:     rule.VLAN,
+		NatTo:    rule.NatTo,
+		MirrorTo: rule.MirrorTo,
+	}
+	for _, c := range rule.Copies {
+		e.Copies = append(e.Copies, ledger.Copy{To: c.To, Link: c.Link})
+	}
+	return e
+}
+
+// FromEntry фильтр, записанный в журнал, в том виде, в каком его ставили
+func FromEntry(e ledger.Entry) Rule {
+	rule := Rule{
+		Link:      e.Link,
+		Priority:  e.Priority,
+		Handle:    e.Handle,
+		MatchIP:   e.IP,
+		MatchSrc:  e.Src,
+		MatchPort: e.Port,
+		VLAN:      e.VLAN,
+		NatTo:     e.NatTo,
+		MirrorTo:  e.MirrorTo,
+	}
+	for _, c := range e.Copies {
+		rule.Copies = append(rule.Copies, Copy{To: c.To, Link: c.Link})
+	}
+	return rule
+}
@@ -0,0 +1,96 @@
+package traffic_control
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jashakimov/multiswitcher/internal/ledger"
+)
+
+// fakeTC фильтры в памяти, handle выдается по порядку установки, Del без handle снимает все совпавшие
+type fakeTC struct {
+	rules  []Rule
+	handle uint32
+}
+
+func (t *fakeTC) Add(rule Rule) error {
+	t.handle++
+	rule.Handle = t.handle
+	t.rules = append(t.rules, rule)
+	return nil
+}
+
+func (t *fakeTC) Del(rule Rule) error {
+	rules := t.rules[:0]
+	for _, r := range t.rules {
+		if r.Priority == rule.Priority && r.sameMatch(rule) && (rule.Handle == 0 || r.Handle == rule.Handle) {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	if len(rules) == len(t.rules) {
+		return &Error{Op: "delete", Rule: rule, Err: ErrNotFound}
+	}
+	t.rules = rules
+	return nil
+}
+
+func (t *fakeTC) List(string) ([]Rule, error) {
+	return append([]Rule(nil), t.rules...), nil
+}
+
+func TestRecordedEntry(t *testing.T) {
+	rule := Rule{
+		Link:      "eth0",
+		Priority:  10,
+		MatchIP:   "233.0.0.1",
+		MatchSrc:  "10.0.0.5",
+		MatchPort: 1234,
+		VLAN:      100,
+		NatTo:     "239.0.0.1",
+		Copies:    []Copy{{To: "239.0.0.2", Link: "eth1"}},
+	}
+	l := ledger.New(filepath.Join(t.TempDir(), "ledger.json"))
+	r := NewRecorded(&fakeTC{}, l)
+	if err := r.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := l.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("записей %d, ожидалась 1", len(entries))
+	}
+	rule.Handle = 1
+	if got := FromEntry(entries[0]); !reflect.DeepEqual(got, rule) {
+		t.Fatalf("%+v, ожидалось %+v", got, rule)
+	}
+}
+
+func TestRecordedReplace(t *testing.T) {
+	old := Rule{Link: "eth0", Priority: 10, MatchIP: "233.0.0.1", NatTo: "239.0.0.1"}
+	replacement := old
+	replacement.Copies = []Copy{{To: "239.0.0.2", Link: "eth1"}}
+	other := Rule{Link: "eth0", Priority: 10, MatchIP: "233.0.0.1", MatchPort: 1234, NatTo: "239.0.0.1"}
+
+	l := ledger.New(filepath.Join(t.TempDir(), "ledger.json"))
+	r := NewRecorded(&fakeTC{}, l)
+	for _, rule := range []Rule{old, other, replacement} {
+		if err := r.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// замена выходов: новый фильтр уже стоит, старый снимается по handle
+	old.Handle = 1
+	if err := r.Del(old); err != nil {
+		t.Fatal(err)
+	}
+
+	var handles []uint32
+	for _, e := range l.Entries() {
+		handles = append(handles, e.Handle)
+	}
+	if want := []uint32{2, 3}; !reflect.DeepEqual(handles, want) {
+		t.Fatalf("handle в журнале %v, ожидалось %v", handles, want)
+	}
+}
@@ -9,12 +9,13 @@ func PrintConfig(cfg *config.Config) {
 
 	fmt.Println("Total pairs:", len(cfg.Filters), "for Interface:", cfg.Interface)
 	for i, filter := range cfg.Filters {
-		fmt.Printf(" %d) masterIP: '%s', slaveIP: '%s', changeIP: '%s', tries before switch: '%d'\n",
+		fmt.Printf(" %d) changeIP: '%s', tries before switch: '%d'\n",
 			i+1,
-			filter.Master.IP,
-			filter.Slave.IP,
 			filter.Route,
 			filter.SwitchTries,
 		)
+		for _, src := range filter.GetSources() {
+			fmt.Printf("    %s: '%s'\n", src.Name, src.IP)
+		}
 	}
 }
@@ -0,0 +1,32 @@
+package utils
+
+// Ring кольцевой буфер фиксированного размера, старые элементы вытесняются новыми.
+// Не потокобезопасен
+type Ring[T any] struct {
+	items []T
+	next  int
+	full  bool
+}
+
+func NewRing[T any](size int) *Ring[T] {
+	return &Ring[T]{items: make([]T, size)}
+}
+
+func (r *Ring[T]) Push(item T) {
+	if len(r.items) == 0 {
+		return
+	}
+	r.items[r.next] = item
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Items элементы от старых к новым
+func (r *Ring[T]) Items() []T {
+	if !r.full {
+		return append([]T(nil), r.items[:r.next]...)
+	}
+	return append(append([]T(nil), r.items[r.next:]...), r.items[:r.next]...)
+}
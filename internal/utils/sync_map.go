@@ -30,15 +30,27 @@ func (m *SyncMap[K, V]) Get(key K) (V, bool) {
 	return val, ok
 }
 
+// Values копия содержимого, по ней можно безопасно итерироваться
 func (m *SyncMap[K, V]) Values() map[K]V {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return m.items
+	items := make(map[K]V, len(m.items))
+	for k, v := range m.items {
+		items[k] = v
+	}
+	return items
 }
 
 func (m *SyncMap[K, V]) Del(ip K) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	delete(m.items, ip)
 }
+
+func (m *SyncMap[K, V]) Reset(items map[K]V) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.items = items
+}